@@ -0,0 +1,124 @@
+package main
+
+import (
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// adminConn is one open stream as listed by /admin/connections.
+type adminConn struct {
+    ID         string    `json:"id"`
+    ClientIP   string    `json:"client_ip"`
+    StartedAt  time.Time `json:"started_at"`
+    EventsSent int64     `json:"events_sent"`
+    StreamType string    `json:"stream_type"`
+}
+
+// adminTokens returns the bearer tokens guarding the /admin endpoints,
+// which are disabled unless ADMIN_TOKEN is set.
+func adminTokens() []string {
+    return splitList(getEnv("ADMIN_TOKEN", ""))
+}
+
+// adminConnectionsHandler serves /admin/connections: every open stream,
+// oldest first. It is mounted behind bearerAuthMiddleware(adminTokens).
+func adminConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+    if len(adminTokens()) == 0 {
+        http.NotFound(w, r)
+        return
+    }
+    if r.Method != http.MethodGet {
+        w.Header().Set("Allow", http.MethodGet)
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    conns := openStreams.snapshot()
+    out := make([]adminConn, 0, len(conns))
+    for _, c := range conns {
+        meta, _ := streamContextFrom(c.ctx)
+        out = append(out, adminConn{
+            ID:         meta.StreamID,
+            ClientIP:   meta.ClientIP,
+            StartedAt:  meta.StartedAt.UTC(),
+            EventsSent: c.sent.Load(),
+            StreamType: c.kind,
+        })
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(out)
+}
+
+// intervalControl is a server-wide override of every stream's intervalMs,
+// set through /admin/interval. Streams pick up a change on the fly.
+type intervalControl struct {
+    ms atomic.Int64 // 0 when streams use their own intervalMs
+
+    mu sync.Mutex
+    // changed is closed and replaced on every set, waking the streams.
+    changed chan struct{}
+}
+
+var runtimeInterval = &intervalControl{changed: make(chan struct{})}
+
+// interval returns the override, or def when there is none.
+func (c *intervalControl) interval(def time.Duration) time.Duration {
+    if ms := c.ms.Load(); ms > 0 {
+        return time.Duration(ms) * time.Millisecond
+    }
+    return def
+}
+
+// watch returns a channel that is closed on the next change.
+func (c *intervalControl) watch() <-chan struct{} {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.changed
+}
+
+func (c *intervalControl) set(ms int64) {
+    c.ms.Store(ms)
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    close(c.changed)
+    c.changed = make(chan struct{})
+}
+
+type intervalBody struct {
+    IntervalMs *int64 `json:"intervalMs"`
+}
+
+// adminIntervalHandler serves /admin/interval. PUT {"intervalMs":N} makes
+// every stream, open or new, send a number every N ms; N=0 returns them to
+// their own intervalMs. GET reports the current override.
+func adminIntervalHandler(w http.ResponseWriter, r *http.Request) {
+    if len(adminTokens()) == 0 {
+        http.NotFound(w, r)
+        return
+    }
+    switch r.Method {
+    case http.MethodGet:
+    case http.MethodPut:
+        var body intervalBody
+        if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil {
+            http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        if body.IntervalMs == nil || *body.IntervalMs < 0 {
+            http.Error(w, "invalid intervalMs: must be an integer >= 0", http.StatusBadRequest)
+            return
+        }
+        runtimeInterval.set(*body.IntervalMs)
+        loggerFrom(r.Context()).Info("stream interval changed", slog.Int64("interval_ms", *body.IntervalMs))
+    default:
+        w.Header().Set("Allow", "GET, PUT")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    current := runtimeInterval.ms.Load()
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(intervalBody{IntervalMs: &current})
+}
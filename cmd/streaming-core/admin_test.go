@@ -0,0 +1,126 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// adminRequest sends method path with body to h as the admin.
+func adminRequest(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, path, strings.NewReader(body))
+    if token != "" {
+        r.Header.Set("Authorization", "Bearer "+token)
+    }
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, r)
+    return rr
+}
+
+func TestAdminConnectionsListsStreams(t *testing.T) {
+    t.Setenv("ADMIN_TOKEN", "adm")
+    srv := newStreamServer(t)
+    sse := openStream(t, srv, "/stream?intervalMs=60000&burst=2")
+    if _, err := scanSSE(sse.Body, 2); err != nil {
+        t.Fatal(err)
+    }
+    // NDJSON sends its headers with the first line, so burst one event.
+    openStream(t, srv, "/stream.ndjson?intervalMs=60000&burst=1")
+
+    h := bearerAuthMiddleware(adminTokens, nil)(http.HandlerFunc(adminConnectionsHandler))
+    var conns []adminConn
+    waitFor(t, "two streams listed", func() bool {
+        rr := adminRequest(h, http.MethodGet, "/admin/connections", "adm", "")
+        conns = nil
+        return json.Unmarshal(rr.Body.Bytes(), &conns) == nil && len(conns) == 2 && conns[0].EventsSent == 2
+    })
+    if conns[0].StreamType != "sse" || conns[1].StreamType != "ndjson" {
+        t.Errorf("stream types %q, %q; want sse then ndjson", conns[0].StreamType, conns[1].StreamType)
+    }
+    for _, c := range conns {
+        if c.ID == "" || c.ClientIP != "127.0.0.1" || c.StartedAt.IsZero() {
+            t.Errorf("connection %+v", c)
+        }
+    }
+    if conns[0].StartedAt.After(conns[1].StartedAt) {
+        t.Error("connections not oldest first")
+    }
+}
+
+func TestAdminEndpointsNeedToken(t *testing.T) {
+    for _, handler := range []http.HandlerFunc{adminConnectionsHandler, adminIntervalHandler} {
+        h := bearerAuthMiddleware(adminTokens, nil)(handler)
+        t.Setenv("ADMIN_TOKEN", "")
+        if rr := adminRequest(h, http.MethodGet, "/admin", "", ""); rr.Code != http.StatusNotFound {
+            t.Errorf("without ADMIN_TOKEN: status %d, want 404", rr.Code)
+        }
+        t.Setenv("ADMIN_TOKEN", "adm")
+        if rr := adminRequest(h, http.MethodGet, "/admin", "nope", ""); rr.Code != http.StatusUnauthorized {
+            t.Errorf("wrong token: status %d, want 401", rr.Code)
+        }
+        // Stream tokens do not open the admin endpoints.
+        t.Setenv("AUTH_TOKENS", "stream")
+        if rr := adminRequest(h, http.MethodGet, "/admin", "stream", ""); rr.Code != http.StatusUnauthorized {
+            t.Errorf("stream token: status %d, want 401", rr.Code)
+        }
+    }
+}
+
+func TestAdminIntervalWidensGap(t *testing.T) {
+    t.Setenv("ADMIN_TOKEN", "adm")
+    t.Setenv("DISABLE_COMPRESSION", "true")
+    t.Cleanup(func() { runtimeInterval.set(0) })
+    srv := newStreamServer(t)
+    h := bearerAuthMiddleware(adminTokens, nil)(http.HandlerFunc(adminIntervalHandler))
+
+    resp := openStream(t, srv, "/stream?intervalMs=100")
+    arrivals := make(chan time.Time, 16)
+    go func() {
+        defer close(arrivals)
+        sc := bufio.NewScanner(resp.Body)
+        for sc.Scan() {
+            if strings.HasPrefix(sc.Text(), "data:") {
+                arrivals <- time.Now()
+            }
+        }
+    }()
+    gap := func() time.Duration {
+        t.Helper()
+        prev := <-arrivals
+        select {
+        case next := <-arrivals:
+            return next.Sub(prev)
+        case <-time.After(2 * time.Second):
+            t.Fatal("no event within 2s")
+            return 0
+        }
+    }
+
+    if d := gap(); d > 300*time.Millisecond {
+        t.Fatalf("gap at intervalMs=100 is %v", d)
+    }
+    if rr := adminRequest(h, http.MethodPut, "/admin/interval", "adm", `{"intervalMs":500}`); rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"intervalMs":500}` {
+        t.Fatalf("PUT: %d %q", rr.Code, rr.Body)
+    }
+    // Skip whatever was already sent, then time a full interval.
+    for len(arrivals) > 0 {
+        <-arrivals
+    }
+    <-arrivals
+    if d := gap(); d < 400*time.Millisecond || d > 900*time.Millisecond {
+        t.Errorf("gap after PUT intervalMs=500 is %v", d)
+    }
+
+    for _, body := range []string{`{"intervalMs":-1}`, `{}`, `nope`} {
+        if rr := adminRequest(h, http.MethodPut, "/admin/interval", "adm", body); rr.Code != http.StatusBadRequest {
+            t.Errorf("PUT %s: status %d, want 400", body, rr.Code)
+        }
+    }
+    if rr := adminRequest(h, http.MethodGet, "/admin/interval", "adm", ""); strings.TrimSpace(rr.Body.String()) != `{"intervalMs":500}` {
+        t.Errorf("GET after bad PUTs: %q", rr.Body)
+    }
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "testing"
+)
+
+func TestBinaryStreamRoundTrip(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(binaryStreamHandler))
+    t.Cleanup(srv.Close)
+
+    resp, err := http.Get(srv.URL + "/stream/binary?intervalMs=1&limit=100&burst=100&start=7")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if ct := resp.Header.Get("Content-Type"); ct != "application/octet-stream" {
+        t.Errorf("Content-Type = %q", ct)
+    }
+    if !slices.Equal(resp.TransferEncoding, []string{"chunked"}) {
+        t.Errorf("TransferEncoding = %v, want chunked", resp.TransferEncoding)
+    }
+    for i := uint32(0); i < 100; i++ {
+        seq, val, err := ReadBinaryFrame(resp.Body)
+        if err != nil {
+            t.Fatalf("frame %d: %v", i, err)
+        }
+        if seq != 7+i || val != 7+i {
+            t.Fatalf("frame %d = (%d, %d), want (%d, %d)", i, seq, val, 7+i, 7+i)
+        }
+    }
+    if _, _, err := ReadBinaryFrame(resp.Body); err != io.EOF {
+        t.Errorf("after the limit: err = %v, want io.EOF", err)
+    }
+}
+
+func TestReadBinaryFrameTruncated(t *testing.T) {
+    frame := []byte{0, 0, 1, 0, 0, 0, 0, 42}
+    seq, val, err := ReadBinaryFrame(bytes.NewReader(frame))
+    if err != nil || seq != 256 || val != 42 {
+        t.Errorf("ReadBinaryFrame = %d, %d, %v; want 256, 42", seq, val, err)
+    }
+    if _, _, err := ReadBinaryFrame(bytes.NewReader(frame[:5])); !errors.Is(err, io.ErrUnexpectedEOF) {
+        t.Errorf("truncated frame: err = %v, want io.ErrUnexpectedEOF", err)
+    }
+}
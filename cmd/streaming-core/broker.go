@@ -0,0 +1,279 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// publishBuffer is how many published events may queue up while the broker
+// is busy fanning out.
+const publishBuffer = 256
+
+// backpressurePolicy decides what happens to a subscriber whose buffer is
+// full when an event is published.
+type backpressurePolicy string
+
+const (
+    // dropOldest discards the oldest buffered event to make room, so a slow
+    // subscriber sees the most recent events.
+    dropOldest backpressurePolicy = "drop_oldest"
+    // dropNewest discards the new event, so a slow subscriber sees a gap
+    // after what it has buffered.
+    dropNewest backpressurePolicy = "drop_newest"
+    // disconnect closes the subscriber's channel, ending its stream; the
+    // client can reconnect with Last-Event-ID to catch up from history.
+    disconnect backpressurePolicy = "disconnect"
+)
+
+// brokerConfig is what every topic's broker is created with.
+type brokerConfig struct {
+    // history is how many published events are kept for replay.
+    history int
+    // buffer is how many events a subscriber may fall behind before the
+    // policy applies.
+    buffer int
+    policy backpressurePolicy
+}
+
+// brokerConfigFromEnv reads REPLAY_BUFFER_SIZE (alias HISTORY_SIZE),
+// SUBSCRIBER_BUFFER and BACKPRESSURE_POLICY.
+func brokerConfigFromEnv() (brokerConfig, error) {
+    history, _ := strconv.Atoi(getEnv("REPLAY_BUFFER_SIZE", getEnv("HISTORY_SIZE", "512")))
+    cfg := brokerConfig{history: history, policy: backpressurePolicy(getEnv("BACKPRESSURE_POLICY", string(dropNewest)))}
+    buffer, err := strconv.Atoi(getEnv("SUBSCRIBER_BUFFER", "16"))
+    if err != nil || buffer < 1 {
+        return cfg, fmt.Errorf("invalid SUBSCRIBER_BUFFER: must be an integer >= 1")
+    }
+    cfg.buffer = buffer
+    switch cfg.policy {
+    case dropOldest, dropNewest, disconnect:
+    default:
+        return cfg, fmt.Errorf("invalid BACKPRESSURE_POLICY %q: must be drop_oldest, drop_newest or disconnect", cfg.policy)
+    }
+    return cfg, nil
+}
+
+// Broker fans events out from any number of publishers to every subscriber.
+// A single goroutine owns the subscriber set, so no locking is needed. Fan-out
+// never blocks: a subscriber whose buffer is full is handled by the
+// backpressure policy instead of stalling everyone else. Published events are
+// numbered from 1 and the most recent ones are kept so reconnecting clients
+// can catch up.
+type Broker struct {
+    publish     chan SSEEvent
+    subscribe   chan subscribeRequest
+    unsubscribe chan (<-chan SSEEvent)
+    cfg         brokerConfig
+    // count mirrors the number of subscribers for readers outside run.
+    count atomic.Int64
+    // dropped counts the events subscribers missed, or were disconnected
+    // over, because their buffer was full.
+    dropped atomic.Int64
+
+    // subs mirrors the subscriber channels for QueueDepth.
+    mu   sync.Mutex
+    subs map[chan SSEEvent]bool
+
+    // lastUsed is when the broker was last looked up, subscribed or
+    // published to, in Unix nanoseconds.
+    lastUsed atomic.Int64
+    // done is closed by stop.
+    done chan struct{}
+}
+
+type subscribeRequest struct {
+    lastSeq int
+    reply   chan subscription
+}
+
+type subscription struct {
+    events   <-chan SSEEvent
+    missed   []SSEEvent
+    complete bool
+}
+
+func newBroker(cfg brokerConfig) *Broker {
+    b := &Broker{
+        publish:     make(chan SSEEvent, publishBuffer),
+        subscribe:   make(chan subscribeRequest),
+        unsubscribe: make(chan (<-chan SSEEvent)),
+        cfg:         cfg,
+        subs:        make(map[chan SSEEvent]bool),
+        done:        make(chan struct{}),
+    }
+    b.touch()
+    go b.run(newEventStore(cfg.history))
+    return b
+}
+
+func (b *Broker) run(history *EventStore) {
+    subscribers := make(map[<-chan SSEEvent]chan SSEEvent)
+    seq := 0
+    for {
+        select {
+        case <-b.done:
+            return
+        case req := <-b.subscribe:
+            ch := make(chan SSEEvent, b.cfg.buffer)
+            subscribers[ch] = ch
+            b.track(ch, true)
+            b.count.Store(int64(len(subscribers)))
+            sub := subscription{events: ch, complete: true}
+            if req.lastSeq >= 0 {
+                sub.missed, sub.complete = history.Since(req.lastSeq)
+            }
+            req.reply <- sub
+        case ch := <-b.unsubscribe:
+            if sub, ok := subscribers[ch]; ok {
+                delete(subscribers, ch)
+                b.track(sub, false)
+                b.count.Store(int64(len(subscribers)))
+                close(sub)
+            }
+        case e := <-b.publish:
+            seq++
+            if e.ID == "" {
+                e.ID = strconv.Itoa(seq)
+            }
+            history.Append(seq, e)
+            for key, sub := range subscribers {
+                if !b.deliver(sub, e) {
+                    delete(subscribers, key)
+                    b.track(sub, false)
+                    b.count.Store(int64(len(subscribers)))
+                    close(sub)
+                }
+            }
+        }
+    }
+}
+
+// deliver hands e to sub without blocking, applying the backpressure policy
+// when sub's buffer is full. It returns false when sub is to be
+// disconnected.
+func (b *Broker) deliver(sub chan SSEEvent, e SSEEvent) bool {
+    select {
+    case sub <- e:
+        return true
+    default:
+    }
+    b.dropped.Add(1)
+    switch b.cfg.policy {
+    case disconnect:
+        return false
+    case dropOldest:
+        // The subscriber may drain the buffer in between, in which case
+        // there is nothing to discard; the send below cannot block either
+        // way, since only this goroutine sends.
+        select {
+        case <-sub:
+        default:
+        }
+        select {
+        case sub <- e:
+        default:
+        }
+    }
+    return true
+}
+
+// Subscribe registers a new subscriber. The returned channel is closed by
+// Unsubscribe, or by the broker when the disconnect policy drops a slow
+// subscriber.
+func (b *Broker) Subscribe() <-chan SSEEvent {
+    return b.subscribeFrom(-1).events
+}
+
+// Resume subscribes and returns the buffered events published after lastSeq.
+// Both happen in one step of the broker loop so no event is missed or
+// delivered twice. complete is false when some of the missed events were
+// already evicted.
+func (b *Broker) Resume(lastSeq int) (ch <-chan SSEEvent, missed []SSEEvent, complete bool) {
+    sub := b.subscribeFrom(lastSeq)
+    return sub.events, sub.missed, sub.complete
+}
+
+func (b *Broker) subscribeFrom(lastSeq int) subscription {
+    b.touch()
+    reply := make(chan subscription, 1)
+    select {
+    case b.subscribe <- subscribeRequest{lastSeq: lastSeq, reply: reply}:
+        return <-reply
+    case <-b.done:
+        // A stopped broker ends the stream at once, as if it had been
+        // dropped for falling behind, and the client reconnects.
+        ch := make(chan SSEEvent)
+        close(ch)
+        return subscription{events: ch, complete: true}
+    }
+}
+
+// Unsubscribe removes ch and closes it. It is safe to call more than once.
+func (b *Broker) Unsubscribe(ch <-chan SSEEvent) {
+    select {
+    case b.unsubscribe <- ch:
+    case <-b.done:
+    }
+}
+
+// Subscribers returns the number of current subscribers.
+func (b *Broker) Subscribers() int {
+    return int(b.count.Load())
+}
+
+func (b *Broker) track(sub chan SSEEvent, add bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if add {
+        b.subs[sub] = true
+    } else {
+        delete(b.subs, sub)
+    }
+}
+
+// QueueDepth returns the number of published events not yet delivered:
+// those waiting to be fanned out plus those buffered for subscribers that
+// have not caught up. It grows with slow subscribers.
+func (b *Broker) QueueDepth() int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    depth := len(b.publish)
+    for sub := range b.subs {
+        depth += len(sub)
+    }
+    return depth
+}
+
+// Dropped returns how many events subscribers missed, or were disconnected
+// over, because they fell behind.
+func (b *Broker) Dropped() int64 {
+    return b.dropped.Load()
+}
+
+// Publish queues e for delivery to every current subscriber. Events without
+// an ID are given their sequence number as ID. Once the broker is stopped
+// events are discarded.
+func (b *Broker) Publish(e SSEEvent) {
+    b.touch()
+    select {
+    case b.publish <- e:
+    case <-b.done:
+    }
+}
+
+func (b *Broker) touch() {
+    b.lastUsed.Store(time.Now().UnixNano())
+}
+
+// idleSince returns when the broker was last used.
+func (b *Broker) idleSince() time.Time {
+    return time.Unix(0, b.lastUsed.Load())
+}
+
+// stop ends the broker's goroutine, releasing its history.
+func (b *Broker) stop() {
+    close(b.done)
+}
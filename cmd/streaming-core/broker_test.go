@@ -0,0 +1,202 @@
+package main
+
+import (
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func testBrokerConfig() brokerConfig {
+    return brokerConfig{history: 64, buffer: 64, policy: dropNewest}
+}
+
+// receive reads n events from ch, failing the test if they take over 2s.
+func receive(t *testing.T, ch <-chan SSEEvent, n int) []SSEEvent {
+    t.Helper()
+    var got []SSEEvent
+    timeout := time.After(2 * time.Second)
+    for len(got) < n {
+        select {
+        case e, ok := <-ch:
+            if !ok {
+                t.Fatalf("channel closed after %d of %d events", len(got), n)
+            }
+            got = append(got, e)
+        case <-timeout:
+            t.Fatalf("got %d of %d events", len(got), n)
+        }
+    }
+    return got
+}
+
+func TestBrokerFansOutToEverySubscriber(t *testing.T) {
+    b := newBroker(testBrokerConfig())
+    a, c := b.Subscribe(), b.Subscribe()
+    defer b.Unsubscribe(a)
+    defer b.Unsubscribe(c)
+    if n := b.Subscribers(); n != 2 {
+        t.Fatalf("Subscribers() = %d, want 2", n)
+    }
+
+    // Both buffers hold all 20, so they can be read afterwards.
+    for i := 1; i <= 20; i++ {
+        b.Publish(SSEEvent{Event: "n", Data: strconv.Itoa(i)})
+    }
+    results := [][]SSEEvent{receive(t, a, 20), receive(t, c, 20)}
+    for s, got := range results {
+        for i, e := range got {
+            if want := strconv.Itoa(i + 1); e.Data != want || e.ID != want {
+                t.Fatalf("subscriber %d event %d = %+v, want id and data %s", s, i, e, want)
+            }
+        }
+    }
+}
+
+func TestBrokerUnsubscribeClosesChannel(t *testing.T) {
+    b := newBroker(testBrokerConfig())
+    ch := b.Subscribe()
+    b.Unsubscribe(ch)
+    b.Unsubscribe(ch)
+    if _, ok := <-ch; ok {
+        t.Fatal("channel open after Unsubscribe")
+    }
+    if n := b.Subscribers(); n != 0 {
+        t.Fatalf("Subscribers() = %d, want 0", n)
+    }
+    // Publishing with nobody subscribed does not block.
+    b.Publish(SSEEvent{Data: "x"})
+}
+
+func TestStreamsShareBrokerEvents(t *testing.T) {
+    srv := newStreamServer(t)
+    topic := uniqueTopic("shared")
+    // A slow number feed, so the published event is the first on both.
+    a := openStream(t, srv, "/stream/"+topic+"?intervalMs=60000")
+    c := openStream(t, srv, "/stream/"+topic+"?intervalMs=60000&start=100")
+    b, _ := topics.get(topic)
+    waitFor(t, "2 subscribers", func() bool { return b.Subscribers() == 2 })
+    b.Publish(SSEEvent{Event: "order", Data: `{"sku":42}`})
+
+    want := SSEEvent{ID: "t1", Event: "order", Data: `{"sku":42}`}
+    for i, resp := range []*http.Response{a, c} {
+        got, err := scanSSE(resp.Body, 1)
+        if len(got) != 1 || got[0] != want {
+            t.Errorf("stream %d got %+v (%v), want %+v", i, got, err, want)
+        }
+    }
+}
+
+func TestBrokerResumeRacingPublishes(t *testing.T) {
+    cfg := testBrokerConfig()
+    cfg.history, cfg.buffer = 512, 512
+    b := newBroker(cfg)
+    const total = 300
+    // A client can only resume from an ID it has seen, so 1-10 are out.
+    probe := b.Subscribe()
+    for i := 1; i <= 10; i++ {
+        b.Publish(SSEEvent{Data: strconv.Itoa(i)})
+    }
+    receive(t, probe, 10)
+    b.Unsubscribe(probe)
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        for i := 11; i <= total; i++ {
+            b.Publish(SSEEvent{Data: strconv.Itoa(i)})
+        }
+    }()
+    // Resume part way through: missed and live events together must be
+    // every event after 10 exactly once, in order, wherever the split falls.
+    ch, missed, complete := b.Resume(10)
+    defer b.Unsubscribe(ch)
+    if !complete {
+        t.Fatal("Resume(10) reported a gap with room for every event")
+    }
+    <-done
+    var live []SSEEvent
+    if n := total - 10 - len(missed); n > 0 {
+        live = receive(t, ch, n)
+    }
+    got := append(missed, live...)
+    if len(got) != total-10 {
+        t.Fatalf("got %d events, want %d", len(got), total-10)
+    }
+    for i, e := range got {
+        if want := strconv.Itoa(i + 11); e.ID != want {
+            t.Fatalf("event %d has id %s, want %s (%d replayed)", i, e.ID, want, len(missed))
+        }
+    }
+}
+
+func TestBrokerBackpressurePolicies(t *testing.T) {
+    tests := []struct {
+        policy  backpressurePolicy
+        slow    []string // what the slow subscriber has buffered
+        closed  bool     // whether it was disconnected
+        dropped int64
+        subs    int
+    }{
+        {dropNewest, []string{"1", "2"}, false, 3, 2},
+        {dropOldest, []string{"4", "5"}, false, 3, 2},
+        {disconnect, []string{"1", "2"}, true, 1, 1},
+    }
+    for _, tt := range tests {
+        t.Run(string(tt.policy), func(t *testing.T) {
+            b := newBroker(brokerConfig{history: 64, buffer: 2, policy: tt.policy})
+            t.Cleanup(b.stop)
+            slow := b.Subscribe()
+            fast := b.Subscribe()
+            // Each publish is fanned out before the next, since the fast
+            // subscriber receives it first.
+            for i := 1; i <= 5; i++ {
+                b.Publish(SSEEvent{Data: strconv.Itoa(i)})
+                if e := receive(t, fast, 1)[0]; e.Data != strconv.Itoa(i) {
+                    t.Fatalf("fast subscriber got %q, want %d", e.Data, i)
+                }
+            }
+
+            var got []string
+            for len(got) < len(tt.slow) {
+                got = append(got, (<-slow).Data)
+            }
+            if !slices.Equal(got, tt.slow) {
+                t.Errorf("slow subscriber got %v, want %v", got, tt.slow)
+            }
+            select {
+            case e, ok := <-slow:
+                if ok || !tt.closed {
+                    t.Errorf("slow subscriber: extra event %+v, or not closed (ok=%v)", e, ok)
+                }
+            default:
+                if tt.closed {
+                    t.Error("slow subscriber not disconnected")
+                }
+            }
+            if d := b.Dropped(); d != tt.dropped {
+                t.Errorf("Dropped() = %d, want %d", d, tt.dropped)
+            }
+            if n := b.Subscribers(); n != tt.subs {
+                t.Errorf("Subscribers() = %d, want %d", n, tt.subs)
+            }
+        })
+    }
+}
+
+func TestBrokerConfigFromEnv(t *testing.T) {
+    t.Setenv("SUBSCRIBER_BUFFER", "4")
+    t.Setenv("BACKPRESSURE_POLICY", "drop_oldest")
+    if cfg, err := brokerConfigFromEnv(); err != nil || cfg.buffer != 4 || cfg.policy != dropOldest {
+        t.Errorf("brokerConfigFromEnv() = %+v, %v", cfg, err)
+    }
+    for env, bad := range map[string]string{"BACKPRESSURE_POLICY": "block", "SUBSCRIBER_BUFFER": "0"} {
+        t.Run(env, func(t *testing.T) {
+            t.Setenv(env, bad)
+            if _, err := brokerConfigFromEnv(); err == nil || !strings.Contains(err.Error(), env) {
+                t.Errorf("%s=%s: err = %v, want one naming %s", env, bad, err, env)
+            }
+        })
+    }
+}
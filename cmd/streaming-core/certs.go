@@ -0,0 +1,41 @@
+package main
+
+import (
+    "crypto/tls"
+    "fmt"
+    "sync/atomic"
+)
+
+// certStore holds the server certificate and swaps it on reload, so a
+// renewed certificate is picked up by new handshakes while connections
+// made with the old one, including open streams, carry on.
+type certStore struct {
+    certFile, keyFile string
+    cert              atomic.Pointer[tls.Certificate]
+}
+
+// newCertStore loads the key pair, failing with an error naming the files
+// if either is missing or they do not match.
+func newCertStore(certFile, keyFile string) (*certStore, error) {
+    s := &certStore{certFile: certFile, keyFile: keyFile}
+    if err := s.reload(); err != nil {
+        return nil, err
+    }
+    return s, nil
+}
+
+// reload reads the key pair again. On error the current certificate stays
+// in use.
+func (s *certStore) reload() error {
+    cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+    if err != nil {
+        return fmt.Errorf("load TLS key pair %s, %s: %w", s.certFile, s.keyFile, err)
+    }
+    s.cert.Store(&cert)
+    return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (s *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+    return s.cert.Load(), nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "net/url"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/Amarifields/streaming-core/streamingcore"
+)
+
+// StreamContext is the metadata of one open stream. beginStream stores it
+// in the stream's context so logging, metrics and /stats read it from there.
+type StreamContext struct {
+    StartedAt time.Time
+    ClientIP  string
+    StreamID  string
+    // Subject is the JWT subject of the caller, if it sent a JWT.
+    Subject string
+}
+
+type streamContextKey struct{}
+
+func withStreamContext(ctx context.Context, sc StreamContext) context.Context {
+    return context.WithValue(ctx, streamContextKey{}, sc)
+}
+
+// streamContextFrom returns the StreamContext stored in ctx, if any.
+func streamContextFrom(ctx context.Context) (StreamContext, bool) {
+    sc, ok := ctx.Value(streamContextKey{}).(StreamContext)
+    return sc, ok
+}
+
+// streamConn is one open stream: its parsed options, the broker it reads
+// from and what it has sent so far.
+type streamConn struct {
+    id     string
+    remote string
+    path   string
+    kind   string // transport: "sse", "ndjson", "ws" or "binary"
+    query  url.Values
+    opts   streamOpts
+    broker *Broker
+    // ctx carries the StreamContext and the stream's logger; handlers
+    // derive the context they run the stream with from it.
+    ctx  context.Context
+    sent atomic.Int64
+    // lastSeq is the last number written, or -1 before the first.
+    lastSeq atomic.Int64
+    // sourceErr is why the stream's Source failed, set before its feed is
+    // closed.
+    sourceErr error
+    // err is why runStream stopped, set when it returns.
+    err error
+    // retry is the reconnect delay in ms sent to an SSE client, after
+    // jitter; 0 if none was sent, -1 for transports without one.
+    retry   int
+    release func()
+}
+
+// close releases the stream's slot, removes it from openStreams and logs
+// how it ended.
+func (c *streamConn) close() {
+    openStreams.remove(c)
+    c.release()
+    reason := closeReason(c.err)
+    meta, _ := streamContextFrom(c.ctx)
+    attrs := []slog.Attr{
+        slog.Int64("events", c.sent.Load()),
+        slog.Int64("duration_ms", time.Since(meta.StartedAt).Milliseconds()),
+        slog.String("reason", reason),
+    }
+    if c.retry >= 0 {
+        attrs = append(attrs, slog.Int("retry_ms", c.retry))
+    }
+    level := slog.LevelInfo
+    switch {
+    case errors.Is(c.err, streamingcore.ErrClientGone):
+        // Noticed by a failed write rather than the request context: as
+        // routine as any other disconnect, the error is only of interest
+        // when debugging.
+        level = slog.LevelDebug
+        attrs = append(attrs, slog.Any("error", c.err))
+    case reason == "write_error" || reason == "write_timeout":
+        level = slog.LevelError
+        attrs = append(attrs, slog.Any("error", c.err))
+    case reason == "slow_consumer" || reason == "source_error":
+        level = slog.LevelWarn
+        attrs = append(attrs, slog.Any("error", c.err))
+    }
+    loggerFrom(c.ctx).LogAttrs(context.Background(), level, "stream closed", attrs...)
+}
+
+func (c *streamConn) startedAt() time.Time {
+    meta, _ := streamContextFrom(c.ctx)
+    return meta.StartedAt
+}
+
+func closeReason(err error) string {
+    switch {
+    case err == nil:
+        return "aborted"
+    case errors.Is(err, errStreamComplete):
+        return "complete"
+    case errors.Is(err, errShuttingDown):
+        return "shutdown"
+    case errors.Is(err, errSlowConsumer):
+        return "slow_consumer"
+    case errors.Is(err, errMaxDuration):
+        return "max_duration"
+    case errors.Is(err, errSourceFailed):
+        return "source_error"
+    case errors.Is(err, context.Canceled), errors.Is(err, streamingcore.ErrClientGone):
+        return "client_closed"
+    case errors.Is(err, streamingcore.ErrWriteTimeout):
+        return "write_timeout"
+    default:
+        return "write_error"
+    }
+}
+
+// countingSink counts the events written through it. An event the sink
+// rejects as larger than MAX_EVENT_BYTES is dropped: logged, counted in
+// streaming_events_dropped_total and skipped, and the stream goes on.
+type countingSink struct {
+    eventSink
+    conn *streamConn
+}
+
+func (s countingSink) Write(e SSEEvent) error {
+    _, err := s.send(e)
+    return err
+}
+
+// send writes e and reports whether it went out rather than being dropped.
+func (s countingSink) send(e SSEEvent) (bool, error) {
+    err := s.eventSink.Write(e)
+    if errors.Is(err, streamingcore.ErrEventTooLarge) {
+        loggerFrom(s.conn.ctx).Warn("event dropped", slog.String("event_id", e.ID), slog.Int("bytes", len(e.Data)), slog.Int("max_bytes", maxEventBytes))
+        defaultMetrics.eventsDropped.Inc()
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    s.conn.sent.Add(1)
+    return true, nil
+}
+
+// connRegistry is the set of open streams, reported by /stats.
+type connRegistry struct {
+    mu    sync.Mutex
+    conns map[*streamConn]struct{}
+}
+
+var openStreams = &connRegistry{conns: make(map[*streamConn]struct{})}
+
+func (reg *connRegistry) add(c *streamConn) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    reg.conns[c] = struct{}{}
+}
+
+func (reg *connRegistry) remove(c *streamConn) {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    delete(reg.conns, c)
+}
+
+// count returns the number of open streams.
+func (reg *connRegistry) count() int {
+    reg.mu.Lock()
+    defer reg.mu.Unlock()
+    return len(reg.conns)
+}
+
+// snapshot returns the open streams, oldest first.
+func (reg *connRegistry) snapshot() []*streamConn {
+    reg.mu.Lock()
+    conns := make([]*streamConn, 0, len(reg.conns))
+    for c := range reg.conns {
+        conns = append(conns, c)
+    }
+    reg.mu.Unlock()
+    sort.Slice(conns, func(i, j int) bool { return conns[i].startedAt().Before(conns[j].startedAt()) })
+    return conns
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+
+    "github.com/Amarifields/streaming-core/streamingcore"
+)
+
+func TestStreamContextRoundTrip(t *testing.T) {
+    if _, ok := streamContextFrom(context.Background()); ok {
+        t.Error("found a StreamContext in an empty context")
+    }
+    want := StreamContext{StartedAt: time.Unix(1700000000, 0), ClientIP: "192.0.2.1", StreamID: "s1", Subject: "alice"}
+    ctx := withStreamContext(context.Background(), want)
+    got, ok := streamContextFrom(ctx)
+    if !ok || got != want {
+        t.Errorf("streamContextFrom() = %+v, %v; want %+v", got, ok, want)
+    }
+}
+
+func TestBeginStreamStoresStreamContext(t *testing.T) {
+    var ids []string
+    for i := 0; i < 2; i++ {
+        r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+        r.RemoteAddr = "198.51.100.4:5000"
+        before := time.Now()
+        sc, ok := beginStream(httptest.NewRecorder(), r, "sse", "")
+        if !ok {
+            t.Fatal("beginStream refused the stream")
+        }
+        meta, ok := streamContextFrom(sc.ctx)
+        sc.close()
+        if !ok || meta.ClientIP != "198.51.100.4" || meta.StartedAt.Before(before) || meta.StreamID == "" {
+            t.Fatalf("stream context %+v, %v", meta, ok)
+        }
+        ids = append(ids, meta.StreamID)
+    }
+    if ids[0] == ids[1] {
+        t.Errorf("two streams share the ID %s", ids[0])
+    }
+}
+
+func TestStreamClosedReasonAndLevel(t *testing.T) {
+    wrap := func(sentinel error) error { return fmt.Errorf("%w: %w", sentinel, errors.New("cause")) }
+    tests := []struct {
+        err     error
+        reason  string
+        level   string
+        logsErr bool
+    }{
+        {nil, "aborted", "INFO", false},
+        {errStreamComplete, "complete", "INFO", false},
+        {errShuttingDown, "shutdown", "INFO", false},
+        {errMaxDuration, "max_duration", "INFO", false},
+        {context.Canceled, "client_closed", "INFO", false},
+        {wrap(streamingcore.ErrClientGone), "client_closed", "DEBUG", true},
+        {wrap(streamingcore.ErrWriteTimeout), "write_timeout", "ERROR", true},
+        {wrap(streamingcore.ErrBufferFull), "write_error", "ERROR", true},
+        {errors.New("unexpected"), "write_error", "ERROR", true},
+        {errSlowConsumer, "slow_consumer", "WARN", true},
+        {wrap(errSourceFailed), "source_error", "WARN", true},
+    }
+    for _, tt := range tests {
+        var buf bytes.Buffer
+        logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+        ctx := withStreamContext(context.Background(), StreamContext{StartedAt: time.Now()})
+        sc := &streamConn{ctx: context.WithValue(ctx, loggerKey{}, logger), err: tt.err, retry: -1, release: func() {}}
+        sc.close()
+
+        var rec map[string]any
+        if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+            t.Fatalf("%v: log %q: %v", tt.err, buf.String(), err)
+        }
+        _, hasErr := rec["error"]
+        if rec["reason"] != tt.reason || rec["level"] != tt.level || hasErr != tt.logsErr {
+            t.Errorf("%v: logged reason %v at %v with error %v; want %s at %s, error logged %v",
+                tt.err, rec["reason"], rec["level"], rec["error"], tt.reason, tt.level, tt.logsErr)
+        }
+        if _, ok := rec["retry_ms"]; ok {
+            t.Errorf("%v: retry_ms logged for a transport without retry", tt.err)
+        }
+    }
+}
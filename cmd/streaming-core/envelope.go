@@ -0,0 +1,86 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// envelope is the stable JSON shape of every event sent with format=json.
+type envelope struct {
+    Seq       int    `json:"seq"`
+    TS        string `json:"ts"`
+    RequestID string `json:"requestId,omitempty"`
+    Data      any    `json:"data"`
+}
+
+// envelopeEncoder wraps event payloads in an envelope. Both the number feed
+// and broker events go through it, so clients see one shape regardless of
+// the producer. The output is compact JSON and never contains a raw newline.
+type envelopeEncoder struct {
+    now func() time.Time
+}
+
+var jsonEnvelope = envelopeEncoder{now: time.Now}
+
+// Encode returns the envelope for data published at seq, sent on the
+// connection with the given request ID ("" to omit it).
+func (enc envelopeEncoder) Encode(seq int, data any, requestID string) (string, error) {
+    b, err := json.Marshal(envelope{
+        Seq:       seq,
+        TS:        enc.now().UTC().Format(time.RFC3339Nano),
+        RequestID: requestID,
+        Data:      data,
+    })
+    if err != nil {
+        return "", err
+    }
+    return string(b), nil
+}
+
+// tick is the payload of number events sent with payload=json.
+type tick struct {
+    Seq   int    `json:"seq"`
+    TS    string `json:"ts"`
+    Value int    `json:"value"`
+}
+
+// EncodeTick returns the tick for value at seq. It encodes into a buffer first so a
+// failed encode never reaches the client as a partial data line.
+func (enc envelopeEncoder) EncodeTick(seq, value int) (string, error) {
+    var buf bytes.Buffer
+    err := json.NewEncoder(&buf).Encode(tick{
+        Seq:   seq,
+        TS:    enc.now().UTC().Format(time.RFC3339Nano),
+        Value: value,
+    })
+    if err != nil {
+        return "", err
+    }
+    return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// formatEvent renders the data field for value at seq in opts.format.
+func formatEvent(seq, value int, opts streamOpts) (string, error) {
+    if opts.format == "json" {
+        return jsonEnvelope.Encode(seq, value, opts.requestID)
+    }
+    return strconv.Itoa(value), nil
+}
+
+// formatBrokerEvent applies opts.format to a published event. In json mode
+// the seq is the broker-assigned ID, or 0 when the publisher chose its own.
+func formatBrokerEvent(e SSEEvent, opts streamOpts) (SSEEvent, error) {
+    if opts.format != "json" {
+        return e, nil
+    }
+    seq, _ := strconv.Atoi(e.ID)
+    data, err := jsonEnvelope.Encode(seq, e.Data, opts.requestID)
+    if err != nil {
+        return e, err
+    }
+    e.Data = data
+    return e, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+var fixedEnvelope = envelopeEncoder{now: func() time.Time {
+    return time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.FixedZone("CEST", 2*3600))
+}}
+
+// The envelope is a client-facing contract: these strings change only with
+// a deliberate, announced format change.
+func TestEnvelopeGolden(t *testing.T) {
+    tests := []struct {
+        name      string
+        seq       int
+        data      any
+        requestID string
+        want      string
+    }{
+        {"number", 7, 42, "", `{"seq":7,"ts":"2024-05-01T10:30:00.123456789Z","data":42}`},
+        {"request id", 7, 42, "req-1", `{"seq":7,"ts":"2024-05-01T10:30:00.123456789Z","requestId":"req-1","data":42}`},
+        {"string", 1, "a\nb", "", `{"seq":1,"ts":"2024-05-01T10:30:00.123456789Z","data":"a\nb"}`},
+        {"html", 1, "<b>&", "", `{"seq":1,"ts":"2024-05-01T10:30:00.123456789Z","data":"\u003cb\u003e\u0026"}`},
+        {"nil", 0, nil, "", `{"seq":0,"ts":"2024-05-01T10:30:00.123456789Z","data":null}`},
+    }
+    for _, tt := range tests {
+        got, err := fixedEnvelope.Encode(tt.seq, tt.data, tt.requestID)
+        if err != nil {
+            t.Fatalf("%s: %v", tt.name, err)
+        }
+        if got != tt.want {
+            t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestTickGolden(t *testing.T) {
+    got, err := fixedEnvelope.EncodeTick(3, 9)
+    if want := `{"seq":3,"ts":"2024-05-01T10:30:00.123456789Z","value":9}`; err != nil || got != want {
+        t.Errorf("EncodeTick(3, 9) = %s, %v; want %s", got, err, want)
+    }
+}
+
+func TestEnvelopeIsOneDataLine(t *testing.T) {
+    data, err := fixedEnvelope.Encode(1, "line one\nline two\r\n", "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    rr := httptest.NewRecorder()
+    w, _ := newSSEWriter(rr, newMetricsRegistry())
+    if err := w.Write(SSEEvent{ID: "1", Data: data}); err != nil {
+        t.Fatal(err)
+    }
+    want := "id: 1\ndata: " + `{"seq":1,"ts":"2024-05-01T10:30:00.123456789Z","data":"line one\nline two\r\n"}` + "\n\n"
+    if got := rr.Body.String(); got != want {
+        t.Errorf("wire format:\n got %q\nwant %q", got, want)
+    }
+    if strings.Count(rr.Body.String(), "data:") != 1 {
+        t.Error("envelope split across data lines")
+    }
+}
+
+func TestFormatBrokerEvent(t *testing.T) {
+    e := SSEEvent{ID: "12", Event: "order", Data: `{"sku":1}`}
+    if got, _ := formatBrokerEvent(e, streamOpts{}); got != e {
+        t.Errorf("plain format changed the event: %+v", got)
+    }
+    got, err := formatBrokerEvent(e, streamOpts{format: "json"})
+    if err != nil || got.ID != "12" || got.Event != "order" || !strings.HasPrefix(got.Data, `{"seq":12,"ts":"`) || !strings.HasSuffix(got.Data, `","data":"{\"sku\":1}"}`) {
+        t.Errorf("json format = %+v, %v", got, err)
+    }
+}
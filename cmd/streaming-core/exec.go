@@ -0,0 +1,180 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "log/slog"
+    "os/exec"
+    "strconv"
+    "syscall"
+    "time"
+)
+
+const (
+    // execStableAfter is how long the command must run before a restart
+    // starts over from the initial backoff.
+    execStableAfter = time.Minute
+    // execKillDelay is how long the command gets to exit after SIGTERM on
+    // shutdown before it is killed.
+    execKillDelay = 3 * time.Second
+)
+
+// execSource streams the stdout lines of EXEC_COMMAND, run with sh -c from
+// startup, as "line" events. The command is restarted with exponential
+// backoff whenever it exits, and each restart is announced with a "restart"
+// event carrying the restart count and the command's exit status. Its stderr
+// goes to the log. Like the tail source, it has one broker shared by every
+// stream, which keeps recent lines for Last-Event-ID resume.
+type execSource struct {
+    command    string
+    backoff    time.Duration
+    maxBackoff time.Duration
+    lines      *tailer
+    // done is closed once the command has been stopped at shutdown.
+    done chan struct{}
+}
+
+// execSourceFromEnv reads EXEC_COMMAND, EXEC_BACKOFF_MS and
+// EXEC_MAX_BACKOFF_MS and starts the command. It returns nil when
+// EXEC_COMMAND is unset.
+func execSourceFromEnv(cfg brokerConfig, logger *slog.Logger) (*execSource, error) {
+    command := getEnv("EXEC_COMMAND", "")
+    if command == "" {
+        return nil, nil
+    }
+    backoffMs, err := strconv.Atoi(getEnv("EXEC_BACKOFF_MS", "1000"))
+    if err != nil || backoffMs < 1 {
+        return nil, errors.New("invalid EXEC_BACKOFF_MS: must be an integer >= 1")
+    }
+    maxBackoffMs, err := strconv.Atoi(getEnv("EXEC_MAX_BACKOFF_MS", "60000"))
+    if err != nil || maxBackoffMs < backoffMs {
+        return nil, errors.New("invalid EXEC_MAX_BACKOFF_MS: must be an integer >= EXEC_BACKOFF_MS")
+    }
+    s := &execSource{
+        command:    command,
+        backoff:    time.Duration(backoffMs) * time.Millisecond,
+        maxBackoff: time.Duration(maxBackoffMs) * time.Millisecond,
+        lines:      &tailer{broker: newBroker(cfg), maxLine: stdinMaxLine, log: logger.With(slog.String("source", "exec"))},
+        done:       make(chan struct{}),
+    }
+    go s.supervise(shutdownCtx)
+    return s, nil
+}
+
+// supervise runs the command until ctx is done, restarting it after each
+// exit.
+func (s *execSource) supervise(ctx context.Context) {
+    defer close(s.done)
+    log := s.lines.log
+    delay := s.backoff
+    var err error
+    for restarts := 0; ; restarts++ {
+        if restarts > 0 {
+            s.lines.broker.Publish(restartEvent(restarts, err))
+        }
+        started := time.Now()
+        err = s.run(ctx)
+        if ctx.Err() != nil {
+            log.Info("exec command stopped")
+            return
+        }
+        if time.Since(started) >= execStableAfter {
+            delay = s.backoff
+        }
+        log.Warn("exec command exited; restarting", slog.Any("error", err), slog.Int64("delay_ms", delay.Milliseconds()))
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(delay):
+        }
+        delay = min(2*delay, s.maxBackoff)
+    }
+}
+
+// restartEvent announces the restarts-th restart of a command that exited
+// with err: its exit status, or the error when it did not run at all. A
+// clean exit adds neither.
+func restartEvent(restarts int, err error) SSEEvent {
+    restart := map[string]any{"restarts": restarts}
+    var exitErr *exec.ExitError
+    switch {
+    case errors.As(err, &exitErr):
+        restart["exit"] = exitErr.ExitCode()
+    case err != nil:
+        restart["error"] = err.Error()
+    }
+    data, _ := json.Marshal(restart)
+    return SSEEvent{Event: "restart", Data: string(data)}
+}
+
+// run runs the command once, publishing its stdout lines, and returns how
+// it exited. It runs in its own process group, so that on shutdown SIGTERM
+// reaches the processes it started too; whatever is left after
+// execKillDelay is killed.
+func (s *execSource) run(ctx context.Context) error {
+    cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.command)
+    cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+    cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM) }
+    cmd.WaitDelay = execKillDelay
+    stdout, err := cmd.StdoutPipe()
+    if err != nil {
+        return err
+    }
+    stderr, err := cmd.StderrPipe()
+    if err != nil {
+        return err
+    }
+    if err := cmd.Start(); err != nil {
+        return err
+    }
+    s.lines.log.Info("exec command started", slog.String("command", s.command), slog.Int("pid", cmd.Process.Pid))
+    stderrDone := make(chan struct{})
+    go func() {
+        defer close(stderrDone)
+        s.logStderr(stderr)
+    }()
+    s.readLines(stdout)
+    // Wait closes the pipes, so both must be read to the end first.
+    <-stderrDone
+    return cmd.Wait()
+}
+
+func (s *execSource) readLines(r io.Reader) {
+    t := s.lines
+    buf := make([]byte, 32<<10)
+    for {
+        n, err := r.Read(buf)
+        t.consume(buf[:n])
+        if err != nil {
+            break
+        }
+    }
+    if len(t.partial) > 0 {
+        t.publishLine()
+    }
+    t.overlong = false
+}
+
+func (s *execSource) logStderr(r io.Reader) {
+    sc := bufio.NewScanner(r)
+    sc.Buffer(make([]byte, 4096), stdinMaxLine)
+    for sc.Scan() {
+        s.lines.log.Warn("exec stderr", slog.String("line", sc.Text()))
+    }
+    // Keep draining after an overlong line so the command never blocks on
+    // a full stderr pipe.
+    _, _ = io.Copy(io.Discard, r)
+}
+
+// Run relays the command's lines and restart events until ctx is done.
+func (s *execSource) Run(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error {
+    return relayBroker(ctx, s.lines.broker, opts, out, nil)
+}
+
+// wait waits for the command to be stopped after shutdown began.
+func (s *execSource) wait() {
+    <-s.done
+}
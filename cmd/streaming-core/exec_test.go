@@ -0,0 +1,128 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "log/slog"
+    "os"
+    "strconv"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+)
+
+// startExec supervises command with a 50ms backoff doubling up to 200ms,
+// logging to log, until the test ends or stop is called. Its events are
+// read from the returned subscription.
+func startExec(t *testing.T, command string, log *slog.Logger) (s *execSource, events <-chan SSEEvent, stop func()) {
+    t.Helper()
+    s = &execSource{
+        command:    command,
+        backoff:    50 * time.Millisecond,
+        maxBackoff: 200 * time.Millisecond,
+        lines:      &tailer{broker: newBroker(testBrokerConfig()), maxLine: stdinMaxLine, log: log},
+        done:       make(chan struct{}),
+    }
+    events = s.lines.broker.Subscribe()
+    ctx, cancel := context.WithCancel(context.Background())
+    go s.supervise(ctx)
+    stop = func() {
+        cancel()
+        s.wait()
+    }
+    t.Cleanup(stop)
+    return s, events, stop
+}
+
+func TestExecRestartsWithBackoff(t *testing.T) {
+    _, events, stop := startExec(t, "echo hi; exit 3", slog.Default())
+    var restarts []time.Time
+    for range 8 {
+        switch e := receive(t, events, 1)[0]; e.Event {
+        case "line":
+            if e.Data != "hi" {
+                t.Errorf("line %q, want hi", e.Data)
+            }
+        case "restart":
+            want := `{"exit":3,"restarts":` + strconv.Itoa(len(restarts)+1) + `}`
+            if e.Data != want {
+                t.Errorf("restart event %s, want %s", e.Data, want)
+            }
+            restarts = append(restarts, time.Now())
+        }
+    }
+    stop()
+    if len(restarts) != 4 {
+        t.Fatalf("%d restarts in 8 events, want 4", len(restarts))
+    }
+    // The delays are 50, 100 and 200ms, then stay at the 200ms cap.
+    for i, want := range []time.Duration{100, 200, 200} {
+        if gap := restarts[i+1].Sub(restarts[i]); gap < (want-20)*time.Millisecond {
+            t.Errorf("restart %d came %v after the one before, want about %dms", i+2, gap, want)
+        }
+    }
+}
+
+func TestExecRestartEvent(t *testing.T) {
+    for _, tt := range []struct {
+        err  error
+        want string
+    }{
+        {nil, `{"restarts":1}`},
+        {errors.New("fork failed"), `{"error":"fork failed","restarts":1}`},
+    } {
+        if e := restartEvent(1, tt.err); e.Event != "restart" || e.Data != tt.want {
+            t.Errorf("restartEvent(1, %v) = %+v, want %s", tt.err, e, tt.want)
+        }
+    }
+
+    _, events, _ := startExec(t, "true", slog.Default())
+    if got := receive(t, events, 1); got[0].Data != `{"restarts":1}` {
+        t.Errorf("after a clean exit: %s, want no exit status", got[0].Data)
+    }
+}
+
+func TestExecStderrGoesToLog(t *testing.T) {
+    buf := &logBuffer{}
+    _, events, stop := startExec(t, "echo oops >&2; echo out; sleep 30", slog.New(slog.NewJSONHandler(buf, nil)))
+    if got := receive(t, events, 1); got[0].Data != "out" {
+        t.Errorf("first line %q, want out: stderr must not be streamed", got[0].Data)
+    }
+    waitFor(t, "the stderr line", func() bool { return strings.Contains(buf.String(), "oops") })
+    stop()
+    if rec := logRecord(t, buf, "exec stderr"); rec["line"] != "oops" || rec["level"] != "WARN" {
+        t.Errorf("stderr logged as %v", rec)
+    }
+}
+
+func TestExecShutdownKillsProcessGroup(t *testing.T) {
+    // The shell's child reports its pid and would outlive a SIGTERM sent to
+    // the shell alone.
+    _, events, stop := startExec(t, "sleep 30 & echo $!; wait", slog.Default())
+    pid, err := strconv.Atoi(receive(t, events, 1)[0].Data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    start := time.Now()
+    stop()
+    if d := time.Since(start); d >= execKillDelay {
+        t.Errorf("stopping took %v, want the group to exit on SIGTERM", d)
+    }
+    waitFor(t, "the child to exit", func() bool { return processGone(pid) })
+}
+
+// processGone reports whether pid has exited. A zombie counts as gone: it
+// is dead, only not yet reaped by its new parent.
+func processGone(pid int) bool {
+    if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+        return true
+    }
+    stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+    if err != nil {
+        return os.IsNotExist(err)
+    }
+    // The state follows the parenthesised command name.
+    fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+    return len(fields) > 0 && fields[0] == "Z"
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func getHealth(t *testing.T) (int, health) {
+    t.Helper()
+    rr := httptest.NewRecorder()
+    healthHandler(rr, httptest.NewRequest(http.MethodGet, "/health", nil))
+    var h health
+    if err := json.NewDecoder(rr.Body).Decode(&h); err != nil {
+        t.Fatal(err)
+    }
+    return rr.Code, h
+}
+
+func TestHealthFailsWhenSubscribersFallBehind(t *testing.T) {
+    saved, savedDepth := topics, unhealthyQueueDepth
+    defer func() { topics, unhealthyQueueDepth = saved, savedDepth }()
+    topics = newTopicRegistry(brokerConfig{history: 64, buffer: 8, policy: dropNewest}, true, "")
+    unhealthyQueueDepth = 10
+
+    code, h := getHealth(t)
+    if code != http.StatusOK || h.Status != "ok" || h.HubQueueDepth != 0 {
+        t.Fatalf("idle: %d %+v, want 200 ok with empty queue", code, h)
+    }
+
+    // Two subscribers that never read fill their buffers.
+    b, _ := topics.get(defaultTopic)
+    b.Subscribe()
+    b.Subscribe()
+    for i := 0; i < 12; i++ {
+        b.Publish(SSEEvent{Data: "x"})
+    }
+    deadline := time.Now().Add(time.Second)
+    for b.Dropped() < 8 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+
+    code, h = getHealth(t)
+    if code != http.StatusServiceUnavailable || h.Status != "degraded" {
+        t.Fatalf("backed up: %d %+v, want 503 degraded", code, h)
+    }
+    if h.HubQueueDepth != 16 || h.DroppedEvents != 8 {
+        t.Errorf("depth %d, dropped %d; want 16 and 8", h.HubQueueDepth, h.DroppedEvents)
+    }
+}
+
+func TestHealthReportsStreamsAndThreshold(t *testing.T) {
+    saved, savedDepth := topics, unhealthyQueueDepth
+    defer func() { topics, unhealthyQueueDepth = saved, savedDepth }()
+    topics = newTopicRegistry(brokerConfig{history: 64, buffer: 8, policy: dropNewest}, true, "")
+    unhealthyQueueDepth = 8
+
+    srv := newStreamServer(t)
+    _, before := getHealth(t)
+    openStream(t, srv, "/stream?intervalMs=60000&burst=1")
+    waitFor(t, "the stream counted", func() bool {
+        _, h := getHealth(t)
+        return h.ActiveStreams == before.ActiveStreams+1
+    })
+
+    // A backlog of exactly the threshold is still healthy.
+    b, _ := topics.get(uniqueTopic("health"))
+    sub := b.Subscribe()
+    for i := 0; i < 8; i++ {
+        b.Publish(SSEEvent{Data: "x"})
+    }
+    waitFor(t, "a full subscriber buffer", func() bool { return len(sub) == 8 })
+    code, h := getHealth(t)
+    if code != http.StatusOK || h.HubQueueDepth != 8 {
+        t.Errorf("at the threshold: %d %+v, want 200 with depth 8", code, h)
+    }
+    if up := time.Since(processStart).Milliseconds(); h.UptimeMs < 0 || h.UptimeMs > up {
+        t.Errorf("uptime_ms %d, want at most %d", h.UptimeMs, up)
+    }
+}
+
+func TestReadyzFollowsDraining(t *testing.T) {
+    saved := ready.Load()
+    defer ready.Store(saved)
+    probe := func(h http.HandlerFunc, path string) (int, string) {
+        rr := httptest.NewRecorder()
+        h(rr, httptest.NewRequest(http.MethodGet, path, nil))
+        return rr.Code, rr.Body.String()
+    }
+
+    for _, tt := range []struct {
+        ready     bool
+        readyCode int
+        readyBody string
+    }{
+        {false, http.StatusServiceUnavailable, "draining"}, // starting up
+        {true, http.StatusOK, "ok"},
+        {false, http.StatusServiceUnavailable, "draining"}, // shutting down
+    } {
+        ready.Store(tt.ready)
+        if code, body := probe(readyHandler, "/readyz"); code != tt.readyCode || body != tt.readyBody {
+            t.Errorf("ready=%v: /readyz %d %q, want %d %q", tt.ready, code, body, tt.readyCode, tt.readyBody)
+        }
+        // Liveness does not depend on readiness: a draining server is
+        // still alive and must not be restarted.
+        if code, body := probe(livezHandler, "/livez"); code != http.StatusOK || body != "ok" {
+            t.Errorf("ready=%v: /livez %d %q, want 200 ok", tt.ready, code, body)
+        }
+        if code, _ := getHealth(t); code != http.StatusOK {
+            t.Errorf("ready=%v: /health %d, want 200", tt.ready, code)
+        }
+    }
+}
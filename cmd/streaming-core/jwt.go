@@ -0,0 +1,322 @@
+package main
+
+import (
+    "context"
+    "crypto"
+    "crypto/hmac"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "log/slog"
+    "math/big"
+    "net/http"
+    "os"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// jwksMinRefetch limits how often an unknown key ID forces a JWKS refetch,
+// so a client sending made-up kids cannot hammer the key server.
+const jwksMinRefetch = 10 * time.Second
+
+// jwtClaims are the claims the server acts on. Topics lists the topics the
+// caller may subscribe and publish to; "*" grants all of them.
+type jwtClaims struct {
+    Subject   string   `json:"sub"`
+    ExpiresAt *int64   `json:"exp"`
+    NotBefore *int64   `json:"nbf"`
+    Topics    []string `json:"topics"`
+}
+
+// allowsTopic reports whether the claims grant access to topic. The
+// default topic is open to every valid token.
+func (c *jwtClaims) allowsTopic(topic string) bool {
+    if topic == "" || topic == defaultTopic {
+        return true
+    }
+    return slices.Contains(c.Topics, topic) || slices.Contains(c.Topics, "*")
+}
+
+type claimsKey struct{}
+
+// claimsFrom returns the verified JWT claims of the request, if it was
+// authenticated with a JWT rather than a static token.
+func claimsFrom(ctx context.Context) (*jwtClaims, bool) {
+    c, ok := ctx.Value(claimsKey{}).(*jwtClaims)
+    return c, ok
+}
+
+// jwtVerifier checks HS256 tokens against a shared secret and RS256 tokens
+// against a PEM public key or the keys published at a JWKS URL.
+type jwtVerifier struct {
+    secret []byte
+    rsaKey *rsa.PublicKey
+    jwks   *jwksCache
+    // skew is how far exp and nbf may be off to allow for clock drift
+    // between the issuer and this server.
+    skew time.Duration
+    now  func() time.Time
+}
+
+// jwtVerifierFromEnv builds a verifier from JWT_HS256_SECRET,
+// JWT_RS256_PUBLIC_KEY_FILE and JWT_JWKS_URL. It returns nil when none is
+// set, leaving JWTs unsupported.
+func jwtVerifierFromEnv(logger *slog.Logger) (*jwtVerifier, error) {
+    v := &jwtVerifier{now: time.Now}
+    if secret := getEnv("JWT_HS256_SECRET", getEnv("JWT_SECRET", "")); secret != "" {
+        v.secret = []byte(secret)
+    }
+    if file := getEnv("JWT_RS256_PUBLIC_KEY_FILE", ""); file != "" {
+        b, err := os.ReadFile(file)
+        if err != nil {
+            return nil, fmt.Errorf("JWT_RS256_PUBLIC_KEY_FILE: %w", err)
+        }
+        if v.rsaKey, err = parseRSAPublicKey(b); err != nil {
+            return nil, fmt.Errorf("JWT_RS256_PUBLIC_KEY_FILE: %w", err)
+        }
+    }
+    if url := getEnv("JWT_JWKS_URL", ""); url != "" {
+        refreshMs, err := strconv.Atoi(getEnv("JWT_JWKS_REFRESH_MS", "600000"))
+        if err != nil || refreshMs < 1000 {
+            return nil, fmt.Errorf("invalid JWT_JWKS_REFRESH_MS: must be an integer >= 1000")
+        }
+        v.jwks = &jwksCache{
+            url:     url,
+            refresh: time.Duration(refreshMs) * time.Millisecond,
+            client:  &http.Client{Timeout: 5 * time.Second},
+            log:     logger,
+        }
+    }
+    if v.secret == nil && v.rsaKey == nil && v.jwks == nil {
+        return nil, nil
+    }
+    skewMs, err := strconv.Atoi(getEnv("JWT_CLOCK_SKEW_MS", "30000"))
+    if err != nil || skewMs < 0 {
+        return nil, fmt.Errorf("invalid JWT_CLOCK_SKEW_MS: must be an integer >= 0")
+    }
+    v.skew = time.Duration(skewMs) * time.Millisecond
+    return v, nil
+}
+
+func parseRSAPublicKey(b []byte) (*rsa.PublicKey, error) {
+    block, _ := pem.Decode(b)
+    if block == nil {
+        return nil, errors.New("no PEM block found")
+    }
+    switch block.Type {
+    case "RSA PUBLIC KEY":
+        return x509.ParsePKCS1PublicKey(block.Bytes)
+    case "CERTIFICATE":
+        cert, err := x509.ParseCertificate(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+            return key, nil
+        }
+    default:
+        key, err := x509.ParsePKIXPublicKey(block.Bytes)
+        if err != nil {
+            return nil, err
+        }
+        if key, ok := key.(*rsa.PublicKey); ok {
+            return key, nil
+        }
+    }
+    return nil, errors.New("not an RSA public key")
+}
+
+// verify checks token's signature and validity period and returns its
+// claims. Tokens must carry exp; the algorithm must match a configured key,
+// so an RS256 public key can never be used as an HS256 secret.
+func (v *jwtVerifier) verify(token string) (*jwtClaims, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, errors.New("malformed token")
+    }
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    if err := decodeSegment(parts[0], &header); err != nil {
+        return nil, fmt.Errorf("header: %w", err)
+    }
+    sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+    if err != nil {
+        return nil, errors.New("malformed signature")
+    }
+    signed := parts[0] + "." + parts[1]
+    switch header.Alg {
+    case "HS256":
+        if v.secret == nil {
+            return nil, errors.New("HS256 not accepted")
+        }
+        mac := hmac.New(sha256.New, v.secret)
+        mac.Write([]byte(signed))
+        if !hmac.Equal(sig, mac.Sum(nil)) {
+            return nil, errors.New("invalid signature")
+        }
+    case "RS256":
+        key, err := v.rsaKeyFor(header.Kid)
+        if err != nil {
+            return nil, err
+        }
+        sum := sha256.Sum256([]byte(signed))
+        if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+            return nil, errors.New("invalid signature")
+        }
+    default:
+        return nil, fmt.Errorf("unsupported alg %q", header.Alg)
+    }
+
+    var claims jwtClaims
+    if err := decodeSegment(parts[1], &claims); err != nil {
+        return nil, fmt.Errorf("claims: %w", err)
+    }
+    now := v.now()
+    if claims.ExpiresAt == nil {
+        return nil, errors.New("token has no exp")
+    }
+    if now.After(time.Unix(*claims.ExpiresAt, 0).Add(v.skew)) {
+        return nil, errors.New("token expired")
+    }
+    if claims.NotBefore != nil && now.Add(v.skew).Before(time.Unix(*claims.NotBefore, 0)) {
+        return nil, errors.New("token not yet valid")
+    }
+    return &claims, nil
+}
+
+// rsaKeyFor picks the RS256 key for kid: the JWKS key with that ID when a
+// JWKS URL is configured, otherwise the static public key.
+func (v *jwtVerifier) rsaKeyFor(kid string) (*rsa.PublicKey, error) {
+    if v.jwks != nil {
+        if key, err := v.jwks.key(kid); err == nil || v.rsaKey == nil {
+            return key, err
+        }
+    }
+    if v.rsaKey == nil {
+        return nil, errors.New("RS256 not accepted")
+    }
+    return v.rsaKey, nil
+}
+
+func decodeSegment(seg string, v any) error {
+    b, err := base64.RawURLEncoding.DecodeString(seg)
+    if err != nil {
+        return errors.New("malformed base64")
+    }
+    return json.Unmarshal(b, v)
+}
+
+// jwksCache holds the RSA keys published at a JWKS URL. Keys are refetched
+// once they are older than refresh, and early when a token names a key ID
+// the cache has not seen, which is how issuers roll keys. Fetches happen
+// outside the lock, one at a time and at most every jwksMinRefetch, so
+// a slow issuer or a flood of made-up key IDs cannot hold up tokens
+// signed with keys already cached.
+type jwksCache struct {
+    url     string
+    refresh time.Duration
+    client  *http.Client
+    log     *slog.Logger
+
+    mu        sync.Mutex
+    keys      map[string]*rsa.PublicKey
+    fetched   time.Time
+    attempted time.Time
+    // inflight is closed when the running fetch, if any, completes.
+    inflight chan struct{}
+}
+
+// key returns the key for kid. A cached key is returned at once, even while
+// a refresh runs in the background; an unknown one waits for the fetch it
+// triggered, or one already running.
+func (c *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+    c.mu.Lock()
+    now := time.Now()
+    key, known := c.keys[kid]
+    stale := now.Sub(c.fetched) >= c.refresh
+    if (stale || !known) && c.inflight == nil && now.Sub(c.attempted) >= jwksMinRefetch {
+        c.attempted = now
+        c.inflight = make(chan struct{})
+        go c.refetch(c.inflight)
+    }
+    wait := c.inflight
+    c.mu.Unlock()
+    if known {
+        return key, nil
+    }
+    if wait != nil {
+        <-wait
+        c.mu.Lock()
+        key, known = c.keys[kid]
+        c.mu.Unlock()
+    }
+    if !known {
+        return nil, fmt.Errorf("unknown key ID %q", kid)
+    }
+    return key, nil
+}
+
+// refetch replaces the cached keys with freshly fetched ones and closes
+// done.
+func (c *jwksCache) refetch(done chan struct{}) {
+    keys, err := c.fetch()
+    c.mu.Lock()
+    if err != nil {
+        // Keep serving the keys we have; the issuer being briefly
+        // unreachable should not log everyone out.
+        c.log.Warn("JWKS fetch failed", slog.String("url", c.url), slog.Any("error", err))
+    } else {
+        c.keys, c.fetched = keys, time.Now()
+    }
+    c.inflight = nil
+    c.mu.Unlock()
+    close(done)
+}
+
+func (c *jwksCache) fetch() (map[string]*rsa.PublicKey, error) {
+    resp, err := c.client.Get(c.url)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("unexpected status %s", resp.Status)
+    }
+    var set struct {
+        Keys []struct {
+            Kty string `json:"kty"`
+            Kid string `json:"kid"`
+            N   string `json:"n"`
+            E   string `json:"e"`
+        } `json:"keys"`
+    }
+    if err := json.NewDecoder(http.MaxBytesReader(nil, resp.Body, 1<<20)).Decode(&set); err != nil {
+        return nil, err
+    }
+    keys := make(map[string]*rsa.PublicKey)
+    for _, k := range set.Keys {
+        if k.Kty != "RSA" {
+            continue
+        }
+        n, errN := base64.RawURLEncoding.DecodeString(k.N)
+        e, errE := base64.RawURLEncoding.DecodeString(k.E)
+        if errN != nil || errE != nil || len(e) > 4 {
+            continue
+        }
+        keys[k.Kid] = &rsa.PublicKey{
+            N: new(big.Int).SetBytes(n),
+            E: int(new(big.Int).SetBytes(e).Int64()),
+        }
+    }
+    return keys, nil
+}
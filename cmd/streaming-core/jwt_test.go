@@ -0,0 +1,298 @@
+package main
+
+import (
+    "crypto"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "log/slog"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+// jwksServer serves a JWKS holding key under each of kids, counting the
+// fetches and holding each one until release is closed, if set.
+type jwksServer struct {
+    *httptest.Server
+    fetches atomic.Int32
+    release chan struct{}
+}
+
+func newJWKSServer(t *testing.T, key *rsa.PublicKey, kids ...string) *jwksServer {
+    t.Helper()
+    s := &jwksServer{}
+    n := base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+    e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+    body := `{"keys":[`
+    for i, kid := range kids {
+        if i > 0 {
+            body += ","
+        }
+        body += fmt.Sprintf(`{"kty":"RSA","kid":%q,"n":%q,"e":%q}`, kid, n, e)
+    }
+    body += `]}`
+    s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        s.fetches.Add(1)
+        if s.release != nil {
+            <-s.release
+        }
+        fmt.Fprint(w, body)
+    }))
+    t.Cleanup(s.Close)
+    return s
+}
+
+func newTestJWKSCache(url string) *jwksCache {
+    return &jwksCache{url: url, refresh: time.Hour, client: &http.Client{Timeout: 5 * time.Second}, log: slog.Default()}
+}
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+    t.Helper()
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return key
+}
+
+func TestJWKSCacheFetchesOnceForConcurrentUnknownKids(t *testing.T) {
+    key := testRSAKey(t)
+    srv := newJWKSServer(t, &key.PublicKey, "k1")
+    srv.release = make(chan struct{})
+    c := newTestJWKSCache(srv.URL)
+
+    var wg sync.WaitGroup
+    errs := make(chan error, 10)
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            _, err := c.key("k1")
+            errs <- err
+        }()
+    }
+    time.Sleep(50 * time.Millisecond)
+    close(srv.release)
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    if n := srv.fetches.Load(); n != 1 {
+        t.Fatalf("fetches = %d, want 1", n)
+    }
+
+    // Made-up kids do not refetch again within jwksMinRefetch.
+    for i := 0; i < 5; i++ {
+        if _, err := c.key(fmt.Sprintf("bogus%d", i)); err == nil {
+            t.Fatal("unknown kid accepted")
+        }
+    }
+    if n := srv.fetches.Load(); n != 1 {
+        t.Fatalf("fetches after unknown kids = %d, want 1", n)
+    }
+}
+
+func TestJWKSCacheServesCachedKeysDuringRefresh(t *testing.T) {
+    key := testRSAKey(t)
+    srv := newJWKSServer(t, &key.PublicKey, "k1")
+    c := newTestJWKSCache(srv.URL)
+    if _, err := c.key("k1"); err != nil {
+        t.Fatal(err)
+    }
+
+    // Make the keys stale and the next fetch hang.
+    srv.release = make(chan struct{})
+    defer close(srv.release)
+    c.mu.Lock()
+    c.fetched, c.attempted = time.Time{}, time.Time{}
+    c.mu.Unlock()
+
+    done := make(chan error)
+    go func() {
+        _, err := c.key("k1")
+        done <- err
+    }()
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatal(err)
+        }
+    case <-time.After(time.Second):
+        t.Fatal("cached key blocked on the JWKS refresh")
+    }
+}
+
+// jwtNow is the verification time of the JWT tests.
+var jwtNow = time.Unix(1_700_000_000, 0)
+
+// signJWT encodes header and claims and signs them with sign.
+func signJWT(t *testing.T, header, claims map[string]any, sign func(signed []byte) []byte) string {
+    t.Helper()
+    seg := func(v any) string {
+        b, err := json.Marshal(v)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return base64.RawURLEncoding.EncodeToString(b)
+    }
+    signed := seg(header) + "." + seg(claims)
+    return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret []byte) func([]byte) []byte {
+    return func(signed []byte) []byte {
+        mac := hmac.New(sha256.New, secret)
+        mac.Write(signed)
+        return mac.Sum(nil)
+    }
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+    return func(signed []byte) []byte {
+        sum := sha256.Sum256(signed)
+        sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+        if err != nil {
+            t.Fatal(err)
+        }
+        return sig
+    }
+}
+
+// validFor returns claims for sub valid from now until now+d.
+func validFor(d time.Duration) map[string]any {
+    return map[string]any{"sub": "alice", "exp": jwtNow.Add(d).Unix()}
+}
+
+func TestJWTVerify(t *testing.T) {
+    secret := []byte("s3cret")
+    key, other := testRSAKey(t), testRSAKey(t)
+    pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+    both := &jwtVerifier{secret: secret, rsaKey: &key.PublicKey, skew: 30 * time.Second, now: func() time.Time { return jwtNow }}
+    rsaOnly := &jwtVerifier{rsaKey: &key.PublicKey, skew: 30 * time.Second, now: func() time.Time { return jwtNow }}
+    hs, rs := map[string]any{"alg": "HS256"}, map[string]any{"alg": "RS256"}
+    with := func(claims map[string]any, k string, v any) map[string]any {
+        claims[k] = v
+        return claims
+    }
+
+    for _, tt := range []struct {
+        name    string
+        v       *jwtVerifier
+        token   string
+        wantErr string
+    }{
+        {"HS256", both, signJWT(t, hs, validFor(time.Minute), hs256(secret)), ""},
+        {"RS256", both, signJWT(t, rs, validFor(time.Minute), rs256(t, key)), ""},
+        {"HS256 bad signature", both, signJWT(t, hs, validFor(time.Minute), hs256([]byte("guess"))), "invalid signature"},
+        {"RS256 bad signature", both, signJWT(t, rs, validFor(time.Minute), rs256(t, other)), "invalid signature"},
+        // The public key is no secret: HS256 signed with it must not pass.
+        {"alg confusion", rsaOnly, signJWT(t, hs, validFor(time.Minute), hs256(pubPEM)), "HS256 not accepted"},
+        {"alg confusion with a secret", both, signJWT(t, hs, validFor(time.Minute), hs256(pubPEM)), "invalid signature"},
+        {"alg none", both, signJWT(t, map[string]any{"alg": "none"}, validFor(time.Minute), func([]byte) []byte { return nil }), `unsupported alg "none"`},
+        {"no exp", both, signJWT(t, hs, map[string]any{"sub": "alice"}, hs256(secret)), "token has no exp"},
+        {"expired within skew", both, signJWT(t, hs, validFor(-29*time.Second), hs256(secret)), ""},
+        {"expired", both, signJWT(t, hs, validFor(-31*time.Second), hs256(secret)), "token expired"},
+        {"nbf within skew", both, signJWT(t, hs, with(validFor(time.Minute), "nbf", jwtNow.Add(29*time.Second).Unix()), hs256(secret)), ""},
+        {"nbf ahead", both, signJWT(t, hs, with(validFor(time.Minute), "nbf", jwtNow.Add(31*time.Second).Unix()), hs256(secret)), "token not yet valid"},
+        {"malformed", both, "a.b", "malformed token"},
+    } {
+        claims, err := tt.v.verify(tt.token)
+        switch {
+        case tt.wantErr == "" && err != nil:
+            t.Errorf("%s: %v", tt.name, err)
+        case tt.wantErr == "" && claims.Subject != "alice":
+            t.Errorf("%s: subject %q, want alice", tt.name, claims.Subject)
+        case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+            t.Errorf("%s: err = %v, want %s", tt.name, err, tt.wantErr)
+        }
+    }
+}
+
+func TestJWTVerifyFetchesRolledKey(t *testing.T) {
+    k1, k2 := testRSAKey(t), testRSAKey(t)
+    before := newJWKSServer(t, &k1.PublicKey, "k1")
+    after := newJWKSServer(t, &k2.PublicKey, "k2")
+    v := &jwtVerifier{jwks: newTestJWKSCache(before.URL), now: func() time.Time { return jwtNow }}
+    if _, err := v.verify(signJWT(t, map[string]any{"alg": "RS256", "kid": "k1"}, validFor(time.Minute), rs256(t, k1))); err != nil {
+        t.Fatal(err)
+    }
+
+    // The issuer rolls to k2, which only a refetch finds. Within
+    // jwksMinRefetch of the last fetch the kid is refused without one.
+    v.jwks.url = after.URL
+    rolled := signJWT(t, map[string]any{"alg": "RS256", "kid": "k2"}, validFor(time.Minute), rs256(t, k2))
+    if _, err := v.verify(rolled); err == nil || after.fetches.Load() != 0 {
+        t.Fatalf("k2 right after a fetch: err = %v, fetches = %d; want refused without a fetch", err, after.fetches.Load())
+    }
+    v.jwks.mu.Lock()
+    v.jwks.attempted = time.Time{}
+    v.jwks.mu.Unlock()
+    if _, err := v.verify(rolled); err != nil || after.fetches.Load() != 1 {
+        t.Fatalf("k2 once a refetch is allowed: err = %v, fetches = %d", err, after.fetches.Load())
+    }
+}
+
+func TestJWTTopicsOnStreamAndPublish(t *testing.T) {
+    secret := []byte("s3cret")
+    v := &jwtVerifier{secret: secret, skew: time.Second, now: time.Now}
+    token := func(topics ...string) string {
+        claims := map[string]any{"sub": "alice", "exp": time.Now().Add(time.Minute).Unix(), "topics": topics}
+        return signJWT(t, map[string]any{"alg": "HS256"}, claims, hs256(secret))
+    }
+    ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+    auth := bearerAuthMiddleware(func() []string { return nil }, v)
+    mux := http.NewServeMux()
+    mux.Handle("/stream", auth(ok))
+    mux.Handle("/stream/{topic}", auth(ok))
+    mux.Handle("/publish", auth(http.HandlerFunc(publishHandler)))
+    mux.Handle("/publish/{topic}", auth(http.HandlerFunc(publishHandler)))
+    orders := uniqueTopic("orders")
+
+    for _, tt := range []struct {
+        method, path, body, token string
+        want                      int
+    }{
+        {"GET", "/stream/" + orders, "", "", http.StatusUnauthorized},
+        {"GET", "/stream/" + orders, "", "not.a.jwt", http.StatusUnauthorized},
+        {"GET", "/stream/" + orders, "", token(orders), http.StatusOK},
+        {"GET", "/stream/prices", "", token(orders), http.StatusForbidden},
+        {"GET", "/stream/prices", "", token("*"), http.StatusOK},
+        // Every valid token may use the default topic.
+        {"GET", "/stream", "", token(), http.StatusOK},
+        {"POST", "/publish/" + orders, `{"data":"1"}`, token(orders), http.StatusAccepted},
+        {"POST", "/publish/prices", `{"data":"1"}`, token(orders), http.StatusForbidden},
+        {"POST", "/publish/prices", `{"data":"1"}`, "", http.StatusUnauthorized},
+        // On /publish the topic is in the body, past the middleware.
+        {"POST", "/publish", `{"topic":"` + orders + `","data":"1"}`, token(orders), http.StatusAccepted},
+        {"POST", "/publish", `{"topic":"prices","data":"1"}`, token(orders), http.StatusForbidden},
+    } {
+        req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+        if tt.token != "" {
+            req.Header.Set("Authorization", "Bearer "+tt.token)
+        }
+        rr := httptest.NewRecorder()
+        mux.ServeHTTP(rr, req)
+        if rr.Code != tt.want {
+            t.Errorf("%s %s with %q: status %d, want %d", tt.method, tt.path, tt.token, rr.Code, tt.want)
+        }
+    }
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "context"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestKeepaliveBetweenEvents(t *testing.T) {
+    rr := httptest.NewRecorder()
+    r := httptest.NewRequest(http.MethodGet, "/stream?intervalMs=200&heartbeatMs=40&limit=3&send_eof=false", nil)
+    r.Header.Set("Last-Event-ID", "4")
+    streamHandler(rr, r)
+
+    // Split the body at each event; every gap between two events of a
+    // 200ms stream holds about five 40ms pings.
+    body := rr.Body.String()
+    gaps := strings.Split(body, "event: number\n")
+    if len(gaps) != 4 {
+        t.Fatalf("got %d events, want 3: %q", len(gaps)-1, body)
+    }
+    for i, gap := range gaps[1:3] {
+        if n := strings.Count(gap, ": ping\n\n"); n < 3 || n > 6 {
+            t.Errorf("gap %d holds %d pings, want about 5", i, n)
+        }
+    }
+    // The pings leave resume alone: the numbers carry on from the ID.
+    events, _ := scanSSE(strings.NewReader(rr.Body.String()), 3)
+    for i, e := range events {
+        if want := strconv.Itoa(5 + i); e.ID != want {
+            t.Errorf("event %d has id %q, want %s", i, e.ID, want)
+        }
+    }
+}
+
+func TestKeepaliveStopsWithClient(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    r := httptest.NewRequest(http.MethodGet, "/stream?intervalMs=60000&heartbeatMs=10", nil).WithContext(ctx)
+    pr, pw := io.Pipe()
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        streamHandler(&pipeRecorder{ResponseRecorder: httptest.NewRecorder(), w: pw}, r)
+    }()
+    buf := make([]byte, 64)
+    var got strings.Builder
+    for !strings.Contains(got.String(), ": ping\n\n: ping\n\n") {
+        n, err := pr.Read(buf)
+        if err != nil {
+            t.Fatal(err)
+        }
+        got.Write(buf[:n])
+    }
+    cancel()
+    go io.Copy(io.Discard, pr)
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("stream kept running after the client left")
+    }
+}
+
+// pipeRecorder is a flushable ResponseWriter whose body goes to w, so a
+// test can read a stream while it runs.
+type pipeRecorder struct {
+    *httptest.ResponseRecorder
+    w io.Writer
+}
+
+func (p *pipeRecorder) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+func (p *pipeRecorder) WriteString(s string) (int, error) { return io.WriteString(p.w, s) }
+
+func TestKeepaliveWireFormat(t *testing.T) {
+    rr := httptest.NewRecorder()
+    sw, _ := newSSEWriter(rr, newMetricsRegistry())
+    if err := sw.Keepalive(); err != nil {
+        t.Fatal(err)
+    }
+    if got := rr.Body.String(); got != ": ping\n\n" {
+        t.Fatalf("keep-alive = %q, want %q", got, ": ping\n\n")
+    }
+}
+
+func TestKeepaliveDoesNotAdvanceSequence(t *testing.T) {
+    // Pings far outnumber events, yet the numbers run on unbroken.
+    code, events := recordStream(streamHandler, "/stream?intervalMs=30&heartbeatMs=3&limit=4&send_eof=false", nil)
+    if got := eventIDs(events); code != http.StatusOK || !slices.Equal(got, []string{"0", "1", "2", "3"}) {
+        t.Fatalf("status %d, ids %v; want 0 1 2 3", code, got)
+    }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "io/fs"
+    "net"
+    "os"
+    "strconv"
+)
+
+// openListeners opens the listeners the server accepts connections on: TCP
+// on addr unless LISTEN_TCP=false, and a unix socket at LISTEN_UNIX when it
+// is set, e.g. for a sidecar proxy. Both can be served at once.
+func openListeners(addr string) ([]net.Listener, error) {
+    var listeners []net.Listener
+    closeAll := func() {
+        for _, l := range listeners {
+            _ = l.Close()
+        }
+    }
+    if tcp, _ := strconv.ParseBool(getEnv("LISTEN_TCP", "true")); tcp {
+        l, err := net.Listen("tcp", addr)
+        if err != nil {
+            return nil, err
+        }
+        listeners = append(listeners, l)
+    }
+    if path := getEnv("LISTEN_UNIX", ""); path != "" {
+        mode, err := strconv.ParseUint(getEnv("LISTEN_UNIX_MODE", "0660"), 8, 32)
+        if err != nil {
+            closeAll()
+            return nil, fmt.Errorf("invalid LISTEN_UNIX_MODE: %w", err)
+        }
+        l, err := listenUnix(path, fs.FileMode(mode))
+        if err != nil {
+            closeAll()
+            return nil, err
+        }
+        listeners = append(listeners, l)
+    }
+    if len(listeners) == 0 {
+        return nil, errors.New("no listeners: LISTEN_TCP=false needs LISTEN_UNIX")
+    }
+    return listeners, nil
+}
+
+// listenUnix listens on a unix socket at path with the given permissions.
+// A socket left behind by a previous run is removed first; any other file
+// at path is an error rather than something to delete. The socket file is
+// removed again when the listener is closed.
+func listenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+    if fi, err := os.Lstat(path); err == nil {
+        if fi.Mode().Type() != fs.ModeSocket {
+            return nil, fmt.Errorf("LISTEN_UNIX %s exists and is not a socket", path)
+        }
+        if err := os.Remove(path); err != nil {
+            return nil, fmt.Errorf("remove stale socket: %w", err)
+        }
+    }
+    l, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, err
+    }
+    if err := os.Chmod(path, mode); err != nil {
+        _ = l.Close()
+        return nil, fmt.Errorf("chmod %s: %w", path, err)
+    }
+    return l, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "io/fs"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// socketPath returns a path for a unix socket in a fresh directory short
+// enough for the sun_path limit, which t.TempDir can exceed.
+func socketPath(t *testing.T) string {
+    t.Helper()
+    dir, err := os.MkdirTemp("", "sc")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.RemoveAll(dir) })
+    return filepath.Join(dir, "s.sock")
+}
+
+func TestStreamOverUnixSocketAndTCP(t *testing.T) {
+    isolateShutdown(t)
+    path := socketPath(t)
+    // A socket left behind by a crashed run.
+    stale, err := net.Listen("unix", path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    stale.(*net.UnixListener).SetUnlinkOnClose(false)
+    stale.Close()
+    if _, err := os.Lstat(path); err != nil {
+        t.Fatalf("stale socket not left behind: %v", err)
+    }
+
+    t.Setenv("LISTEN_UNIX", path)
+    t.Setenv("LISTEN_UNIX_MODE", "0600")
+    listeners, err := openListeners("127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(listeners) != 2 {
+        t.Fatalf("%d listeners, want TCP and unix", len(listeners))
+    }
+    if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+        t.Fatalf("socket %v, %v; want mode 0600", fi, err)
+    }
+    srv := withServer("", streamTracker.Middleware(http.HandlerFunc(streamHandler)))
+    for _, l := range listeners {
+        go serve(srv, l, false)
+    }
+    t.Cleanup(func() { srv.Close() })
+
+    unixClient := &http.Client{Transport: &http.Transport{
+        DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+            var d net.Dialer
+            return d.DialContext(ctx, "unix", path)
+        },
+    }}
+    t.Cleanup(unixClient.CloseIdleConnections)
+    var bodies []<-chan string
+    for _, get := range []func() (*http.Response, error){
+        func() (*http.Response, error) { return unixClient.Get("http://unix/stream?intervalMs=60000&burst=2") },
+        func() (*http.Response, error) {
+            return http.Get("http://" + listeners[0].Addr().String() + "/stream?intervalMs=60000&burst=2")
+        },
+    } {
+        resp, err := get()
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        if events, err := scanSSE(resp.Body, 2); err != nil || len(events) != 2 {
+            t.Fatalf("read %+v, %v; want two events", events, err)
+        }
+        bodies = append(bodies, drainBody(resp))
+    }
+
+    // Shutdown ends the streams on both listeners and removes the socket.
+    if err := shutdown(srv, 2*time.Second, slog.Default()); !errors.Is(err, http.ErrServerClosed) {
+        t.Fatalf("shutdown() = %v", err)
+    }
+    for i, body := range bodies {
+        if got := <-body; !strings.Contains(got, "event: shutdown\n") {
+            t.Errorf("stream %d ended with %q, want the shutdown event", i, got)
+        }
+    }
+    if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+        t.Errorf("socket still there after shutdown: %v", err)
+    }
+}
+
+func TestListenUnixRefusesOtherFiles(t *testing.T) {
+    path := socketPath(t)
+    if err := os.WriteFile(path, []byte("keep me"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    t.Setenv("LISTEN_TCP", "false")
+    t.Setenv("LISTEN_UNIX", path)
+    if _, err := openListeners(""); err == nil || !strings.Contains(err.Error(), "not a socket") {
+        t.Errorf("err = %v, want a not-a-socket error", err)
+    }
+    if b, _ := os.ReadFile(path); string(b) != "keep me" {
+        t.Error("regular file at LISTEN_UNIX was touched")
+    }
+
+    t.Setenv("LISTEN_UNIX", "")
+    if _, err := openListeners(""); err == nil {
+        t.Error("LISTEN_TCP=false without LISTEN_UNIX: no error")
+    }
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/binary"
+    "fmt"
+    "io"
+    "log/slog"
+    "net/http"
+    "regexp"
+    "time"
+)
+
+// newLogger builds the server's logger from LOG_FORMAT (json or text,
+// default json) and LOG_LEVEL (debug, info, warn or error, default info).
+func newLogger(w io.Writer) (*slog.Logger, error) {
+    var level slog.Level
+    if err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+        return nil, fmt.Errorf("invalid LOG_LEVEL: %w", err)
+    }
+    opts := &slog.HandlerOptions{Level: level}
+    switch format := getEnv("LOG_FORMAT", "json"); format {
+    case "json":
+        return slog.New(slog.NewJSONHandler(w, opts)), nil
+    case "text":
+        return slog.New(slog.NewTextHandler(w, opts)), nil
+    default:
+        return nil, fmt.Errorf("invalid LOG_FORMAT: %s", format)
+    }
+}
+
+type loggerKey struct{}
+
+// withLogger injects logger into each request's context, tagged with the
+// request ID, for handlers to fetch with loggerFrom. It must run inside
+// requestIDMiddleware.
+func withLogger(logger *slog.Logger) MiddlewareFunc {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            l := logger.With(slog.String("request_id", requestIDFrom(r.Context())))
+            next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+        })
+    }
+}
+
+// loggerFrom returns the logger injected by withLogger, or slog's default
+// for requests that did not pass through it.
+func loggerFrom(ctx context.Context) *slog.Logger {
+    if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+        return l
+    }
+    return slog.Default()
+}
+
+type requestIDKey struct{}
+
+// requestIDPattern limits the X-Request-ID values accepted from clients so
+// they are safe to echo back and log.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// crockford is the base32 alphabet used by ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: a 48-bit millisecond timestamp followed by 80
+// random bits, as 26 Crockford base32 characters. IDs sort by creation time,
+// which keeps related log lines together.
+func newULID() string {
+    var b [16]byte
+    ms := uint64(time.Now().UnixMilli())
+    for i := 0; i < 6; i++ {
+        b[i] = byte(ms >> (40 - 8*i))
+    }
+    _, _ = rand.Read(b[6:])
+    hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+    var out [26]byte
+    for i := len(out) - 1; i >= 0; i-- {
+        out[i] = crockford[lo&31]
+        lo = lo>>5 | hi<<59
+        hi >>= 5
+    }
+    return string(out[:])
+}
+
+// requestIDFrom returns the request ID stored by requestIDMiddleware, or ""
+// outside of it.
+func requestIDFrom(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+    return id
+}
+
+// requestIDMiddleware gives each request an ID, reusing a well-formed
+// X-Request-ID from the client or a proxy and otherwise calling newID. It
+// stores the ID in the request context and echoes it in the X-Request-ID
+// response header.
+func requestIDMiddleware(newID func() string) MiddlewareFunc {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            id := r.Header.Get("X-Request-ID")
+            if !requestIDPattern.MatchString(id) {
+                id = newID()
+            }
+            w.Header().Set("X-Request-ID", id)
+            next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+        })
+    }
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRequestIDInHeaderAndEvents(t *testing.T) {
+    h := requestIDMiddleware(func() string { return "generated-1" })(http.HandlerFunc(streamHandler))
+    tests := []struct {
+        header, want string
+    }{
+        {"", "generated-1"},
+        {"client.id-42", "client.id-42"},
+        {"bad id\n", "generated-1"},
+        {strings.Repeat("x", 65), "generated-1"},
+    }
+    for _, tt := range tests {
+        r := httptest.NewRequest(http.MethodGet, "/stream?intervalMs=1&limit=2&format=json", nil)
+        if tt.header != "" {
+            r.Header.Set("X-Request-ID", tt.header)
+        }
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, r)
+        if got := rr.Header().Get("X-Request-ID"); got != tt.want {
+            t.Errorf("X-Request-ID %q: response header %q, want %q", tt.header, got, tt.want)
+        }
+        events, err := scanSSE(rr.Body, 3)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, e := range events[:2] {
+            var env envelope
+            if err := json.Unmarshal([]byte(e.Data), &env); err != nil || env.RequestID != tt.want {
+                t.Errorf("X-Request-ID %q: event %q has requestId %q, want %q", tt.header, e.Data, env.RequestID, tt.want)
+            }
+        }
+    }
+}
+
+func TestNewULID(t *testing.T) {
+    a := newULID()
+    time.Sleep(2 * time.Millisecond)
+    b := newULID()
+    if len(a) != 26 || !requestIDPattern.MatchString(a) {
+        t.Errorf("newULID() = %q, want 26 Crockford characters", a)
+    }
+    if strings.Trim(a, crockford) != "" {
+        t.Errorf("newULID() = %q has characters outside the alphabet", a)
+    }
+    if a >= b {
+        t.Errorf("ULIDs %q then %q do not sort by time", a, b)
+    }
+}
+
+func TestLoggerCarriesRequestID(t *testing.T) {
+    var buf bytes.Buffer
+    logger := slog.New(slog.NewJSONHandler(&buf, nil))
+    h := Chain(requestIDMiddleware(func() string { return "rid-7" }), withLogger(logger))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        loggerFrom(r.Context()).Info("inside")
+    }))
+    h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+    if rec := logRecord(t, &buf, "inside"); rec["request_id"] != "rid-7" {
+        t.Errorf("log line %v, want request_id rid-7", rec)
+    }
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "log"
+    "log/slog"
+    "net"
+    "net/http"
+    "os"
+    "os/signal"
+    "runtime"
+    "strconv"
+    "sync/atomic"
+    "syscall"
+    "time"
+
+    "golang.org/x/net/http2"
+    "golang.org/x/net/http2/h2c"
+)
+
+// ready reports whether the server should receive new traffic. main sets it
+// once serving and shutdown clears it before draining.
+var ready atomic.Bool
+
+// livezHandler serves /livez: the process is up.
+func livezHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    _, _ = w.Write([]byte("ok"))
+}
+
+// unhealthyQueueDepth is UNHEALTHY_QUEUE_DEPTH, the hub queue depth above
+// which /health fails.
+var unhealthyQueueDepth = 1000
+
+type health struct {
+    Status        string `json:"status"`
+    ActiveStreams int    `json:"active_streams"`
+    HubQueueDepth int    `json:"hub_queue_depth"`
+    DroppedEvents int64  `json:"dropped_events"`
+    UptimeMs      int64  `json:"uptime_ms"`
+}
+
+// healthHandler serves /health as JSON. It fails with 503 and status
+// "degraded" while more than UNHEALTHY_QUEUE_DEPTH published events are
+// undelivered, most of them buffered for subscribers that cannot keep up.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+    h := health{
+        Status:        "ok",
+        ActiveStreams: openStreams.count(),
+        UptimeMs:      time.Since(processStart).Milliseconds(),
+    }
+    h.HubQueueDepth, h.DroppedEvents = topics.backlog()
+    status := http.StatusOK
+    if h.HubQueueDepth > unhealthyQueueDepth {
+        h.Status = "degraded"
+        status = http.StatusServiceUnavailable
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    w.WriteHeader(status)
+    _ = json.NewEncoder(w).Encode(h)
+}
+
+// readyHandler serves /readyz, which fails with 503 while the server is
+// starting or draining so load balancers stop routing to it.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    if !ready.Load() {
+        w.WriteHeader(http.StatusServiceUnavailable)
+        _, _ = w.Write([]byte("draining"))
+        return
+    }
+    _, _ = w.Write([]byte("ok"))
+}
+
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    _, _ = w.Write([]byte("/stream and /stream/{topic} stream numbers via SSE. params: intervalMs,start,end,step,limit,heartbeatMs,retryMs,format,payload. /stream/json sends JSON ticks. /stream/eof ends finite streams with an eof event. /stream/replay?events=... replays canned events. /stream/binary sends 8-byte frames. /stream.ndjson and /ws mirror it as NDJSON and over WebSocket. /poll long-polls published events. POST /publish and /publish/{topic} broadcast an event"))
+}
+
+// withServer builds the server. With ENABLE_H2C=true it also speaks
+// cleartext HTTP/2, both with prior knowledge and via Upgrade: h2c, for
+// load balancers that talk HTTP/2 to backends without TLS. The h2c response
+// writer flushes like any other, so streams are unaffected.
+func withServer(addr string, handler http.Handler) *http.Server {
+    if enabled, _ := strconv.ParseBool(getEnv("ENABLE_H2C", "false")); enabled {
+        handler = h2c.NewHandler(handler, &http2.Server{})
+    }
+    return &http.Server{
+        Addr:         addr,
+        Handler:      handler,
+        ReadTimeout:  0,
+        WriteTimeout: 0,
+        TLSConfig: &tls.Config{
+            MinVersion: tls.VersionTLS12,
+            NextProtos: []string{"h2", "http/1.1"},
+        },
+    }
+}
+
+// gracefulServeTLS serves HTTPS when both certFile and keyFile are set and
+// plain HTTP when neither is. Setting only one is an error, as is a cert that
+// cannot be loaded; neither falls back to plain HTTP. SIGHUP reloads the
+// certificate without dropping connections.
+func gracefulServeTLS(srv *http.Server, certFile, keyFile string, logger *slog.Logger) error {
+    if (certFile == "") != (keyFile == "") {
+        return errors.New("TLS needs both a certificate and a key")
+    }
+    var certs *certStore
+    if certFile != "" {
+        var err error
+        if certs, err = newCertStore(certFile, keyFile); err != nil {
+            return err
+        }
+        if srv.TLSConfig == nil {
+            srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+        }
+        srv.TLSConfig.GetCertificate = certs.GetCertificate
+    }
+    timeout, err := shutdownTimeout()
+    if err != nil {
+        return err
+    }
+    if timeout > maxSaneShutdownTimeout {
+        logger.Warn("SHUTDOWN_TIMEOUT_MS is unusually long; deploys and restarts will wait that long for slow clients", slog.Int64("timeout_ms", timeout.Milliseconds()))
+    }
+    listeners, err := openListeners(srv.Addr)
+    if err != nil {
+        return err
+    }
+    for _, l := range listeners {
+        logger.Info("server starting", slog.String("addr", l.Addr().String()), slog.String("network", l.Addr().Network()), slog.Bool("tls", certs != nil))
+    }
+    // Signals are caught before the server reports ready, so a SIGQUIT
+    // sent once it is never falls through to Go's default of exiting.
+    sigCh := make(chan os.Signal, 1)
+    signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+    defer signal.Stop(sigCh)
+    ready.Store(true)
+    errCh := make(chan error, len(listeners))
+    for _, l := range listeners {
+        go func() { errCh <- serve(srv, l, certs != nil) }()
+    }
+    for {
+        select {
+        case err := <-errCh:
+            return err
+        case sig := <-sigCh:
+            switch sig {
+            case syscall.SIGHUP:
+                reloadCerts(certs, logger)
+                continue
+            case syscall.SIGQUIT:
+                dumpGoroutines(getEnv("DEBUG_DUMP_FILE", ""), logger)
+                continue
+            }
+            logger.Info("shutting down", slog.String("signal", sig.String()), slog.Int64("timeout_ms", timeout.Milliseconds()))
+            return shutdown(srv, timeout, logger)
+        }
+    }
+}
+
+// shutdown drains srv: it marks the server not ready, tells open streams to
+// send their shutdown event and stop, waits up to timeout for them and for
+// other requests, then closes whatever is left. It returns
+// http.ErrServerClosed like Serve does.
+func shutdown(srv *http.Server, timeout time.Duration, logger *slog.Logger) error {
+    ready.Store(false)
+    beginShutdown()
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    // Streams were told to stop by beginShutdown; give them the same
+    // deadline to say goodbye before the listener and idle connections are
+    // closed.
+    if err := streamTracker.Drain(ctx); err != nil {
+        logger.Warn("streams still open at shutdown deadline", slog.Any("error", err))
+    }
+    if err := srv.Shutdown(ctx); err != nil {
+        // Handlers that ignored shutdown would otherwise keep the process
+        // alive; cut their connections.
+        logger.Warn("shutdown incomplete; closing remaining connections", slog.Any("error", err))
+        _ = srv.Close()
+    } else {
+        logger.Info("shutdown complete")
+    }
+    return http.ErrServerClosed
+}
+
+// maxSaneShutdownTimeout is the SHUTDOWN_TIMEOUT_MS above which startup
+// warns: orchestrators usually kill the process well before that anyway.
+const maxSaneShutdownTimeout = 60 * time.Second
+
+// shutdownTimeout is SHUTDOWN_TIMEOUT_MS, how long shutdown waits for
+// streams and requests to finish before closing their connections.
+func shutdownTimeout() (time.Duration, error) {
+    ms, err := strconv.Atoi(getEnv("SHUTDOWN_TIMEOUT_MS", "5000"))
+    if err != nil || ms <= 0 {
+        return 0, errors.New("invalid SHUTDOWN_TIMEOUT_MS: must be an integer >= 1")
+    }
+    return time.Duration(ms) * time.Millisecond, nil
+}
+
+// reloadCerts handles SIGHUP. Without TLS there is nothing to reload; a
+// failed reload keeps serving the previous certificate.
+func reloadCerts(certs *certStore, logger *slog.Logger) {
+    if certs == nil {
+        logger.Info("SIGHUP ignored: TLS not enabled")
+        return
+    }
+    if err := certs.reload(); err != nil {
+        logger.Error("TLS certificate reload failed; keeping the current one", slog.Any("error", err))
+        return
+    }
+    logger.Info("TLS certificate reloaded", slog.String("cert_file", certs.certFile))
+}
+
+// dumpGoroutines handles SIGQUIT by appending the stacks of all goroutines
+// to path, or writing them to stderr when path is empty, and keeps serving.
+// Go's default SIGQUIT handling would print them too, but then exit.
+func dumpGoroutines(path string, logger *slog.Logger) {
+    buf := make([]byte, 1<<20)
+    for {
+        n := runtime.Stack(buf, true)
+        if n < len(buf) {
+            buf = buf[:n]
+            break
+        }
+        buf = make([]byte, 2*len(buf))
+    }
+    out := os.Stderr
+    if path != "" {
+        f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+        if err != nil {
+            logger.Error("goroutine dump failed", slog.String("file", path), slog.Any("error", err))
+            return
+        }
+        defer f.Close()
+        out = f
+    }
+    header := fmt.Sprintf("=== goroutine dump at %s ===\n", time.Now().UTC().Format(time.RFC3339))
+    if _, err := out.WriteString(header + string(buf) + "\n"); err != nil {
+        logger.Error("goroutine dump failed", slog.String("file", path), slog.Any("error", err))
+        return
+    }
+    logger.Info("goroutine dump written", slog.String("file", path), slog.Int("bytes", len(buf)))
+}
+
+// serve serves l with HTTPS, with HTTP/2 negotiated via ALPN, when useTLS
+// is set and plain HTTP/1.1 otherwise. srv.Shutdown closes l.
+func serve(srv *http.Server, l net.Listener, useTLS bool) error {
+    if useTLS {
+        return srv.ServeTLS(l, "", "")
+    }
+    return srv.Serve(l)
+}
+
+func getEnv(key, def string) string {
+    if v := os.Getenv(key); v != "" {
+        return v
+    }
+    return def
+}
+
+func main() {
+    source := flag.String("source", getEnv("STREAM_SOURCE", "counter"), "source of /stream events when the request names none, e.g. stdin")
+    flag.Parse()
+
+    logger, err := newLogger(os.Stderr)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    verifier, err := jwtVerifierFromEnv(logger)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    cors := corsConfigFromEnv()
+    if err := cors.Validate(); err != nil {
+        log.Fatal(err)
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", rootHandler)
+    mux.HandleFunc("/health", healthHandler)
+    mux.HandleFunc("/livez", livezHandler)
+    mux.HandleFunc("/readyz", readyHandler)
+    mux.HandleFunc("/metrics", metricsHandler)
+    mux.Handle("/stats", bearerAuthMiddleware(statsTokens, nil)(http.HandlerFunc(statsHandler)))
+    mux.Handle("/admin/connections", bearerAuthMiddleware(adminTokens, nil)(http.HandlerFunc(adminConnectionsHandler)))
+    mux.Handle("/admin/interval", bearerAuthMiddleware(adminTokens, nil)(http.HandlerFunc(adminIntervalHandler)))
+    maxConnPerIP, _ := strconv.Atoi(getEnv("MAX_CONNECTIONS_PER_IP", getEnv("MAX_CONN_PER_IP", "10")))
+    streaming := Chain(
+        streamTracker.Middleware,
+        bearerAuthMiddleware(authTokens, verifier),
+        rateLimitMiddleware(maxConnPerIP),
+    )
+    mux.Handle("/stream", streaming(http.HandlerFunc(streamHandler)))
+    mux.Handle("/stream/{topic}", streaming(http.HandlerFunc(streamHandler)))
+    mux.Handle("/stream/json", streaming(http.HandlerFunc(streamJSONHandler)))
+    mux.Handle("/stream/eof", streaming(http.HandlerFunc(streamEOFHandler)))
+    mux.Handle("/stream/replay", streaming(http.HandlerFunc(replayHandler)))
+    mux.Handle("/stream/binary", streaming(http.HandlerFunc(binaryStreamHandler)))
+    mux.Handle("/stream.ndjson", streaming(http.HandlerFunc(ndjsonHandler)))
+    mux.Handle("/ws", streaming(http.HandlerFunc(wsHandler)))
+    mux.Handle("/ws/{topic}", streaming(http.HandlerFunc(wsHandler)))
+    mux.Handle("/poll", streaming(http.HandlerFunc(pollHandler)))
+    mux.Handle("/poll/{topic}", streaming(http.HandlerFunc(pollHandler)))
+    publishing := Chain(
+        bearerAuthMiddleware(authTokens, verifier),
+        apiKeyMiddleware(func() string { return os.Getenv("PUBLISH_API_KEY") }),
+        publishRateLimit(),
+    )
+    mux.Handle("/publish", publishing(http.HandlerFunc(publishHandler)))
+    mux.Handle("/publish/{topic}", publishing(http.HandlerFunc(publishHandler)))
+
+    brokerCfg, err := brokerConfigFromEnv()
+    if err != nil {
+        log.Fatal(err)
+    }
+    autoCreate, err := strconv.ParseBool(getEnv("AUTO_CREATE_TOPICS", "true"))
+    if err != nil {
+        log.Fatalf("invalid AUTO_CREATE_TOPICS: %v", err)
+    }
+    topics = newTopicRegistry(brokerCfg, autoCreate, getEnv("TOPICS", ""))
+    if topics.maxAuto, topics.idleTTL, err = topicLimitsFromEnv(); err != nil {
+        log.Fatal(err)
+    }
+    topics.evictIdleEvery(time.Minute)
+    if unhealthyQueueDepth, err = strconv.Atoi(getEnv("UNHEALTHY_QUEUE_DEPTH", "1000")); err != nil || unhealthyQueueDepth < 0 {
+        log.Fatal("invalid UNHEALTHY_QUEUE_DEPTH: must be an integer >= 0")
+    }
+    if maxEventBytes, err = strconv.Atoi(getEnv("MAX_EVENT_BYTES", "65536")); err != nil || maxEventBytes < 0 {
+        log.Fatal("invalid MAX_EVENT_BYTES: must be an integer >= 0")
+    }
+    maxPollWaitMs, err := strconv.Atoi(getEnv("MAX_POLL_WAIT_MS", "60000"))
+    if err != nil || maxPollWaitMs < 1 {
+        log.Fatal("invalid MAX_POLL_WAIT_MS: must be an integer >= 1")
+    }
+    maxPollWait = time.Duration(maxPollWaitMs) * time.Millisecond
+    if retryJitterPct, err = strconv.ParseFloat(getEnv("RETRY_JITTER_PCT", "20"), 64); err != nil || retryJitterPct < 0 || retryJitterPct > 100 {
+        log.Fatal("invalid RETRY_JITTER_PCT: must be a number from 0 to 100")
+    }
+    if trustProxy, err = strconv.ParseBool(getEnv("TRUST_PROXY", "false")); err != nil {
+        log.Fatalf("invalid TRUST_PROXY: %v", err)
+    }
+    tails, err := tailSourceFromEnv(brokerCfg, logger)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if tails != nil {
+        registerSource("tail", tails)
+    }
+    execs, err := execSourceFromEnv(brokerCfg, logger)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if execs != nil {
+        registerSource("exec", execs)
+    }
+    if *source == "stdin" {
+        exitOnEOF, _ := strconv.ParseBool(getEnv("EXIT_ON_EOF", "false"))
+        registerSource("stdin", newStdinSource(os.Stdin, brokerCfg, exitOnEOF, logger))
+    }
+    if _, ok := sources[*source]; !ok {
+        log.Fatalf("unknown source %q", *source)
+    }
+    defaultSource = *source
+
+    if maxConns, _ := strconv.Atoi(getEnv("MAX_CONNECTIONS", "0")); maxConns > 0 {
+        streamSlots = make(chan struct{}, maxConns)
+    }
+
+    port := getEnv("PORT", "8080")
+    srv := withServer(":"+port, Chain(requestIDMiddleware(newULID), withLogger(logger), loggingMiddleware(logger), newCORSMiddleware(cors), rateLimit)(mux))
+
+    srv.ErrorLog = slog.NewLogLogger(logger.Handler(), slog.LevelError)
+
+    if err := gracefulServeTLS(srv, getEnv("TLS_CERT_FILE", getEnv("TLSCERT", "")), getEnv("TLS_KEY_FILE", getEnv("TLSKEY", "")), logger); err != nil && err != http.ErrServerClosed {
+        log.Fatalf("server error: %v", err)
+    }
+    if execs != nil {
+        execs.wait()
+    }
+
+    _ = srv.Shutdown(context.Background())
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "log/slog"
+    "math"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestMain(m *testing.M) {
+    slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+    topics = newTopicRegistry(brokerConfig{history: 512, buffer: 16, policy: dropNewest}, true, "")
+    os.Exit(m.Run())
+}
+
+// readSSE requests path from srv with the given headers and parses the
+// first n events of the response, failing the test after 5s.
+func readSSE(t *testing.T, srv *httptest.Server, path string, header http.Header, n int) []SSEEvent {
+    t.Helper()
+    req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for k, v := range header {
+        req.Header[k] = v
+    }
+    client := &http.Client{Timeout: 5 * time.Second}
+    resp, err := client.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("GET %s: status %d", path, resp.StatusCode)
+    }
+    events, err := scanSSE(resp.Body, n)
+    if len(events) < n {
+        t.Fatalf("GET %s: got %d events, want %d (%v)", path, len(events), n, err)
+    }
+    return events
+}
+
+// openStream starts streaming path from srv, closing the response when the
+// test ends.
+func openStream(t *testing.T, srv *httptest.Server, path string) *http.Response {
+    t.Helper()
+    resp, err := http.Get(srv.URL + path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { resp.Body.Close() })
+    if resp.StatusCode != http.StatusOK {
+        t.Fatalf("GET %s: status %d", path, resp.StatusCode)
+    }
+    return resp
+}
+
+// waitFor polls cond for up to 2s, failing the test with msg if it never
+// holds.
+func waitFor(t *testing.T, msg string, cond func() bool) {
+    t.Helper()
+    deadline := time.Now().Add(2 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatal("timed out waiting: " + msg)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+// uniqueTopic returns a topic name no other test uses.
+func uniqueTopic(prefix string) string {
+    return fmt.Sprintf("%s%d", prefix, time.Now().UnixNano())
+}
+
+// recordStream serves a finite stream for path through h and returns its
+// status and events.
+func recordStream(h http.HandlerFunc, path string, header http.Header) (int, []SSEEvent) {
+    rr := httptest.NewRecorder()
+    req := httptest.NewRequest(http.MethodGet, path, nil)
+    for k, vs := range header {
+        for _, v := range vs {
+            req.Header.Add(k, v)
+        }
+    }
+    h(rr, req)
+    events, _ := scanSSE(rr.Body, math.MaxInt)
+    return rr.Code, events
+}
+
+// eventIDs returns the IDs of events.
+func eventIDs(events []SSEEvent) []string {
+    ids := make([]string, len(events))
+    for i, e := range events {
+        ids[i] = e.ID
+    }
+    return ids
+}
+
+// scanSSE parses up to n events from r the way EventSource does: data
+// lines are joined with newlines, and records with only a retry field or
+// comments are skipped.
+func scanSSE(r io.Reader, n int) ([]SSEEvent, error) {
+    var events []SSEEvent
+    var e SSEEvent
+    var data []string
+    sc := bufio.NewScanner(r)
+    for len(events) < n && sc.Scan() {
+        line := sc.Text()
+        field, value, _ := strings.Cut(line, ":")
+        value = strings.TrimPrefix(value, " ")
+        switch field {
+        case "":
+            if line == "" && (e.ID != "" || e.Event != "" || data != nil) {
+                e.Data = strings.Join(data, "\n")
+                events = append(events, e)
+                e, data = SSEEvent{}, nil
+            }
+        case "id":
+            e.ID = value
+        case "event":
+            e.Event = value
+        case "data":
+            data = append(data, value)
+        }
+    }
+    return events, sc.Err()
+}
+
+// newStreamServer serves the streaming endpoints the way main does, without
+// auth or limits.
+func newStreamServer(t *testing.T) *httptest.Server {
+    t.Helper()
+    mux := http.NewServeMux()
+    mux.HandleFunc("/stream", streamHandler)
+    mux.HandleFunc("/stream/{topic}", streamHandler)
+    mux.HandleFunc("/stream/eof", streamEOFHandler)
+    mux.HandleFunc("/stream.ndjson", ndjsonHandler)
+    mux.HandleFunc("/stream/replay", replayHandler)
+    mux.HandleFunc("/publish", publishHandler)
+    mux.HandleFunc("/publish/{topic}", publishHandler)
+    mux.HandleFunc("/poll", pollHandler)
+    mux.HandleFunc("/poll/{topic}", pollHandler)
+    srv := httptest.NewServer(mux)
+    t.Cleanup(srv.Close)
+    return srv
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+    "net/http"
+    "time"
+
+    "github.com/Amarifields/streaming-core/metrics"
+)
+
+// metricsRegistry holds the server's metrics, exposed at /metrics in the
+// Prometheus text format. Handlers and sinks record into defaultMetrics;
+// tests can hand them a fresh registry instead.
+type metricsRegistry struct {
+    registry           *metrics.Registry
+    activeConnections  *metrics.Gauge
+    connectionsTotal   *metrics.Counter
+    eventsSent         *metrics.Counter
+    eventsDropped      *metrics.Counter
+    bytesWritten       *metrics.Counter
+    writeErrors        *metrics.Counter
+    connectionDuration *metrics.Histogram
+}
+
+func newMetricsRegistry() *metricsRegistry {
+    reg := metrics.NewRegistry()
+    return &metricsRegistry{
+        registry:           reg,
+        activeConnections:  reg.NewGauge("streaming_active_connections", "Number of open stream connections."),
+        connectionsTotal:   reg.NewCounter("streaming_connections_total", "Stream connections accepted."),
+        eventsSent:         reg.NewCounter("streaming_events_sent_total", "Events written to stream clients."),
+        eventsDropped:      reg.NewCounter("streaming_events_dropped_total", "Events dropped for exceeding MAX_EVENT_BYTES."),
+        bytesWritten:       reg.NewCounter("streaming_bytes_written_total", "Bytes written to stream clients."),
+        writeErrors:        reg.NewCounter("streaming_write_errors_total", "Failed writes to stream clients."),
+        connectionDuration: reg.NewHistogram("streaming_connection_duration_seconds", "Lifetime of stream connections.", []float64{1, 5, 15, 60, 300, 900, 3600}),
+    }
+}
+
+var defaultMetrics = newMetricsRegistry()
+
+// trackConnection records an open stream and returns a func that records
+// its close.
+func (m *metricsRegistry) trackConnection() func() {
+    m.activeConnections.Inc()
+    m.connectionsTotal.Inc()
+    started := time.Now()
+    return func() {
+        m.activeConnections.Dec()
+        m.connectionDuration.Observe(time.Since(started).Seconds())
+    }
+}
+
+// recordWrite accounts for a write of n bytes that ended with err.
+func (m *metricsRegistry) recordWrite(n int, err error) {
+    m.bytesWritten.Add(int64(n))
+    if err != nil {
+        m.writeErrors.Inc()
+    }
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+    defaultMetrics.registry.Handler().ServeHTTP(w, r)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+// useMetrics points the handlers at a fresh registry for the rest of the
+// test.
+func useMetrics(t *testing.T) *metricsRegistry {
+    t.Helper()
+    old := defaultMetrics
+    defaultMetrics = newMetricsRegistry()
+    t.Cleanup(func() { defaultMetrics = old })
+    return defaultMetrics
+}
+
+func TestStreamRecordsMetrics(t *testing.T) {
+    m := useMetrics(t)
+    rr := httptest.NewRecorder()
+    streamHandler(rr, httptest.NewRequest(http.MethodGet, "/stream?intervalMs=1&limit=3&send_eof=false", nil))
+
+    if got := m.eventsSent.Value(); got != 3 {
+        t.Errorf("events sent = %d, want 3", got)
+    }
+    if got := m.bytesWritten.Value(); got != int64(rr.Body.Len()) {
+        t.Errorf("bytes written = %d, want %d", got, rr.Body.Len())
+    }
+    if got := m.connectionsTotal.Value(); got != 1 {
+        t.Errorf("connections total = %d, want 1", got)
+    }
+    if got := m.activeConnections.Value(); got != 0 {
+        t.Errorf("active connections = %d after the stream ended", got)
+    }
+    if got := m.writeErrors.Value(); got != 0 {
+        t.Errorf("write errors = %d", got)
+    }
+    var text strings.Builder
+    m.registry.WriteText(&text)
+    if !strings.Contains(text.String(), "\nstreaming_connection_duration_seconds_count 1\n") {
+        t.Errorf("duration histogram missing the stream:\n%s", text.String())
+    }
+}
+
+func TestMetricsAfterFiveEvents(t *testing.T) {
+    m := useMetrics(t)
+    streamHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stream?intervalMs=1&limit=5&send_eof=false", nil))
+    if got := m.eventsSent.Value(); got != 5 {
+        t.Errorf("events sent = %d, want 5", got)
+    }
+
+    rr := httptest.NewRecorder()
+    metricsHandler(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+    body := rr.Body.String()
+    if !strings.Contains(body, "\nstreaming_events_sent_total 5\n") {
+        t.Errorf("/metrics does not report 5 events:\n%s", body)
+    }
+    if !strings.Contains(body, "# TYPE streaming_events_sent_total counter\n") {
+        t.Errorf("/metrics has no TYPE line for the counter:\n%s", body)
+    }
+}
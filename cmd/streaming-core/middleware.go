@@ -0,0 +1,504 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "log/slog"
+    "net"
+    "net/http"
+    "net/url"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// MiddlewareFunc wraps a handler with additional behaviour.
+type MiddlewareFunc func(http.Handler) http.Handler
+
+// Chain composes middlewares left to right: the first one listed is the
+// outermost and sees each request first.
+func Chain(middlewares ...MiddlewareFunc) MiddlewareFunc {
+    return func(next http.Handler) http.Handler {
+        for i := len(middlewares) - 1; i >= 0; i-- {
+            next = middlewares[i](next)
+        }
+        return next
+    }
+}
+
+// CORSConfig controls the CORS headers set by newCORSMiddleware.
+type CORSConfig struct {
+    // AllowOrigins lists origins allowed to read responses: exact origins,
+    // wildcard subdomains such as https://*.example.com, or "*" for any.
+    AllowOrigins []string
+    // AllowCredentials lets browsers send cookies and Authorization headers.
+    // The request's origin is then always echoed back, since browsers
+    // reject a wildcard on credentialed responses; Validate refuses it
+    // combined with "*".
+    AllowCredentials bool
+    // MaxAgeSec is how long browsers may cache a preflight; 0 omits it.
+    MaxAgeSec    int
+    AllowHeaders []string
+}
+
+// Validate rejects settings browsers would refuse: credentials are only
+// allowed for listed origins, not for any origin.
+func (cfg CORSConfig) Validate() error {
+    if !cfg.AllowCredentials {
+        return nil
+    }
+    if slices.Contains(cfg.AllowOrigins, "*") {
+        return errors.New("CORS_ALLOW_CREDENTIALS=true cannot be combined with CORS_ALLOW_ORIGINS=*; list the allowed origins instead")
+    }
+    return nil
+}
+
+// originList is a parsed CORS origin allowlist.
+type originList struct {
+    any       bool
+    origins   map[string]bool
+    wildcards []originPattern
+}
+
+// originPattern is an allowlist entry such as https://*.example.com, which
+// matches any subdomain (but not example.com itself) over the same scheme
+// and port.
+type originPattern struct {
+    scheme string
+    // suffix is the host after the "*", including the leading dot.
+    suffix string
+    port   string
+}
+
+func newOriginList(origins []string) originList {
+    l := originList{origins: make(map[string]bool)}
+    for _, o := range origins {
+        o = strings.TrimSpace(o)
+        switch {
+        case o == "":
+        case o == "*":
+            l.any = true
+        case strings.Contains(o, "://*."):
+            scheme, rest, _ := strings.Cut(o, "://*")
+            host, port, _ := strings.Cut(rest, ":")
+            l.wildcards = append(l.wildcards, originPattern{
+                scheme: strings.ToLower(scheme),
+                suffix: strings.ToLower(host),
+                port:   port,
+            })
+        default:
+            l.origins[o] = true
+        }
+    }
+    return l
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, or false when the origin is not allowed.
+func (l originList) allowOrigin(origin string) (string, bool) {
+    if l.any {
+        return "*", true
+    }
+    if origin == "" {
+        return "", false
+    }
+    if l.origins[origin] {
+        return origin, true
+    }
+    for _, p := range l.wildcards {
+        if p.matches(origin) {
+            return origin, true
+        }
+    }
+    return "", false
+}
+
+func (p originPattern) matches(origin string) bool {
+    u, err := url.Parse(origin)
+    if err != nil || u.Path != "" || u.User != nil || u.RawQuery != "" {
+        return false
+    }
+    host := strings.ToLower(u.Hostname())
+    return strings.ToLower(u.Scheme) == p.scheme &&
+        u.Port() == p.port &&
+        len(host) > len(p.suffix) &&
+        strings.HasSuffix(host, p.suffix)
+}
+
+// splitList splits a comma-separated env value, dropping empty entries.
+func splitList(v string) []string {
+    var out []string
+    for _, s := range strings.Split(v, ",") {
+        if s = strings.TrimSpace(s); s != "" {
+            out = append(out, s)
+        }
+    }
+    return out
+}
+
+// corsConfigFromEnv reads CORS_ALLOW_ORIGINS (or the single
+// CORS_ALLOW_ORIGIN), CORS_ALLOW_CREDENTIALS, CORS_MAX_AGE_SEC and
+// CORS_ALLOW_HEADERS.
+func corsConfigFromEnv() CORSConfig {
+    credentials, _ := strconv.ParseBool(getEnv("CORS_ALLOW_CREDENTIALS", "false"))
+    maxAge, _ := strconv.Atoi(getEnv("CORS_MAX_AGE_SEC", "0"))
+    return CORSConfig{
+        AllowOrigins:     splitList(getEnv("CORS_ALLOW_ORIGINS", getEnv("CORS_ALLOW_ORIGIN", "*"))),
+        AllowCredentials: credentials,
+        MaxAgeSec:        maxAge,
+        AllowHeaders:     splitList(getEnv("CORS_ALLOW_HEADERS", "Authorization,Content-Type,Last-Event-ID")),
+    }
+}
+
+// corsOrigins is the allowlist from the environment, parsed on first use.
+var corsOrigins = sync.OnceValue(func() originList {
+    return newOriginList(corsConfigFromEnv().AllowOrigins)
+})
+
+// newCORSMiddleware sets CORS headers on every response and answers
+// preflight requests. Origins not on the allowlist get no CORS headers at
+// all, only Vary: Origin so caches keep their responses apart.
+func newCORSMiddleware(cfg CORSConfig) MiddlewareFunc {
+    origins := newOriginList(cfg.AllowOrigins)
+    allowHeaders := strings.Join(cfg.AllowHeaders, ",")
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            origin := r.Header.Get("Origin")
+            allow, allowed := origins.allowOrigin(origin)
+            if allowed {
+                if cfg.AllowCredentials && allow == "*" && origin != "" {
+                    allow = origin
+                }
+                w.Header().Set("Access-Control-Allow-Origin", allow)
+                if cfg.AllowCredentials {
+                    w.Header().Set("Access-Control-Allow-Credentials", "true")
+                }
+            }
+            w.Header().Add("Vary", "Origin")
+            if r.Method == http.MethodOptions {
+                if !allowed {
+                    w.WriteHeader(http.StatusNoContent)
+                    return
+                }
+                w.Header().Set("Access-Control-Allow-Methods", "GET,POST,OPTIONS")
+                if allowHeaders != "" {
+                    w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+                }
+                if cfg.MaxAgeSec > 0 {
+                    w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAgeSec))
+                }
+                w.WriteHeader(http.StatusNoContent)
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// responseRecorder captures the status code and body size of a response. It
+// forwards Flush so streaming handlers keep working behind it.
+type responseRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int64
+
+    // onStream, if set, runs once when the response turns out to be
+    // long-lived: on its first flush or a hijack.
+    onStream  func()
+    streaming bool
+
+    // subject is the authenticated caller, set by bearerAuthMiddleware
+    // through setLogSubject.
+    subject string
+}
+
+// setLogSubject records the authenticated subject for the access log line
+// of the response behind w, if it is being logged.
+func setLogSubject(w http.ResponseWriter, subject string) {
+    for {
+        if rec, ok := w.(*responseRecorder); ok {
+            rec.subject = subject
+            return
+        }
+        u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+        if !ok {
+            return
+        }
+        w = u.Unwrap()
+    }
+}
+
+// subjectAttrs appends the authenticated subject, if any, to attrs.
+func (rec *responseRecorder) subjectAttrs(attrs []slog.Attr) []slog.Attr {
+    if rec.subject == "" {
+        return attrs
+    }
+    return append(attrs[:len(attrs):len(attrs)], slog.String("subject", rec.subject))
+}
+
+func (rec *responseRecorder) markStreaming() {
+    if rec.streaming {
+        return
+    }
+    rec.streaming = true
+    if rec.onStream != nil {
+        rec.onStream()
+    }
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+    if rec.status == 0 {
+        rec.status = code
+    }
+    rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+    if rec.status == 0 {
+        rec.status = http.StatusOK
+    }
+    n, err := rec.ResponseWriter.Write(b)
+    rec.bytes += int64(n)
+    return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+    _ = rec.FlushError()
+}
+
+// FlushError flushes like Flush but reports failures, such as a write
+// deadline expiring, through http.ResponseController.
+func (rec *responseRecorder) FlushError() error {
+    if rec.status == 0 {
+        rec.status = http.StatusOK
+    }
+    rec.markStreaming()
+    return http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+// Hijack hands the connection over for WebSocket upgrades.
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    h, ok := rec.ResponseWriter.(http.Hijacker)
+    if !ok {
+        return nil, nil, http.ErrNotSupported
+    }
+    rec.status = http.StatusSwitchingProtocols
+    rec.markStreaming()
+    return h.Hijack()
+}
+
+// Push forwards HTTP/2 server pushes.
+func (rec *responseRecorder) Push(target string, opts *http.PushOptions) error {
+    p, ok := rec.ResponseWriter.(http.Pusher)
+    if !ok {
+        return http.ErrNotSupported
+    }
+    return p.Push(target, opts)
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+    return rec.ResponseWriter
+}
+
+// loggingMiddleware writes one structured access log line per completed
+// request. Long-lived responses such as streams also get a "connect" line
+// when they first flush, and their final line reads "disconnect". It is a
+// no-op when DISABLE_ACCESS_LOG=true; paths listed in
+// ACCESS_LOG_EXCLUDE_PATHS, e.g. /health, are not logged.
+func loggingMiddleware(logger *slog.Logger) MiddlewareFunc {
+    if disabled, _ := strconv.ParseBool(getEnv("DISABLE_ACCESS_LOG", "false")); disabled {
+        return func(next http.Handler) http.Handler { return next }
+    }
+    excluded := make(map[string]bool)
+    for _, p := range splitList(getEnv("ACCESS_LOG_EXCLUDE_PATHS", "")) {
+        excluded[p] = true
+    }
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if excluded[r.URL.Path] {
+                next.ServeHTTP(w, r)
+                return
+            }
+            started := time.Now()
+            attrs := []slog.Attr{
+                slog.String("request_id", requestIDFrom(r.Context())),
+                slog.String("method", r.Method),
+                slog.String("path", r.URL.Path),
+                slog.String("remote_addr", r.RemoteAddr),
+            }
+            rec := &responseRecorder{ResponseWriter: w}
+            rec.onStream = func() {
+                logger.LogAttrs(r.Context(), slog.LevelInfo, "connect",
+                    append(rec.subjectAttrs(attrs), slog.Int("status", rec.status))...)
+            }
+            next.ServeHTTP(rec, r)
+            if rec.status == 0 {
+                rec.status = http.StatusOK
+            }
+            attrs = rec.subjectAttrs(attrs)
+            msg := "request"
+            if rec.streaming {
+                msg = "disconnect"
+            }
+            logger.LogAttrs(r.Context(), slog.LevelInfo, msg, append(attrs,
+                slog.Int("status", rec.status),
+                slog.Int64("bytes", rec.bytes),
+                slog.Float64("latency_ms", float64(time.Since(started).Microseconds())/1000),
+            )...)
+        })
+    }
+}
+
+// bearerAuthMiddleware requires a token from getTokens or, when verifier
+// is set, a valid JWT, sent as an "Authorization: Bearer <token>" header or,
+// for EventSource clients that cannot set headers, an access_token or token
+// query param. A JWT must also grant the {topic} in the path, else the
+// request gets 403. Rejections carry a JSON body such as
+// {"error":"unauthorized"}, sent before any stream headers. With no tokens
+// and no verifier the check is off, so leaving AUTH_TOKENS unset keeps the
+// server open rather than locking everyone out.
+func bearerAuthMiddleware(getTokens func() []string, verifier *jwtVerifier) MiddlewareFunc {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            want := getTokens()
+            if len(want) == 0 && verifier == nil {
+                next.ServeHTTP(w, r)
+                return
+            }
+            got, ok := requestToken(r)
+            if ok && len(want) > 0 && tokenMatches(got, want) {
+                next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), "token:"+got)))
+                return
+            }
+            if !ok || verifier == nil {
+                w.Header().Set("WWW-Authenticate", "Bearer")
+                writeAuthError(w, http.StatusUnauthorized, "unauthorized")
+                return
+            }
+            claims, err := verifier.verify(got)
+            if err != nil {
+                loggerFrom(r.Context()).Debug("JWT rejected", slog.Any("error", err))
+                w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+                writeAuthError(w, http.StatusUnauthorized, "invalid_token")
+                return
+            }
+            if !claims.allowsTopic(r.PathValue("topic")) {
+                writeAuthError(w, http.StatusForbidden, "forbidden")
+                return
+            }
+            setLogSubject(w, claims.Subject)
+            ctx := context.WithValue(r.Context(), claimsKey{}, claims)
+            ctx = withIdentity(ctx, "sub:"+claims.Subject)
+            ctx = context.WithValue(ctx, loggerKey{}, loggerFrom(ctx).With(slog.String("subject", claims.Subject)))
+            next.ServeHTTP(w, r.WithContext(ctx))
+        })
+    }
+}
+
+// writeAuthError answers a rejected request with {"error":code}.
+func writeAuthError(w http.ResponseWriter, status int, code string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    _ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+type identityKey struct{}
+
+// withIdentity records who the request was authenticated as, e.g.
+// "token:<token>" or "sub:<subject>", for per-caller limits. The first
+// identity set wins.
+func withIdentity(ctx context.Context, id string) context.Context {
+    if _, ok := identityFrom(ctx); ok {
+        return ctx
+    }
+    return context.WithValue(ctx, identityKey{}, id)
+}
+
+// identityFrom returns the verified identity of the request, if an auth
+// check set one.
+func identityFrom(ctx context.Context) (string, bool) {
+    id, ok := ctx.Value(identityKey{}).(string)
+    return id, ok
+}
+
+// apiKeyMiddleware requires the X-API-Key header to equal getKey() when it
+// is set, answering 401 otherwise.
+func apiKeyMiddleware(getKey func() string) MiddlewareFunc {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            want := getKey()
+            if want == "" {
+                next.ServeHTTP(w, r)
+                return
+            }
+            if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(want)) != 1 {
+                http.Error(w, "unauthorized", http.StatusUnauthorized)
+                return
+            }
+            next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), "api_key:"+want)))
+        })
+    }
+}
+
+// authTokens returns the tokens accepted on streaming endpoints and
+// /publish: AUTH_TOKENS, comma-separated, or the single AUTH_TOKEN.
+func authTokens() []string {
+    return splitList(getEnv("AUTH_TOKENS", getEnv("AUTH_TOKEN", "")))
+}
+
+// tokenMatches compares got against every token in constant time, so the
+// response time reveals neither which token nor how much of it matched.
+func tokenMatches(got string, want []string) bool {
+    match := 0
+    for _, t := range want {
+        match |= subtle.ConstantTimeCompare([]byte(got), []byte(t))
+    }
+    return match == 1
+}
+
+// tokenParams are the query params a token may be passed in, in order of
+// precedence.
+var tokenParams = []string{"access_token", "token"}
+
+// requestToken returns the bearer token from the Authorization header, or
+// else from a token query param.
+func requestToken(r *http.Request) (string, bool) {
+    if token, ok := bearerToken(r); ok {
+        return token, true
+    }
+    q := r.URL.Query()
+    for _, name := range tokenParams {
+        if token := q.Get(name); token != "" {
+            return token, true
+        }
+    }
+    return "", false
+}
+
+// redactedQuery returns r's query params with tokens masked, for logs and
+// /stats.
+func redactedQuery(r *http.Request) url.Values {
+    q := r.URL.Query()
+    for _, name := range tokenParams {
+        if q.Has(name) {
+            q.Set(name, "REDACTED")
+        }
+    }
+    return q
+}
+
+// bearerToken extracts the token from an Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+    const prefix = "Bearer "
+    h := r.Header.Get("Authorization")
+    if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+        return "", false
+    }
+    return strings.TrimSpace(h[len(prefix):]), true
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "strings"
+    "testing"
+)
+
+func TestChainRunsMiddlewaresInOrder(t *testing.T) {
+    var calls []string
+    mark := func(name string) MiddlewareFunc {
+        return func(next http.Handler) http.Handler {
+            return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                calls = append(calls, name)
+                next.ServeHTTP(w, r)
+            })
+        }
+    }
+    inner := 0
+    h := Chain(mark("a"), mark("b"), mark("c"))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+        inner++
+        calls = append(calls, "handler")
+    }))
+    h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+    if want := []string{"a", "b", "c", "handler"}; !slices.Equal(calls, want) {
+        t.Errorf("calls = %v, want %v", calls, want)
+    }
+    if inner != 1 {
+        t.Errorf("handler called %d times, want 1", inner)
+    }
+}
+
+func TestEmptyChainIsIdentity(t *testing.T) {
+    called := false
+    h := Chain()(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { called = true }))
+    h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+    if !called {
+        t.Error("empty chain did not reach the handler")
+    }
+}
+
+// logLines decodes each JSON log line in buf.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+    t.Helper()
+    var recs []map[string]any
+    for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+        var rec map[string]any
+        if err := json.Unmarshal([]byte(line), &rec); err != nil {
+            t.Fatalf("log line %q: %v", line, err)
+        }
+        recs = append(recs, rec)
+    }
+    return recs
+}
+
+func TestLoggingMiddlewareLogsCompletedStream(t *testing.T) {
+    var buf bytes.Buffer
+    logger := slog.New(slog.NewJSONHandler(&buf, nil))
+    h := loggingMiddleware(logger)(http.HandlerFunc(streamHandler))
+    req := httptest.NewRequest(http.MethodGet, "/stream?intervalMs=1&limit=3", nil)
+    req.RemoteAddr = "192.0.2.1:4000"
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+
+    var done []map[string]any
+    for _, rec := range logLines(t, &buf) {
+        switch rec["msg"] {
+        case "disconnect":
+            done = append(done, rec)
+        case "connect":
+        default:
+            t.Errorf("unexpected log line %v", rec)
+        }
+    }
+    if len(done) != 1 {
+        t.Fatalf("got %d disconnect lines, want 1:\n%s", len(done), buf.String())
+    }
+    rec := done[0]
+    if rec["method"] != "GET" || rec["path"] != "/stream" || rec["remote_addr"] != "192.0.2.1:4000" || rec["status"] != float64(200) {
+        t.Errorf("disconnect line %v", rec)
+    }
+    if rec["bytes"] != float64(rr.Body.Len()) {
+        t.Errorf("bytes = %v, want %d", rec["bytes"], rr.Body.Len())
+    }
+    if ms, ok := rec["latency_ms"].(float64); !ok || ms <= 0 {
+        t.Errorf("latency_ms = %v", rec["latency_ms"])
+    }
+}
+
+func TestLoggingMiddlewareOneLinePerRequest(t *testing.T) {
+    var buf bytes.Buffer
+    h := loggingMiddleware(slog.New(slog.NewJSONHandler(&buf, nil)))(http.NotFoundHandler())
+    h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/nope", nil))
+    recs := logLines(t, &buf)
+    if len(recs) != 1 || recs[0]["msg"] != "request" || recs[0]["status"] != float64(404) || recs[0]["method"] != "POST" {
+        t.Errorf("log lines %v, want one request line with status 404", recs)
+    }
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+    t.Setenv("DISABLE_ACCESS_LOG", "true")
+    var buf bytes.Buffer
+    h := loggingMiddleware(slog.New(slog.NewJSONHandler(&buf, nil)))(http.NotFoundHandler())
+    h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+    if buf.Len() != 0 {
+        t.Errorf("logged with DISABLE_ACCESS_LOG=true: %s", buf.String())
+    }
+}
+
+func TestBearerAuth(t *testing.T) {
+    h := bearerAuthMiddleware(authTokens, nil)(http.HandlerFunc(streamHandler))
+    tests := []struct {
+        name, env, header string
+        want              int
+    }{
+        {"no header", "s3cret", "", http.StatusUnauthorized},
+        {"wrong token", "s3cret", "Bearer nope", http.StatusUnauthorized},
+        {"not bearer", "s3cret", "Basic s3cret", http.StatusUnauthorized},
+        {"correct token", "s3cret", "Bearer s3cret", http.StatusOK},
+        {"auth off", "", "", http.StatusOK},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            t.Setenv("AUTH_TOKEN", tt.env)
+            req := httptest.NewRequest(http.MethodGet, "/stream?intervalMs=1&limit=1", nil)
+            if tt.header != "" {
+                req.Header.Set("Authorization", tt.header)
+            }
+            rr := httptest.NewRecorder()
+            h.ServeHTTP(rr, req)
+            if rr.Code != tt.want {
+                t.Fatalf("status %d, want %d", rr.Code, tt.want)
+            }
+            ct := rr.Header().Get("Content-Type")
+            if tt.want == http.StatusUnauthorized {
+                if rr.Header().Get("WWW-Authenticate") != "Bearer" || strings.HasPrefix(ct, "text/event-stream") {
+                    t.Errorf("401 headers %v", rr.Header())
+                }
+            } else if !strings.HasPrefix(ct, "text/event-stream") {
+                t.Errorf("Content-Type %q, want a stream", ct)
+            }
+        })
+    }
+}
+
+// corsHeaders returns the response headers for a method request from
+// origin ("" for none) through a CORS middleware built from cfg.
+func corsHeaders(cfg CORSConfig, method, origin string) (int, http.Header) {
+    h := newCORSMiddleware(cfg)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+    r := httptest.NewRequest(method, "/stream", nil)
+    if origin != "" {
+        r.Header.Set("Origin", origin)
+    }
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, r)
+    return rr.Code, rr.Header()
+}
+
+func TestCORSAllowlist(t *testing.T) {
+    cfg := CORSConfig{AllowOrigins: splitList("https://a.example, https://b.example")}
+    tests := []struct {
+        origin, want string
+    }{
+        {"https://a.example", "https://a.example"},
+        {"https://b.example", "https://b.example"},
+        {"https://evil.example", ""},
+        {"http://a.example", ""},
+        {"", ""},
+    }
+    for _, tt := range tests {
+        _, h := corsHeaders(cfg, http.MethodGet, tt.origin)
+        if got := h.Get("Access-Control-Allow-Origin"); got != tt.want {
+            t.Errorf("origin %q: Access-Control-Allow-Origin %q, want %q", tt.origin, got, tt.want)
+        }
+        if h.Get("Vary") != "Origin" {
+            t.Errorf("origin %q: Vary %q, want Origin", tt.origin, h.Get("Vary"))
+        }
+    }
+}
+
+func TestCORSWildcard(t *testing.T) {
+    cfg := CORSConfig{AllowOrigins: []string{"*"}}
+    for _, origin := range []string{"https://a.example", "http://localhost:3000", ""} {
+        _, h := corsHeaders(cfg, http.MethodGet, origin)
+        if got := h.Get("Access-Control-Allow-Origin"); got != "*" {
+            t.Errorf("origin %q: Access-Control-Allow-Origin %q, want *", origin, got)
+        }
+    }
+}
+
+func TestCORSPreflight(t *testing.T) {
+    cfg := CORSConfig{AllowOrigins: []string{"https://a.example"}, AllowHeaders: []string{"Last-Event-ID"}, MaxAgeSec: 600}
+    code, h := corsHeaders(cfg, http.MethodOptions, "https://a.example")
+    if code != http.StatusNoContent || h.Get("Access-Control-Allow-Methods") == "" ||
+        h.Get("Access-Control-Allow-Headers") != "Last-Event-ID" || h.Get("Access-Control-Max-Age") != "600" {
+        t.Errorf("allowed preflight: status %d, headers %v", code, h)
+    }
+    code, h = corsHeaders(cfg, http.MethodOptions, "https://evil.example")
+    if code != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "" || h.Get("Access-Control-Allow-Methods") != "" {
+        t.Errorf("refused preflight: status %d, headers %v", code, h)
+    }
+}
+
+func TestCORSCredentials(t *testing.T) {
+    cfg := CORSConfig{AllowOrigins: []string{"https://a.example", "https://b.example"}, AllowCredentials: true}
+    for _, origin := range cfg.AllowOrigins {
+        _, h := corsHeaders(cfg, http.MethodGet, origin)
+        if h.Get("Access-Control-Allow-Origin") != origin || h.Get("Access-Control-Allow-Credentials") != "true" {
+            t.Errorf("origin %s: headers %v, want the origin echoed with credentials", origin, h)
+        }
+    }
+    _, h := corsHeaders(cfg, http.MethodGet, "https://c.example")
+    if h.Get("Access-Control-Allow-Origin") != "" || h.Get("Access-Control-Allow-Credentials") != "" {
+        t.Errorf("unlisted origin got CORS headers %v", h)
+    }
+
+    // Without credentials the header is left off.
+    cfg.AllowCredentials = false
+    _, h = corsHeaders(cfg, http.MethodGet, "https://a.example")
+    if h.Get("Access-Control-Allow-Credentials") != "" {
+        t.Errorf("Access-Control-Allow-Credentials set with credentials off")
+    }
+}
+
+func TestCORSConfigFromEnv(t *testing.T) {
+    t.Setenv("CORS_ALLOW_ORIGINS", "https://a.example, https://b.example")
+    t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+    t.Setenv("CORS_MAX_AGE_SEC", "300")
+    t.Setenv("CORS_ALLOW_HEADERS", "Authorization")
+    cfg := corsConfigFromEnv()
+    if !slices.Equal(cfg.AllowOrigins, []string{"https://a.example", "https://b.example"}) ||
+        !cfg.AllowCredentials || cfg.MaxAgeSec != 300 || !slices.Equal(cfg.AllowHeaders, []string{"Authorization"}) {
+        t.Errorf("corsConfigFromEnv() = %+v", cfg)
+    }
+}
+
+func TestAuthTokensHeaderAndQuery(t *testing.T) {
+    h := bearerAuthMiddleware(authTokens, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id, _ := identityFrom(r.Context())
+        _, _ = w.Write([]byte(id))
+    }))
+    tests := []struct {
+        name, tokens, query, header string
+        want                        int
+        identity                    string
+    }{
+        {"disabled by default", "", "", "", http.StatusOK, ""},
+        {"no credentials", "a,b", "", "", http.StatusUnauthorized, ""},
+        {"header, first token", "a,b", "", "Bearer a", http.StatusOK, "token:a"},
+        {"header, second token", "a, b", "", "Bearer b", http.StatusOK, "token:b"},
+        {"header, wrong token", "a,b", "", "Bearer c", http.StatusUnauthorized, ""},
+        {"query", "a,b", "access_token=b", "", http.StatusOK, "token:b"},
+        {"query, wrong token", "a,b", "access_token=c", "", http.StatusUnauthorized, ""},
+        {"query, empty", "a,b", "access_token=", "", http.StatusUnauthorized, ""},
+        {"header wins over query", "a,b", "access_token=a", "Bearer c", http.StatusUnauthorized, ""},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            t.Setenv("AUTH_TOKENS", tt.tokens)
+            r := httptest.NewRequest(http.MethodGet, "/stream?"+tt.query, nil)
+            if tt.header != "" {
+                r.Header.Set("Authorization", tt.header)
+            }
+            rr := httptest.NewRecorder()
+            h.ServeHTTP(rr, r)
+            if rr.Code != tt.want {
+                t.Fatalf("status %d, want %d", rr.Code, tt.want)
+            }
+            if tt.want == http.StatusOK && rr.Body.String() != tt.identity {
+                t.Errorf("identity %q, want %q", rr.Body.String(), tt.identity)
+            }
+            if tt.want == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+                t.Error("401 without WWW-Authenticate")
+            }
+        })
+    }
+}
+
+func TestAuthTokenParamAndJSONError(t *testing.T) {
+    t.Setenv("AUTH_TOKENS", "s3cret")
+    h := bearerAuthMiddleware(authTokens, nil)(http.HandlerFunc(streamHandler))
+    tests := []struct {
+        query string
+        want  int
+    }{
+        {"token=s3cret", http.StatusOK},
+        {"token=nope", http.StatusUnauthorized},
+        {"", http.StatusUnauthorized},
+        // access_token is looked at first.
+        {"access_token=nope&token=s3cret", http.StatusUnauthorized},
+    }
+    for _, tt := range tests {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stream?intervalMs=1&limit=1&"+tt.query, nil))
+        if rr.Code != tt.want {
+            t.Errorf("%q: status %d, want %d", tt.query, rr.Code, tt.want)
+            continue
+        }
+        ct := rr.Header().Get("Content-Type")
+        if tt.want == http.StatusOK {
+            if !strings.HasPrefix(ct, "text/event-stream") {
+                t.Errorf("%q: Content-Type %q, want a stream", tt.query, ct)
+            }
+            continue
+        }
+        if ct != "application/json" || rr.Body.String() != "{\"error\":\"unauthorized\"}\n" {
+            t.Errorf("%q: 401 as %q with body %q, want the JSON error", tt.query, ct, rr.Body)
+        }
+    }
+}
+
+func TestOriginMatching(t *testing.T) {
+    l := newOriginList(splitList("https://app.example.com, https://*.example.com, http://*.dev.test:8080"))
+    tests := []struct {
+        origin string
+        want   bool
+    }{
+        {"https://app.example.com", true},
+        {"https://a.example.com", true},
+        {"https://a.b.example.com", true},
+        {"https://A.Example.COM", true},
+        {"https://example.com", false}, // the wildcard needs a subdomain
+        {"https://badexample.com", false},
+        {"https://a.example.com.evil.test", false},
+        {"http://a.example.com", false},       // scheme differs
+        {"https://a.example.com:8443", false}, // port differs
+        {"http://x.dev.test:8080", true},
+        {"http://x.dev.test", false},
+        {"http://x.dev.test:9090", false},
+        {"https://x.dev.test:8080", false},
+        {"https://a.example.com/path", false},
+        {"https://user@a.example.com", false},
+        {"null", false},
+        {"", false},
+    }
+    for _, tt := range tests {
+        allow, ok := l.allowOrigin(tt.origin)
+        if ok != tt.want || (ok && allow != tt.origin) {
+            t.Errorf("allowOrigin(%q) = %q, %v; want allowed %v", tt.origin, allow, ok, tt.want)
+        }
+    }
+}
+
+func TestCORSSameOnPreflightAndStream(t *testing.T) {
+    cfg := CORSConfig{AllowOrigins: []string{"https://*.example.com"}}
+    for _, origin := range []string{"https://a.example.com", "https://evil.test"} {
+        _, pre := corsHeaders(cfg, http.MethodOptions, origin)
+        _, get := corsHeaders(cfg, http.MethodGet, origin)
+        if pre.Get("Access-Control-Allow-Origin") != get.Get("Access-Control-Allow-Origin") || pre.Get("Vary") != "Origin" || get.Get("Vary") != "Origin" {
+            t.Errorf("origin %s: preflight %v, stream %v", origin, pre, get)
+        }
+    }
+}
+
+func TestCORSCredentialsWithAllowlist(t *testing.T) {
+    cfg := CORSConfig{AllowOrigins: []string{"https://dash.example.com", "https://*.preview.example.com"}, AllowCredentials: true}
+    if err := cfg.Validate(); err != nil {
+        t.Fatalf("Validate() = %v for an allowlist", err)
+    }
+    for _, tt := range []struct {
+        method, origin string
+        allowed        bool
+    }{
+        {http.MethodGet, "https://dash.example.com", true},
+        {http.MethodOptions, "https://dash.example.com", true},
+        {http.MethodGet, "https://pr-7.preview.example.com", true},
+        {http.MethodOptions, "https://pr-7.preview.example.com", true},
+        {http.MethodGet, "https://evil.example.com", false},
+        {http.MethodOptions, "https://evil.example.com", false},
+    } {
+        _, h := corsHeaders(cfg, tt.method, tt.origin)
+        allow, creds := h.Get("Access-Control-Allow-Origin"), h.Get("Access-Control-Allow-Credentials")
+        if tt.allowed && (allow != tt.origin || creds != "true") {
+            t.Errorf("%s from %s: origin %q, credentials %q; want the origin echoed with credentials", tt.method, tt.origin, allow, creds)
+        }
+        if !tt.allowed && (allow != "" || creds != "") {
+            t.Errorf("%s from %s: origin %q, credentials %q; want neither", tt.method, tt.origin, allow, creds)
+        }
+    }
+}
+
+func TestCORSCredentialsRejectWildcard(t *testing.T) {
+    t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+    for _, origins := range []string{"", "*", "https://a.example, *"} {
+        t.Setenv("CORS_ALLOW_ORIGINS", origins)
+        err := corsConfigFromEnv().Validate()
+        if err == nil || !strings.Contains(err.Error(), "CORS_ALLOW_CREDENTIALS") {
+            t.Errorf("CORS_ALLOW_ORIGINS=%q with credentials: Validate() = %v, want a startup error", origins, err)
+        }
+    }
+    t.Setenv("CORS_ALLOW_CREDENTIALS", "false")
+    if err := corsConfigFromEnv().Validate(); err != nil {
+        t.Errorf("wildcard without credentials: Validate() = %v", err)
+    }
+}
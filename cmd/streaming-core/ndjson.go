@@ -0,0 +1,107 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/Amarifields/streaming-core/streamingcore"
+)
+
+// ndjsonSink writes each event as one line of JSON and flushes it.
+type ndjsonSink struct {
+    w       http.ResponseWriter
+    metrics *metricsRegistry
+    rc      *http.ResponseController
+    timeout time.Duration
+}
+
+func newNDJSONSink(w http.ResponseWriter, m *metricsRegistry) (*ndjsonSink, bool) {
+    if !streamingcore.CanFlush(w) {
+        return nil, false
+    }
+    return &ndjsonSink{w: w, metrics: m, rc: http.NewResponseController(w), timeout: writeTimeout()}, true
+}
+
+// ndjsonLine is an event as written to NDJSON. An event with a numeric ID
+// carries it as seq, and leaves out the "number" event name and data that
+// only repeats the ID, so the plain counter is just {"seq":N}. Other
+// events keep their id, event and data fields.
+type ndjsonLine struct {
+    Seq   *int   `json:"seq,omitempty"`
+    ID    string `json:"id,omitempty"`
+    Event string `json:"event,omitempty"`
+    Data  string `json:"data,omitempty"`
+}
+
+func newNDJSONLine(e SSEEvent) ndjsonLine {
+    seq, err := strconv.Atoi(e.ID)
+    if err != nil {
+        return ndjsonLine{ID: e.ID, Event: e.Event, Data: e.Data}
+    }
+    line := ndjsonLine{Seq: &seq, Event: e.Event, Data: e.Data}
+    if line.Event == "number" {
+        line.Event = ""
+    }
+    if line.Data == e.ID {
+        line.Data = ""
+    }
+    return line
+}
+
+func (s *ndjsonSink) Write(e SSEEvent) error {
+    b, err := json.Marshal(newNDJSONLine(e))
+    if err != nil {
+        return err
+    }
+    if err := s.send(append(b, '\n')); err != nil {
+        return err
+    }
+    s.metrics.eventsSent.Inc()
+    return nil
+}
+
+// Keepalive writes a blank line, which NDJSON readers such as jq skip.
+func (s *ndjsonSink) Keepalive() error {
+    return s.send([]byte("\n"))
+}
+
+func (s *ndjsonSink) send(line []byte) error {
+    defer streamingcore.SetWriteDeadline(s.rc, s.timeout)()
+    n, err := s.w.Write(line)
+    if err == nil {
+        err = s.rc.Flush()
+    }
+    err = streamingcore.ClassifyWriteError(err)
+    s.metrics.recordWrite(n, err)
+    return err
+}
+
+// ndjsonHandler serves the /stream events as newline-delimited JSON for
+// consumers that do not speak SSE, one ndjsonLine per event. It backs
+// /stream.ndjson and /stream?mode=ndjson. There is no SSE id to resume
+// from, so Last-Event-ID is ignored; start picks where the numbers begin.
+func ndjsonHandler(w http.ResponseWriter, r *http.Request) {
+    sc, ok := beginStream(w, r, "ndjson", "")
+    if !ok {
+        return
+    }
+    defer sc.close()
+
+    sink, ok := newNDJSONSink(w, defaultMetrics)
+    if !ok {
+        http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/x-ndjson")
+    w.Header().Set("Cache-Control", "no-cache")
+
+    ctx, cancel := context.WithCancel(sc.ctx)
+    defer cancel()
+    if err := runStream(ctx, sc, sink, streamFeed(ctx, sc)); errors.Is(err, errShuttingDown) {
+        _ = sink.Write(shutdownEvent())
+    }
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestNDJSONCompactLines(t *testing.T) {
+    for _, tt := range []struct {
+        path    string
+        handler http.HandlerFunc
+    }{
+        {"/stream.ndjson?intervalMs=1&limit=3&start=5&send_eof=true", ndjsonHandler},
+        {"/stream?mode=ndjson&intervalMs=1&limit=3&start=5&send_eof=true", streamHandler},
+    } {
+        rr := httptest.NewRecorder()
+        req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+        // Last-Event-ID is ignored: the numbers begin at start.
+        req.Header.Set("Last-Event-ID", "100")
+        tt.handler(rr, req)
+
+        if ct := rr.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+            t.Errorf("%s: Content-Type = %q", tt.path, ct)
+        }
+        want := `{"seq":5}` + "\n" + `{"seq":6}` + "\n" + `{"seq":7}` + "\n" +
+            `{"event":"eof","data":"{\"reason\":\"limit_reached\",\"total\":3}"}` + "\n"
+        if got := rr.Body.String(); got != want {
+            t.Errorf("%s: body = %q, want %q", tt.path, got, want)
+        }
+    }
+}
+
+func TestNDJSONLine(t *testing.T) {
+    tests := []struct {
+        e    SSEEvent
+        want ndjsonLine
+    }{
+        {SSEEvent{ID: "3", Event: "number", Data: "3"}, ndjsonLine{Seq: ptr(3)}},
+        {SSEEvent{ID: "3", Event: "number", Data: `{"value":3}`}, ndjsonLine{Seq: ptr(3), Data: `{"value":3}`}},
+        {SSEEvent{ID: "0", Event: "tick", Data: "0"}, ndjsonLine{Seq: ptr(0), Event: "tick"}},
+        {SSEEvent{ID: "t4", Event: "order", Data: "x"}, ndjsonLine{ID: "t4", Event: "order", Data: "x"}},
+    }
+    for _, tt := range tests {
+        got := newNDJSONLine(tt.e)
+        if (got.Seq == nil) != (tt.want.Seq == nil) || got.Seq != nil && *got.Seq != *tt.want.Seq ||
+            got.ID != tt.want.ID || got.Event != tt.want.Event || got.Data != tt.want.Data {
+            t.Errorf("newNDJSONLine(%+v) = %+v, want %+v", tt.e, got, tt.want)
+        }
+    }
+}
+
+func ptr(n int) *int { return &n }
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "github.com/Amarifields/streaming-core/params"
+)
+
+// defaultPollWait is how long /poll waits for an event when waitMs is not
+// given.
+const defaultPollWait = 30 * time.Second
+
+// pollHandler is a long-polling fallback for clients whose proxies buffer
+// SSE. It returns the first published event after the `after` id as JSON,
+// waiting up to waitMs for one, or 204 if none arrives in time. It reads the
+// same broker and replay buffer as /stream and uses its IDs, marked with
+// topicIDPrefix, so clients may switch between the two using the last id
+// they saw.
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+    after := -1
+    if q := r.URL.Query().Get("after"); q != "" {
+        n, _, ok := parseEventID(q, false)
+        if !ok {
+            http.Error(w, "after must be an event id such as t7", http.StatusBadRequest)
+            return
+        }
+        after = n
+    }
+    wait, err := parseWait(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    broker, ok := topicBroker(w, r.PathValue("topic"))
+    if !ok {
+        return
+    }
+
+    var events <-chan SSEEvent
+    var missed []SSEEvent
+    if after >= 0 {
+        events, missed, _ = broker.Resume(after)
+    } else {
+        events = broker.Subscribe()
+    }
+    defer broker.Unsubscribe(events)
+
+    if len(missed) > 0 {
+        writePollEvent(w, missed[0])
+        return
+    }
+    timer := time.NewTimer(wait)
+    defer timer.Stop()
+    select {
+    case e, ok := <-events:
+        if !ok {
+            w.WriteHeader(http.StatusNoContent)
+            return
+        }
+        writePollEvent(w, e)
+    case <-timer.C:
+        w.WriteHeader(http.StatusNoContent)
+    case <-shutdownCtx.Done():
+        w.WriteHeader(http.StatusNoContent)
+    case <-r.Context().Done():
+    }
+}
+
+// maxPollWait is MAX_POLL_WAIT_MS, the longest /poll waits whatever waitMs
+// asks for. main sets it at startup.
+var maxPollWait = 60 * time.Second
+
+// parseWait reads waitMs, how long /poll waits for an event, capped by
+// MAX_POLL_WAIT_MS.
+func parseWait(r *http.Request) (time.Duration, error) {
+    ms, err := params.Int(r, "waitMs", int(defaultPollWait.Milliseconds()), 1)
+    if err != nil {
+        return 0, err
+    }
+    return time.Duration(min(ms, int(maxPollWait.Milliseconds()))) * time.Millisecond, nil
+}
+
+func writePollEvent(w http.ResponseWriter, e SSEEvent) {
+    if e.ID != "" {
+        e.ID = topicIDPrefix + e.ID
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-cache")
+    b, err := json.Marshal(e)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    n, err := w.Write(append(b, '\n'))
+    defaultMetrics.recordWrite(n, err)
+    if err == nil {
+        defaultMetrics.eventsSent.Inc()
+    }
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+// poll GETs path from srv and decodes the event it answers with, if any.
+func poll(t *testing.T, srv *httptest.Server, path string) (int, SSEEvent) {
+    t.Helper()
+    resp, err := http.Get(srv.URL + path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    var e SSEEvent
+    if resp.StatusCode == http.StatusOK {
+        if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return resp.StatusCode, e
+}
+
+func TestPollAndStreamShareIDs(t *testing.T) {
+    srv := newStreamServer(t)
+    topic := uniqueTopic("switch")
+    resp := openStream(t, srv, "/stream/"+topic+"?intervalMs=60000")
+    b, _ := topics.get(topic)
+    waitFor(t, "the subscriber", func() bool { return b.Subscribers() == 1 })
+    for _, data := range []string{"1", "2", "3"} {
+        if code := post(t, srv.URL+"/publish/"+topic, `{"event":"order","data":"`+data+`"}`); code != http.StatusAccepted {
+            t.Fatalf("publish: status %d", code)
+        }
+    }
+    got, err := scanSSE(resp.Body, 1)
+    if err != nil || len(got) != 1 || got[0].ID != "t1" {
+        t.Fatalf("streamed %+v, %v; want id t1", got, err)
+    }
+
+    // The stream's last ID picks up where it left off on /poll...
+    code, e := poll(t, srv, "/poll/"+topic+"?after="+got[0].ID)
+    if code != http.StatusOK || e.ID != "t2" || e.Data != "2" {
+        t.Fatalf("poll after t1: status %d, event %+v; want t2", code, e)
+    }
+    // ...and the poll's back on /stream, with or without the feed.
+    got = readSSE(t, srv, "/stream/"+topic+"?intervalMs=60000", http.Header{"Last-Event-ID": {e.ID}}, 1)
+    if got[0].ID != "t3" || got[0].Data != "3" {
+        t.Errorf("resumed stream with %+v, want t3", got[0])
+    }
+    got = readSSE(t, srv, "/stream/"+topic+"?numbers=false", http.Header{"Last-Event-ID": {e.ID}}, 1)
+    if got[0].ID != "3" || got[0].Data != "3" {
+        t.Errorf("resumed stream without the feed with %+v, want 3", got[0])
+    }
+    // The bare IDs of a stream without the feed work on /poll too.
+    if code, e := poll(t, srv, "/poll/"+topic+"?after=1"); code != http.StatusOK || e.ID != "t2" {
+        t.Errorf("poll after 1: status %d, event %+v; want t2", code, e)
+    }
+
+    if code, _ := poll(t, srv, "/poll/"+topic+"?after=order-1"); code != http.StatusBadRequest {
+        t.Errorf("poll after order-1: status %d, want 400", code)
+    }
+}
+
+func TestPollAfter(t *testing.T) {
+    srv := newStreamServer(t)
+    topic := uniqueTopic("after")
+    b, _ := topics.get(topic)
+    for _, data := range []string{"1", "2", "3"} {
+        b.Publish(SSEEvent{Event: "order", Data: data})
+    }
+    time.Sleep(20 * time.Millisecond)
+
+    for after, want := range map[string]string{"t0": "t1", "t1": "t2", "t2": "t3"} {
+        if code, e := poll(t, srv, "/poll/"+topic+"?waitMs=50&after="+after); code != http.StatusOK || e.ID != want {
+            t.Errorf("after=%s: status %d, event %+v; want %s", after, code, e, want)
+        }
+    }
+    // Past the latest event, and without after, it waits for the next one.
+    for _, q := range []string{"?waitMs=50&after=t3", "?waitMs=50"} {
+        if code, _ := poll(t, srv, "/poll/"+topic+q); code != http.StatusNoContent {
+            t.Errorf("%s with nothing new: status %d, want 204", q, code)
+        }
+    }
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        b.Publish(SSEEvent{Event: "order", Data: "4"})
+    }()
+    if code, e := poll(t, srv, "/poll/"+topic+"?waitMs=2000&after=t3"); code != http.StatusOK || e.ID != "t4" {
+        t.Errorf("after=t3 while publishing: status %d, event %+v; want t4", code, e)
+    }
+}
+
+func TestPollTimesOutEmpty(t *testing.T) {
+    srv := newStreamServer(t)
+    start := time.Now()
+    resp, err := http.Get(srv.URL + "/poll/" + uniqueTopic("quiet") + "?waitMs=100")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+    if resp.StatusCode != http.StatusNoContent || len(body) != 0 {
+        t.Errorf("status %d, body %q; want an empty 204", resp.StatusCode, body)
+    }
+    if d := time.Since(start); d < 100*time.Millisecond || d > time.Second {
+        t.Errorf("answered after %v, want about waitMs", d)
+    }
+}
+
+func TestPollWaitMs(t *testing.T) {
+    srv := newStreamServer(t)
+    for _, q := range []string{"abc", "0", "-5", "1.5"} {
+        if code, _ := poll(t, srv, "/poll?waitMs="+q); code != http.StatusBadRequest {
+            t.Errorf("waitMs=%s: status %d, want 400", q, code)
+        }
+    }
+
+    old := maxPollWait
+    maxPollWait = 50 * time.Millisecond
+    t.Cleanup(func() { maxPollWait = old })
+    start := time.Now()
+    if code, _ := poll(t, srv, "/poll?waitMs=60000"); code != http.StatusNoContent {
+        t.Errorf("waitMs above MAX_POLL_WAIT_MS: status %d, want 204", code)
+    }
+    if d := time.Since(start); d > time.Second {
+        t.Errorf("waited %v, want MAX_POLL_WAIT_MS", d)
+    }
+}
+
+func TestOnePublishWakesAllPollers(t *testing.T) {
+    const pollers = 20
+    srv := newStreamServer(t)
+    topic := uniqueTopic("wake")
+    b, _ := topics.get(topic)
+    type result struct {
+        code int
+        e    SSEEvent
+    }
+    results := make(chan result, pollers)
+    for range pollers {
+        go func() {
+            // poll cannot be used here: it may call t.Fatal.
+            var r result
+            resp, err := http.Get(srv.URL + "/poll/" + topic + "?waitMs=5000")
+            if err == nil {
+                r.code = resp.StatusCode
+                _ = json.NewDecoder(resp.Body).Decode(&r.e)
+                resp.Body.Close()
+            }
+            results <- r
+        }()
+    }
+    waitFor(t, "the pollers", func() bool { return b.Subscribers() == pollers })
+
+    b.Publish(SSEEvent{Event: "order", Data: "all"})
+    for range pollers {
+        if r := <-results; r.code != http.StatusOK || r.e.ID != "t1" || r.e.Data != "all" {
+            t.Errorf("poller got status %d, event %+v; want t1", r.code, r.e)
+        }
+    }
+}
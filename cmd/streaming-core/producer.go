@@ -0,0 +1,31 @@
+package main
+
+import (
+    "context"
+    "fmt"
+)
+
+// streamFeed returns the producer for sc's own events: the Source named by
+// the source param, or nil when numbers=false so only broker events are
+// delivered and the stream runs until the client leaves. The channel is
+// closed when the source returns; if it failed, the error is in
+// sc.sourceErr by then.
+func streamFeed(ctx context.Context, sc *streamConn) <-chan SSEEvent {
+    if !sc.opts.numbers {
+        return nil
+    }
+    return runSource(ctx, sources[sc.opts.source], sc.opts, &sc.sourceErr)
+}
+
+// runSource runs src in its own goroutine and returns its events. A failure
+// other than ctx ending is stored in *errp before the channel is closed.
+func runSource(ctx context.Context, src Source, opts streamOpts, errp *error) <-chan SSEEvent {
+    out := make(chan SSEEvent)
+    go func() {
+        defer close(out)
+        if err := src.Run(ctx, opts, out); err != nil && ctx.Err() == nil {
+            *errp = fmt.Errorf("%w: %w", errSourceFailed, err)
+        }
+    }()
+    return out
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// maxPublishBytes caps the size of a /publish request body.
+const maxPublishBytes = 1 << 20
+
+type publishRequest struct {
+    Topic string `json:"topic,omitempty"`
+    Event string `json:"event"`
+    Data  string `json:"data"`
+    ID    string `json:"id,omitempty"`
+}
+
+// publishHandler fans a JSON-encoded event out to every client of its topic,
+// taken from the path on /publish/{topic} and from the body on /publish.
+func publishHandler(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var req publishRequest
+    dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBytes))
+    if err := dec.Decode(&req); err != nil {
+        http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    if strings.ContainsAny(req.Event, "\r\n") || strings.ContainsAny(req.ID, "\r\n") {
+        http.Error(w, "event and id must not contain line breaks", http.StatusBadRequest)
+        return
+    }
+    if req.Data == "" {
+        http.Error(w, "data must not be empty", http.StatusBadRequest)
+        return
+    }
+    if topic := r.PathValue("topic"); topic != "" {
+        req.Topic = topic
+    }
+    if claims, ok := claimsFrom(r.Context()); ok && !claims.allowsTopic(req.Topic) {
+        http.Error(w, "forbidden", http.StatusForbidden)
+        return
+    }
+    broker, ok := topicBroker(w, req.Topic)
+    if !ok {
+        return
+    }
+    if requireSubscribers() && broker.Subscribers() == 0 {
+        http.Error(w, "no subscribers", http.StatusNotFound)
+        return
+    }
+
+    broker.Publish(SSEEvent{ID: req.ID, Event: req.Event, Data: req.Data})
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// requireSubscribers reports whether publishing to a topic nobody is
+// subscribed to fails with 404 (PUBLISH_REQUIRE_SUBSCRIBERS) instead of
+// only filling its replay buffer.
+func requireSubscribers() bool {
+    require, _ := strconv.ParseBool(getEnv("PUBLISH_REQUIRE_SUBSCRIBERS", "false"))
+    return require
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+)
+
+func post(t *testing.T, url, body string) int {
+    t.Helper()
+    resp, err := http.Post(url, "application/json", strings.NewReader(body))
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp.Body.Close()
+    return resp.StatusCode
+}
+
+func TestPublishFansOutToStreams(t *testing.T) {
+    srv := newStreamServer(t)
+    topic := uniqueTopic("fanout")
+    if code := post(t, srv.URL+"/publish/"+topic, `{"event":"order","data":"nobody listening"}`); code != http.StatusAccepted {
+        t.Fatalf("publish without subscribers: status %d, want 202", code)
+    }
+
+    var streams []*http.Response
+    for i := 0; i < 3; i++ {
+        streams = append(streams, openStream(t, srv, "/stream/"+topic+"?numbers=false"))
+    }
+    b, _ := topics.get(topic)
+    waitFor(t, "3 subscribers", func() bool { return b.Subscribers() == 3 })
+    for i := 1; i <= 3; i++ {
+        body := fmt.Sprintf(`{"topic":%q,"event":"order","data":"o%d"}`, topic, i)
+        if code := post(t, srv.URL+"/publish", body); code != http.StatusAccepted {
+            t.Fatalf("publish %d: status %d", i, code)
+        }
+    }
+    for s, resp := range streams {
+        got, err := scanSSE(resp.Body, 3)
+        if err != nil || len(got) != 3 {
+            t.Fatalf("stream %d: %d events, %v", s, len(got), err)
+        }
+        for i, e := range got {
+            // The first event, published before anyone subscribed, is 1.
+            if want := fmt.Sprint(i + 2); e.ID != want || e.Event != "order" || e.Data != fmt.Sprintf("o%d", i+1) {
+                t.Errorf("stream %d event %d = %+v", s, i, e)
+            }
+        }
+    }
+}
+
+func TestConcurrentPublishes(t *testing.T) {
+    srv := newStreamServer(t)
+    topic := uniqueTopic("concurrent")
+    resp := openStream(t, srv, "/stream/"+topic+"?numbers=false")
+    b, _ := topics.get(topic)
+    waitFor(t, "subscriber", func() bool { return b.Subscribers() == 1 })
+
+    // Stay within the subscriber buffer while nothing reads the stream.
+    var wg sync.WaitGroup
+    for p := 0; p < 4; p++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for i := 0; i < 3; i++ {
+                rr := httptest.NewRecorder()
+                req := httptest.NewRequest(http.MethodPost, "/publish/"+topic, strings.NewReader(fmt.Sprintf(`{"data":"%d-%d"}`, p, i)))
+                req.SetPathValue("topic", topic)
+                publishHandler(rr, req)
+            }
+        }()
+    }
+    wg.Wait()
+    got, _ := scanSSE(resp.Body, 12)
+    seen := make(map[string]bool)
+    for i, e := range got {
+        if e.ID != fmt.Sprint(i+1) {
+            t.Errorf("event %d has id %s", i, e.ID)
+        }
+        seen[e.Data] = true
+    }
+    if len(seen) != 12 {
+        t.Fatalf("got %d distinct events, want 12", len(seen))
+    }
+}
+
+func TestPublishRejectsBadRequests(t *testing.T) {
+    for _, tt := range []struct {
+        method, body string
+        want         int
+    }{
+        {http.MethodGet, "", http.StatusMethodNotAllowed},
+        {http.MethodPost, `{"data":`, http.StatusBadRequest},
+        {http.MethodPost, `{"event":"order"}`, http.StatusBadRequest},
+        {http.MethodPost, `{"event":"order","data":""}`, http.StatusBadRequest},
+        {http.MethodPost, `{"event":"a\nb","data":"x"}`, http.StatusBadRequest},
+        {http.MethodPost, `{"topic":"bad topic!","data":"x"}`, http.StatusBadRequest},
+    } {
+        rr := httptest.NewRecorder()
+        publishHandler(rr, httptest.NewRequest(tt.method, "/publish", strings.NewReader(tt.body)))
+        if rr.Code != tt.want {
+            t.Errorf("%s %q: status %d, want %d", tt.method, tt.body, rr.Code, tt.want)
+        }
+    }
+}
+
+func TestPublishAPIKeyAndStatuses(t *testing.T) {
+    t.Setenv("PUBLISH_API_KEY", "k1")
+    h := apiKeyMiddleware(func() string { return getEnv("PUBLISH_API_KEY", "") })(http.HandlerFunc(publishHandler))
+    topic := uniqueTopic("statuses")
+    send := func(key, body string) int {
+        req := httptest.NewRequest(http.MethodPost, "/publish/"+topic, strings.NewReader(body))
+        req.SetPathValue("topic", topic)
+        if key != "" {
+            req.Header.Set("X-API-Key", key)
+        }
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, req)
+        return rr.Code
+    }
+
+    tests := []struct {
+        name, key, body string
+        require         string
+        want            int
+    }{
+        {"no key", "", `{"data":"x"}`, "false", http.StatusUnauthorized},
+        {"wrong key", "k2", `{"data":"x"}`, "false", http.StatusUnauthorized},
+        {"accepted", "k1", `{"event":"e","data":"x"}`, "false", http.StatusAccepted},
+        {"malformed JSON", "k1", `{"data":`, "false", http.StatusBadRequest},
+        {"no subscribers", "k1", `{"data":"x"}`, "true", http.StatusNotFound},
+    }
+    for _, tt := range tests {
+        t.Setenv("PUBLISH_REQUIRE_SUBSCRIBERS", tt.require)
+        if got := send(tt.key, tt.body); got != tt.want {
+            t.Errorf("%s: status %d, want %d", tt.name, got, tt.want)
+        }
+    }
+
+    // With a subscriber the same publish is accepted.
+    b, _ := topics.get(topic)
+    ch := b.Subscribe()
+    defer b.Unsubscribe(ch)
+    if got := send("k1", `{"data":"y"}`); got != http.StatusAccepted {
+        t.Errorf("with a subscriber: status %d, want 202", got)
+    }
+}
+
+func TestPublishUnknownTopicWithoutAutoCreate(t *testing.T) {
+    saved := topics
+    defer func() { topics = saved }()
+    topics = newTopicRegistry(testBrokerConfig(), false, "known")
+    for topic, want := range map[string]int{"known": http.StatusAccepted, "unknown": http.StatusNotFound} {
+        req := httptest.NewRequest(http.MethodPost, "/publish/"+topic, strings.NewReader(`{"data":"x"}`))
+        req.SetPathValue("topic", topic)
+        rr := httptest.NewRecorder()
+        publishHandler(rr, req)
+        if rr.Code != want {
+            t.Errorf("%s: status %d, want %d", topic, rr.Code, want)
+        }
+    }
+}
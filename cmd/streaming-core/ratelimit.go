@@ -0,0 +1,238 @@
+package main
+
+import (
+    "encoding/json"
+    "math"
+    "net"
+    "net/http"
+    "net/netip"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// trustProxy is TRUST_PROXY, whether clientIP honours X-Forwarded-For. main
+// sets it at startup.
+var trustProxy bool
+
+// clientIP returns the address a request came from, without port and in
+// canonical form, so "[::FFFF:10.0.0.1]:443" and "10.0.0.1" count as one
+// client. X-Forwarded-For is only honoured when trustProxy is set, and then
+// only its last entry, the one the proxy appended: clients can set the
+// header freely, so anything to its left is theirs.
+func clientIP(r *http.Request) string {
+    if trustProxy {
+        if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+            entries := strings.Split(xff[len(xff)-1], ",")
+            if ip, ok := parseIP(strings.TrimSpace(entries[len(entries)-1])); ok {
+                return ip
+            }
+        }
+    }
+    if ip, ok := parseIP(r.RemoteAddr); ok {
+        return ip
+    }
+    return r.RemoteAddr
+}
+
+// parseIP canonicalises an address with or without a port. IPv4-mapped
+// IPv6 addresses become plain IPv4 and zones are dropped.
+func parseIP(s string) (string, bool) {
+    if host, _, err := net.SplitHostPort(s); err == nil {
+        s = host
+    }
+    addr, err := netip.ParseAddr(s)
+    if err != nil {
+        return "", false
+    }
+    return addr.Unmap().WithZone("").String(), true
+}
+
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// rateLimiter is a token bucket per key that refills at rate tokens per
+// second up to burst.
+type rateLimiter struct {
+    mu      sync.Mutex
+    rate    float64
+    burst   float64
+    buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+    return &rateLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token for key and reports the whole tokens left. When none
+// is left it reports how long until one is available.
+func (l *rateLimiter) allow(key string, now time.Time) (ok bool, remaining int, wait time.Duration) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &tokenBucket{tokens: l.burst, last: now}
+        l.buckets[key] = b
+    }
+    b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+    b.last = now
+    if b.tokens >= 1 {
+        b.tokens--
+        return true, int(b.tokens), 0
+    }
+    return false, 0, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune drops buckets that have refilled completely; they behave exactly
+// like a fresh bucket.
+func (l *rateLimiter) prune(now time.Time) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for key, b := range l.buckets {
+        if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+            delete(l.buckets, key)
+        }
+    }
+}
+
+// pruneEvery prunes the limiter periodically so one-off clients do not
+// accumulate: a bucket is dropped once it has been idle long enough to
+// refill.
+func (l *rateLimiter) pruneEvery(d time.Duration) {
+    go func() {
+        for now := range time.Tick(d) {
+            l.prune(now)
+        }
+    }()
+}
+
+// rateLimit rejects requests from a client IP beyond RATE_LIMIT_RPS with
+// bursts of up to RATE_LIMIT_BURST. It is a no-op when RATE_LIMIT_RPS is
+// unset or not positive.
+func rateLimit(next http.Handler) http.Handler {
+    rate, _ := strconv.ParseFloat(getEnv("RATE_LIMIT_RPS", "0"), 64)
+    if rate <= 0 {
+        return next
+    }
+    burst, _ := strconv.ParseFloat(getEnv("RATE_LIMIT_BURST", "0"), 64)
+    if burst < 1 {
+        burst = math.Max(1, math.Ceil(rate))
+    }
+    limiter := newRateLimiter(rate, burst)
+    limiter.pruneEvery(time.Minute)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if ok, _, wait := limiter.allow(clientIP(r), time.Now()); !ok {
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+            http.Error(w, "too many requests", http.StatusTooManyRequests)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// publishRateLimit limits published events per verified caller (the
+// matching token, JWT subject or API key), or per client IP for
+// unauthenticated requests, to PUBLISH_RATE_LIMIT_EPS events per
+// second with bursts of PUBLISH_RATE_LIMIT_BURST. Every response carries
+// X-RateLimit-Limit and X-RateLimit-Remaining; rejected ones get 429 with
+// Retry-After, X-RateLimit-Reset and a JSON error body. It is a no-op when
+// PUBLISH_RATE_LIMIT_EPS is unset or not positive.
+func publishRateLimit() MiddlewareFunc {
+    rate, _ := strconv.ParseFloat(getEnv("PUBLISH_RATE_LIMIT_EPS", "0"), 64)
+    if rate <= 0 {
+        return func(next http.Handler) http.Handler { return next }
+    }
+    burst, _ := strconv.ParseFloat(getEnv("PUBLISH_RATE_LIMIT_BURST", "0"), 64)
+    if burst < 1 {
+        burst = math.Max(1, math.Ceil(rate))
+    }
+    limiter := newRateLimiter(rate, burst)
+    limiter.pruneEvery(time.Minute)
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            // An unverified token must not pick the bucket, or every new
+            // made-up token would start with a full one.
+            key, ok := identityFrom(r.Context())
+            if !ok {
+                key = "ip:" + clientIP(r)
+            }
+            ok, remaining, wait := limiter.allow(key, time.Now())
+            w.Header().Set("X-RateLimit-Limit", strconv.Itoa(int(burst)))
+            w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+            if !ok {
+                retryAfter := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+                w.Header().Set("Retry-After", retryAfter)
+                w.Header().Set("X-RateLimit-Reset", retryAfter)
+                w.Header().Set("Content-Type", "application/json")
+                w.WriteHeader(http.StatusTooManyRequests)
+                _ = json.NewEncoder(w).Encode(map[string]any{
+                    "error":          "rate limit exceeded",
+                    "retry_after_ms": wait.Milliseconds(),
+                })
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// ipConns counts open streams per client IP.
+type ipConns struct {
+    mu     sync.Mutex
+    active map[string]int
+}
+
+// streamsPerIP tracks every stream, whether or not a per-IP limit is set,
+// so /stats can report it.
+var streamsPerIP = &ipConns{active: make(map[string]int)}
+
+// acquire counts a stream from ip unless max (when positive) is reached.
+func (c *ipConns) acquire(ip string, max int) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if max > 0 && c.active[ip] >= max {
+        return false
+    }
+    c.active[ip]++
+    return true
+}
+
+// release uncounts a stream; addresses with none left are forgotten.
+func (c *ipConns) release(ip string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.active[ip]--; c.active[ip] <= 0 {
+        delete(c.active, ip)
+    }
+}
+
+func (c *ipConns) snapshot() map[string]int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    out := make(map[string]int, len(c.active))
+    for ip, n := range c.active {
+        out[ip] = n
+    }
+    return out
+}
+
+// rateLimitMiddleware caps how many requests each client IP may have in
+// flight at once, which for streaming endpoints is the number of open
+// streams. Requests beyond maxConn get 429. A maxConn of 0 or less disables
+// the cap but still counts streams for /stats.
+func rateLimitMiddleware(maxConn int) MiddlewareFunc {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            ip := clientIP(r)
+            if !streamsPerIP.acquire(ip, maxConn) {
+                http.Error(w, "too many connections from this address", http.StatusTooManyRequests)
+                return
+            }
+            defer streamsPerIP.release(ip)
+            next.ServeHTTP(w, r)
+        })
+    }
+}
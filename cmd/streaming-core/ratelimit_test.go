@@ -0,0 +1,236 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "sync"
+    "testing"
+    "time"
+)
+
+func publishStatuses(t *testing.T, h http.Handler, reqs ...*http.Request) []int {
+    t.Helper()
+    var codes []int
+    for _, r := range reqs {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, r)
+        codes = append(codes, rr.Code)
+    }
+    return codes
+}
+
+func newPublishRequest(auth, apiKey string) *http.Request {
+    r := httptest.NewRequest(http.MethodPost, "/publish", nil)
+    r.RemoteAddr = "192.0.2.1:1234"
+    if auth != "" {
+        r.Header.Set("Authorization", "Bearer "+auth)
+    }
+    if apiKey != "" {
+        r.Header.Set("X-API-Key", apiKey)
+    }
+    return r
+}
+
+func TestPublishRateLimitIgnoresUnverifiedTokens(t *testing.T) {
+    t.Setenv("PUBLISH_RATE_LIMIT_EPS", "1")
+    t.Setenv("PUBLISH_RATE_LIMIT_BURST", "1")
+    ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) })
+    h := Chain(bearerAuthMiddleware(func() []string { return nil }, nil), publishRateLimit())(ok)
+
+    got := publishStatuses(t, h, newPublishRequest("r1", ""), newPublishRequest("r2", ""), newPublishRequest("r3", ""))
+    want := []int{http.StatusAccepted, http.StatusTooManyRequests, http.StatusTooManyRequests}
+    if !slices.Equal(got, want) {
+        t.Fatalf("made-up tokens: statuses %v, want %v", got, want)
+    }
+}
+
+func TestPublishRateLimitPerVerifiedCaller(t *testing.T) {
+    t.Setenv("PUBLISH_RATE_LIMIT_EPS", "1")
+    t.Setenv("PUBLISH_RATE_LIMIT_BURST", "1")
+    ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) })
+    tokens := func() []string { return []string{"a", "b"} }
+    h := Chain(bearerAuthMiddleware(tokens, nil), publishRateLimit())(ok)
+
+    got := publishStatuses(t, h, newPublishRequest("a", ""), newPublishRequest("b", ""), newPublishRequest("a", ""))
+    want := []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests}
+    if !slices.Equal(got, want) {
+        t.Fatalf("statuses %v, want %v", got, want)
+    }
+}
+
+func TestPublishRateLimitPerAPIKey(t *testing.T) {
+    t.Setenv("PUBLISH_RATE_LIMIT_EPS", "1")
+    t.Setenv("PUBLISH_RATE_LIMIT_BURST", "1")
+    ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) })
+    h := Chain(apiKeyMiddleware(func() string { return "k" }), publishRateLimit())(ok)
+    // The unauthenticated request uses the IP bucket, so the API key still
+    // has its own.
+    got := publishStatuses(t, h, newPublishRequest("", "k"), newPublishRequest("", "k"))
+    want := []int{http.StatusAccepted, http.StatusTooManyRequests}
+    if !slices.Equal(got, want) {
+        t.Fatalf("statuses %v, want %v", got, want)
+    }
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+    l := newRateLimiter(2, 2)
+    now := time.Unix(0, 0)
+    for i := 0; i < 2; i++ {
+        if ok, _, _ := l.allow("k", now); !ok {
+            t.Fatalf("request %d rejected within burst", i)
+        }
+    }
+    ok, _, wait := l.allow("k", now)
+    if ok || wait != 500*time.Millisecond {
+        t.Fatalf("over burst: ok=%v wait=%v, want rejected with 500ms wait", ok, wait)
+    }
+    if ok, _, _ := l.allow("k", now.Add(500*time.Millisecond)); !ok {
+        t.Fatal("not refilled after 500ms")
+    }
+    if ok, _, _ := l.allow("other", now); !ok {
+        t.Fatal("keys share a bucket")
+    }
+}
+
+func TestClientIP(t *testing.T) {
+    tests := []struct {
+        name   string
+        trust  bool
+        remote string
+        xff    []string
+        want   string
+    }{
+        {"remote addr", false, "192.0.2.1:1234", nil, "192.0.2.1"},
+        {"mapped IPv6", false, "[::ffff:192.0.2.1]:443", nil, "192.0.2.1"},
+        {"XFF ignored without trust", false, "192.0.2.1:1234", []string{"198.51.100.7"}, "192.0.2.1"},
+        {"proxy entry", true, "10.0.0.1:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+        {"spoofed entries skipped", true, "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+        {"last header wins", true, "10.0.0.1:1234", []string{"203.0.113.9", "198.51.100.7"}, "198.51.100.7"},
+        {"bad entry", true, "10.0.0.1:1234", []string{"198.51.100.7, junk"}, "10.0.0.1"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            old := trustProxy
+            trustProxy = tt.trust
+            t.Cleanup(func() { trustProxy = old })
+            r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+            r.RemoteAddr = tt.remote
+            for _, v := range tt.xff {
+                r.Header.Add("X-Forwarded-For", v)
+            }
+            if got := clientIP(r); got != tt.want {
+                t.Errorf("clientIP = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestRateLimitMiddlewarePerIP(t *testing.T) {
+    release := make(chan struct{})
+    var wg sync.WaitGroup
+    defer wg.Wait()
+    defer close(release)
+    h := rateLimitMiddleware(10)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        <-release
+    }))
+    fromIP := func(ip string, port int) *http.Request {
+        r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+        r.RemoteAddr = fmt.Sprintf("%s:%d", ip, port)
+        return r
+    }
+
+    // Ten streams from one address, each from its own port.
+    for i := 0; i < 10; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            h.ServeHTTP(httptest.NewRecorder(), fromIP("198.51.100.7", 5000+i))
+        }()
+    }
+    waitFor(t, "10 open streams", func() bool { return streamsPerIP.snapshot()["198.51.100.7"] == 10 })
+
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, fromIP("198.51.100.7", 6000))
+    if rr.Code != http.StatusTooManyRequests {
+        t.Fatalf("11th stream: status %d, want 429", rr.Code)
+    }
+
+    // Another address is not affected.
+    wg.Add(1)
+    go func() {
+        defer wg.Done()
+        h.ServeHTTP(httptest.NewRecorder(), fromIP("198.51.100.8", 5000))
+    }()
+    waitFor(t, "a stream from another address", func() bool { return streamsPerIP.snapshot()["198.51.100.8"] == 1 })
+}
+
+func TestRateLimitMiddlewareReleasesOnReturn(t *testing.T) {
+    h := rateLimitMiddleware(1)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+    for i := 0; i < 3; i++ {
+        rr := httptest.NewRecorder()
+        r := httptest.NewRequest(http.MethodGet, "/stream", nil)
+        r.RemoteAddr = "198.51.100.9:5000"
+        h.ServeHTTP(rr, r)
+        if rr.Code != http.StatusOK {
+            t.Fatalf("request %d: status %d, want 200", i+1, rr.Code)
+        }
+    }
+    if n, ok := streamsPerIP.snapshot()["198.51.100.9"]; ok {
+        t.Errorf("%d streams still counted after they returned", n)
+    }
+}
+
+func TestPublishRateLimitHeadersAndRecovery(t *testing.T) {
+    t.Setenv("PUBLISH_RATE_LIMIT_EPS", "20")
+    t.Setenv("PUBLISH_RATE_LIMIT_BURST", "2")
+    ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) })
+    h := publishRateLimit()(ok)
+    send := func() *httptest.ResponseRecorder {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, newPublishRequest("", ""))
+        return rr
+    }
+
+    for _, remaining := range []string{"1", "0"} {
+        rr := send()
+        if rr.Code != http.StatusAccepted || rr.Header().Get("X-RateLimit-Limit") != "2" || rr.Header().Get("X-RateLimit-Remaining") != remaining {
+            t.Fatalf("within burst: %d, headers %v; want 202 with %s remaining", rr.Code, rr.Header(), remaining)
+        }
+    }
+    rr := send()
+    if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "1" || rr.Header().Get("X-RateLimit-Reset") != "1" {
+        t.Fatalf("over the limit: %d, headers %v; want 429 with Retry-After 1", rr.Code, rr.Header())
+    }
+    var body struct {
+        Error        string `json:"error"`
+        RetryAfterMs int64  `json:"retry_after_ms"`
+    }
+    if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error != "rate limit exceeded" || body.RetryAfterMs <= 0 || body.RetryAfterMs > 50 {
+        t.Errorf("429 body %s: %+v, %v", rr.Body, body, err)
+    }
+
+    // A token comes back every 50ms.
+    time.Sleep(60 * time.Millisecond)
+    if rr := send(); rr.Code != http.StatusAccepted {
+        t.Errorf("after the window: status %d, want 202", rr.Code)
+    }
+}
+
+func TestRateLimiterPrunesFullBuckets(t *testing.T) {
+    l := newRateLimiter(1, 2)
+    now := time.Unix(0, 0)
+    l.allow("once", now)
+    l.allow("busy", now)
+    l.allow("busy", now)
+    // After a second "once" is full again, "busy" is not.
+    l.prune(now.Add(time.Second))
+    if _, ok := l.buckets["once"]; ok {
+        t.Error("refilled bucket kept")
+    }
+    if _, ok := l.buckets["busy"]; !ok {
+        t.Error("partly used bucket dropped")
+    }
+}
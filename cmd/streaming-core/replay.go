@@ -0,0 +1,76 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// parseReplayEvents decodes the events query param: comma-separated JSON
+// SSEEvent objects, e.g. {"event":"a","data":"1"},{"data":"2"}.
+func parseReplayEvents(r *http.Request) ([]SSEEvent, error) {
+    q := r.URL.Query().Get("events")
+    if strings.TrimSpace(q) == "" {
+        return nil, fmt.Errorf("events is required")
+    }
+    var events []SSEEvent
+    if err := json.Unmarshal([]byte("["+q+"]"), &events); err != nil {
+        return nil, fmt.Errorf("invalid events: %v", err)
+    }
+    for i, e := range events {
+        if strings.ContainsAny(e.Event, "\r\n") || strings.ContainsAny(e.ID, "\r\n") {
+            return nil, fmt.Errorf("invalid events: event %d has a line break in its event or id", i)
+        }
+    }
+    return events, nil
+}
+
+// replayHandler serves /stream/replay: a finite, canned SSE stream for
+// testing clients. It sends the given events one per interval and then ends
+// the response. Nothing else, broadcasts included, is mixed in. Like every
+// stream it holds a connection slot and shows up in /stats and
+// /admin/connections while it runs.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+    events, err := parseReplayEvents(r)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    sc, ok := beginStream(w, r, "sse", "")
+    if !ok {
+        return
+    }
+    defer sc.close()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    sw, ok := newSSEWriter(w, defaultMetrics)
+    if !ok {
+        http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+        return
+    }
+    sc.err = replayEvents(sc, countingSink{eventSink: sw, conn: sc}, events)
+}
+
+// replayEvents writes events to sink one per sc.opts.interval and returns
+// why it stopped, as runStream does.
+func replayEvents(sc *streamConn, sink eventSink, events []SSEEvent) error {
+    ticker := time.NewTicker(sc.opts.interval)
+    defer ticker.Stop()
+    for _, e := range events {
+        select {
+        case <-sc.ctx.Done():
+            return sc.ctx.Err()
+        case <-shutdownCtx.Done():
+            _ = sink.Write(shutdownEvent())
+            return errShuttingDown
+        case <-ticker.C:
+            if err := sink.Write(e); err != nil {
+                return err
+            }
+        }
+    }
+    return errStreamComplete
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "testing"
+    "time"
+)
+
+func TestReplayStreamIsTracked(t *testing.T) {
+    srv := newStreamServer(t)
+    events := url.QueryEscape(`{"event":"a","data":"1"},{"id":"7","data":"2"},{"data":"3"}`)
+    path := "/stream/replay?intervalMs=50&events=" + events
+
+    done := make(chan []SSEEvent)
+    go func() { done <- readSSE(t, srv, path, nil, 3) }()
+    deadline := time.Now().Add(2 * time.Second)
+    for openStreams.count() == 0 && time.Now().Before(deadline) {
+        time.Sleep(5 * time.Millisecond)
+    }
+    conns := openStreams.snapshot()
+    if len(conns) != 1 || conns[0].path != "/stream/replay" {
+        t.Fatalf("open streams during replay = %d, want the replay", len(conns))
+    }
+    got := <-done
+    if got[0].Event != "a" || got[0].Data != "1" || got[1].ID != "7" || got[2].Data != "3" {
+        t.Errorf("replayed %+v", got)
+    }
+    for openStreams.count() != 0 && time.Now().Before(deadline) {
+        time.Sleep(5 * time.Millisecond)
+    }
+    if n := openStreams.count(); n != 0 {
+        t.Fatalf("open streams after replay = %d, want 0", n)
+    }
+    if conns[0].sent.Load() != 3 || closeReason(conns[0].err) != "complete" {
+        t.Errorf("replay sent %d events, ended %q; want 3, complete", conns[0].sent.Load(), closeReason(conns[0].err))
+    }
+}
+
+func TestReplayRejectsBadEvents(t *testing.T) {
+    for _, q := range []string{"", "events=", "events=" + url.QueryEscape(`{"data":`), "events=" + url.QueryEscape(`{"event":"a\nb"}`)} {
+        rr := httptest.NewRecorder()
+        replayHandler(rr, httptest.NewRequest(http.MethodGet, "/stream/replay?"+q, nil))
+        if rr.Code != http.StatusBadRequest {
+            t.Errorf("%q: status %d, want 400", q, rr.Code)
+        }
+    }
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "io"
+    "log/slog"
+    "math"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "syscall"
+    "testing"
+    "time"
+)
+
+// isolateShutdown gives the test its own shutdown signal and stream
+// tracker, so shutting down does not end every later test's streams.
+func isolateShutdown(t *testing.T) {
+    t.Helper()
+    oldCtx, oldBegin, oldTracker, oldReady := shutdownCtx, beginShutdown, streamTracker, ready.Load()
+    shutdownCtx, beginShutdown = context.WithCancel(context.Background())
+    streamTracker = &ConnectionTracker{}
+    t.Cleanup(func() {
+        beginShutdown()
+        shutdownCtx, beginShutdown, streamTracker = oldCtx, oldBegin, oldTracker
+        ready.Store(oldReady)
+    })
+}
+
+// startServer serves h like main does, on a free local port.
+func startServer(t *testing.T, h http.Handler) (*http.Server, string) {
+    t.Helper()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv := withServer(l.Addr().String(), h)
+    go srv.Serve(l)
+    t.Cleanup(func() { srv.Close() })
+    return srv, "http://" + l.Addr().String()
+}
+
+// drainBody reads resp's body to the end in the background.
+func drainBody(resp *http.Response) <-chan string {
+    body := make(chan string, 1)
+    go func() {
+        b, err := io.ReadAll(resp.Body)
+        if err != nil {
+            b = append(b, "\nread error: "+err.Error()...)
+        }
+        body <- string(b)
+    }()
+    return body
+}
+
+func TestShutdownClosesStreamsCleanly(t *testing.T) {
+    isolateShutdown(t)
+    srv, url := startServer(t, streamTracker.Middleware(http.HandlerFunc(streamHandler)))
+    resp, err := http.Get(url + "/stream?intervalMs=60000")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    body := drainBody(resp)
+
+    started := time.Now()
+    if err := shutdown(srv, 2*time.Second, slog.Default()); !errors.Is(err, http.ErrServerClosed) {
+        t.Fatalf("shutdown() = %v, want http.ErrServerClosed", err)
+    }
+    // The stream ended on its own rather than at the deadline.
+    if d := time.Since(started); d > time.Second {
+        t.Errorf("shutdown took %v", d)
+    }
+    select {
+    case got := <-body:
+        if strings.Contains(got, "read error") || !strings.Contains(got, "event: shutdown\n") {
+            t.Errorf("stream ended with %q, want the shutdown event and a clean EOF", got)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("stream still open after shutdown")
+    }
+    if _, err := http.Get(url + "/stream"); err == nil {
+        t.Error("server still accepting requests after shutdown")
+    }
+}
+
+func TestShutdownEventIsLast(t *testing.T) {
+    isolateShutdown(t)
+    t.Setenv("SHUTDOWN_RETRY_MS", "1500")
+    mux := http.NewServeMux()
+    mux.HandleFunc("/stream", streamHandler)
+    mux.HandleFunc("/stream.ndjson", ndjsonHandler)
+    _, url := startServer(t, mux)
+
+    sse, err := http.Get(url + "/stream?intervalMs=5")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sse.Body.Close()
+    ndjson, err := http.Get(url + "/stream.ndjson?intervalMs=5")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ndjson.Body.Close()
+    sseBody, ndjsonBody := drainBody(sse), drainBody(ndjson)
+    waitFor(t, "both streams sending", func() bool {
+        for _, c := range openStreams.snapshot() {
+            if c.sent.Load() < 3 {
+                return false
+            }
+        }
+        return openStreams.count() == 2
+    })
+    beginShutdown()
+
+    body := <-sseBody
+    events, err := scanSSE(strings.NewReader(body), 1<<20)
+    if err != nil || len(events) < 4 {
+        t.Fatalf("SSE stream: %d events, %v", len(events), err)
+    }
+    last := events[len(events)-1]
+    if last.Event != "shutdown" || last.Data != `{"reason":"server shutting down","reconnectMs":1500}` {
+        t.Errorf("last SSE event %+v, want shutdown", last)
+    }
+    records := strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n")
+    if record := records[len(records)-1]; !strings.HasSuffix(record, "\nretry: 1500") {
+        t.Errorf("shutdown record %q has no retry field", record)
+    }
+
+    lines := strings.Split(strings.TrimSpace(<-ndjsonBody), "\n")
+    if got := lines[len(lines)-1]; !strings.Contains(got, `"event":"shutdown"`) {
+        t.Errorf("last NDJSON line %s, want the shutdown event", got)
+    }
+}
+
+func TestShutdownTimeoutClosesHungStreams(t *testing.T) {
+    isolateShutdown(t)
+    returned := make(chan struct{})
+    // A handler that ignores shutdown and only stops when its connection
+    // is cut.
+    hung := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        defer close(returned)
+        w.WriteHeader(http.StatusOK)
+        http.NewResponseController(w).Flush()
+        <-r.Context().Done()
+    })
+    srv, url := startServer(t, streamTracker.Middleware(hung))
+    resp, err := http.Get(url)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    body := drainBody(resp)
+
+    buf := captureLog(t)
+    start := time.Now()
+    if err := shutdown(srv, 200*time.Millisecond, slog.Default()); !errors.Is(err, http.ErrServerClosed) {
+        t.Fatalf("shutdown() = %v", err)
+    }
+    // Drain and Shutdown each wait out the deadline, which they share.
+    if d := time.Since(start); d < 200*time.Millisecond || d > time.Second {
+        t.Errorf("shutdown took %v with a 200ms timeout", d)
+    }
+    select {
+    case <-returned:
+    case <-time.After(2 * time.Second):
+        t.Fatal("hung handler still running after shutdown")
+    }
+    if got := <-body; !strings.Contains(got, "read error") {
+        t.Errorf("client read %q, want its connection cut", got)
+    }
+    if rec := logRecord(t, buf, "shutdown incomplete; closing remaining connections"); rec["level"] != "WARN" {
+        t.Errorf("forced close logged as %v", rec)
+    }
+    logRecord(t, buf, "streams still open at shutdown deadline")
+}
+
+func TestShutdownTimeoutFromEnv(t *testing.T) {
+    if d, err := shutdownTimeout(); err != nil || d != 5*time.Second {
+        t.Errorf("default: %v, %v; want 5s", d, err)
+    }
+    t.Setenv("SHUTDOWN_TIMEOUT_MS", "250")
+    if d, err := shutdownTimeout(); err != nil || d != 250*time.Millisecond {
+        t.Errorf("250: %v, %v", d, err)
+    }
+    for _, bad := range []string{"0", "-1", "soon"} {
+        t.Setenv("SHUTDOWN_TIMEOUT_MS", bad)
+        if _, err := shutdownTimeout(); err == nil {
+            t.Errorf("SHUTDOWN_TIMEOUT_MS=%s: no error", bad)
+        }
+    }
+}
+
+func TestSIGQUITDumpsGoroutinesAndKeepsServing(t *testing.T) {
+    isolateShutdown(t)
+    dump := filepath.Join(t.TempDir(), "dump.txt")
+    sock := socketPath(t)
+    t.Setenv("DEBUG_DUMP_FILE", dump)
+    t.Setenv("LISTEN_TCP", "false")
+    t.Setenv("LISTEN_UNIX", sock)
+    srv := withServer("", http.HandlerFunc(healthHandler))
+    served := make(chan error, 1)
+    go func() { served <- gracefulServeTLS(srv, "", "", slog.Default()) }()
+    waitFor(t, "server ready", ready.Load)
+
+    size := func() int64 {
+        fi, err := os.Stat(dump)
+        if err != nil {
+            return 0
+        }
+        return fi.Size()
+    }
+    for i := 1; i <= 2; i++ {
+        before := size()
+        if err := syscall.Kill(os.Getpid(), syscall.SIGQUIT); err != nil {
+            t.Fatal(err)
+        }
+        waitFor(t, "the dump file to grow", func() bool { return size() > before })
+    }
+    b, err := os.ReadFile(dump)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n := strings.Count(string(b), "=== goroutine dump at "); n != 2 {
+        t.Errorf("%d dumps in the file, want 2", n)
+    }
+    if !strings.Contains(string(b), "TestSIGQUITDumpsGoroutinesAndKeepsServing") {
+        t.Error("dump does not include this test's goroutine")
+    }
+
+    // Still serving.
+    client := &http.Client{Transport: &http.Transport{
+        DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+            var d net.Dialer
+            return d.DialContext(ctx, "unix", sock)
+        },
+    }}
+    t.Cleanup(client.CloseIdleConnections)
+    resp, err := client.Get("http://unix/health")
+    if err != nil {
+        t.Fatalf("after SIGQUIT: %v", err)
+    }
+    resp.Body.Close()
+
+    if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case err := <-served:
+        if !errors.Is(err, http.ErrServerClosed) {
+            t.Errorf("gracefulServeTLS() = %v after SIGTERM", err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("server still running after SIGTERM")
+    }
+}
+
+func TestBatchedEventsFlushedAtShutdown(t *testing.T) {
+    isolateShutdown(t)
+    t.Setenv("DISABLE_COMPRESSION", "true")
+    srv, url := startServer(t, streamTracker.Middleware(http.HandlerFunc(streamHandler)))
+    // The first event of the burst is flushed; with batchMs this long
+    // the other two wait in the writer's buffer.
+    resp, err := http.Get(url + "/stream?intervalMs=60000&burst=3&batchMs=60000")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    body := drainBody(resp)
+
+    if err := shutdown(srv, 2*time.Second, slog.Default()); !errors.Is(err, http.ErrServerClosed) {
+        t.Fatalf("shutdown() = %v", err)
+    }
+    events, err := scanSSE(strings.NewReader(<-body), math.MaxInt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var got []string
+    for _, e := range events {
+        got = append(got, e.ID+e.Event)
+    }
+    if want := []string{"0number", "1number", "2number", "shutdown"}; !slices.Equal(got, want) {
+        t.Errorf("events %v, want %v", got, want)
+    }
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand"
+    "strconv"
+    "time"
+)
+
+// Source produces a stream's own events, which runStream interleaves with
+// the events published to its topic. Run sends events on out until the
+// source is exhausted, returning nil so the stream completes, until ctx is
+// done, returning ctx.Err(), or until it fails. A failure ends the stream
+// with an error event.
+type Source interface {
+    Run(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error
+}
+
+// optsChecker is implemented by sources with params of their own.
+// parseStreamOpts calls checkOpts so a bad value is rejected with 400
+// instead of failing the stream.
+type optsChecker interface {
+    checkOpts(opts streamOpts) error
+}
+
+// formatSource is implemented by sources whose events take their own values
+// of the format param in place of number and json. formats returns the
+// accepted values and the one used when the param is absent.
+type formatSource interface {
+    formats() (accepted map[string]bool, def string)
+}
+
+// eofSource is implemented by sources that complete by running out, such
+// as stdin. Their streams end with an eof event unless send_eof=false.
+type eofSource interface {
+    sendsEOF() bool
+}
+
+// SourceFunc adapts a func to a Source.
+type SourceFunc func(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error
+
+func (f SourceFunc) Run(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error {
+    return f(ctx, opts, out)
+}
+
+// sources maps the accepted values of the source query param to their
+// Source. Sources needing configuration are added by main with
+// registerSource.
+var sources = map[string]Source{
+    "counter": numberSource{values: func(opts streamOpts) dataSource {
+        return &counterSource{next: opts.first, step: opts.step}
+    }},
+    "randomwalk": numberSource{values: func(opts streamOpts) dataSource {
+        return newRandomWalkSource(opts.first, rand.New(rand.NewSource(time.Now().UnixNano())))
+    }},
+    "clock":     clockSource{},
+    "synthetic": syntheticSource{},
+    // time is the original name of clock.
+    "time": clockSource{},
+}
+
+// defaultSource is the source of streams without a source param, set by
+// main from --source or STREAM_SOURCE.
+var defaultSource = "counter"
+
+// registerSource makes src selectable as ?source=name. It must be called
+// before the server starts.
+func registerSource(name string, src Source) {
+    if _, dup := sources[name]; dup {
+        panic("source registered twice: " + name)
+    }
+    sources[name] = src
+}
+
+// errSourceFailed wraps the error a Source failed with.
+var errSourceFailed = errors.New("source failed")
+
+// emitEvent sends e on out unless ctx is done first.
+func emitEvent(ctx context.Context, out chan<- SSEEvent, e SSEEvent) error {
+    select {
+    case out <- e:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// relayBroker sends the events of b, a source's own broker, to out: those
+// published after opts.lastID and then live ones, or only live ones when not
+// resuming. It returns nil once limit events were sent or it reached an
+// event for which end returns true, which is not sent, ctx.Err() when ctx
+// is done and errSlowConsumer when b dropped it for falling behind.
+func relayBroker(ctx context.Context, b *Broker, opts streamOpts, out chan<- SSEEvent, end func(SSEEvent) bool) error {
+    var events <-chan SSEEvent
+    var missed []SSEEvent
+    if opts.lastID >= 0 {
+        events, missed, _ = b.Resume(opts.lastID)
+    } else {
+        events = b.Subscribe()
+    }
+    defer b.Unsubscribe(events)
+
+    sent := 0
+    send := func(e SSEEvent) (done bool, err error) {
+        if end != nil && end(e) {
+            return true, nil
+        }
+        if opts.event != "" {
+            e.Event = opts.event
+        }
+        if err := emitEvent(ctx, out, e); err != nil {
+            return true, err
+        }
+        sent++
+        return opts.limit > 0 && sent >= opts.limit, nil
+    }
+    for _, e := range missed {
+        if done, err := send(e); done {
+            return err
+        }
+    }
+    for {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case e, ok := <-events:
+            if !ok {
+                return errSlowConsumer
+            }
+            if done, err := send(e); done {
+                return err
+            }
+        }
+    }
+}
+
+// numberSource is the number feed: one event per interval with the
+// sequence number as ID, bounded by end and limit and thinned by modulo.
+// values supplies what each event carries.
+type numberSource struct {
+    values func(opts streamOpts) dataSource
+}
+
+func (s numberSource) Run(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error {
+    src := s.values(opts)
+    next := opts.first
+    err := generate(ctx, opts, func(seq int) error {
+        // Catch the source up on numbers skipped by modulo, so values are
+        // a sample of the full series.
+        for ; next < seq; next += opts.step {
+            src.Next()
+        }
+        next += opts.step
+        e, err := numberEvent(seq, src.Next(), opts)
+        if err != nil {
+            return fmt.Errorf("encode event: %w", err)
+        }
+        return emitEvent(ctx, out, e)
+    })
+    if errors.Is(err, errStreamComplete) {
+        return nil
+    }
+    return err
+}
+
+// clockFormats are the formats of clock events: Unix seconds, Unix
+// milliseconds and RFC 3339 with nanoseconds.
+var clockFormats = map[string]bool{"unix": true, "unix_ms": true, "rfc3339": true}
+
+// clockSource sends the server's current time as "time" events, paced and
+// numbered like the number feed so the same params and resuming apply.
+type clockSource struct{}
+
+func (clockSource) formats() (map[string]bool, string) {
+    return clockFormats, "rfc3339"
+}
+
+func (clockSource) Run(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error {
+    err := generate(ctx, opts, func(seq int) error {
+        e := SSEEvent{ID: strconv.Itoa(seq), Event: "time", Data: formatClock(time.Now(), opts.format)}
+        if opts.event != "" {
+            e.Event = opts.event
+        }
+        return emitEvent(ctx, out, e)
+    })
+    if errors.Is(err, errStreamComplete) {
+        return nil
+    }
+    return err
+}
+
+func formatClock(t time.Time, format string) string {
+    switch format {
+    case "unix":
+        return strconv.FormatInt(t.Unix(), 10)
+    case "unix_ms":
+        return strconv.FormatInt(t.UnixMilli(), 10)
+    default:
+        return t.UTC().Format(time.RFC3339Nano)
+    }
+}
+
+// dataSource produces the value carried by each number event. The event ID
+// stays the sequence number either way, so resuming works for every source.
+type dataSource interface {
+    Next() int
+}
+
+// counterSource counts up from the first number by step, matching the
+// sequence numbers.
+type counterSource struct {
+    next, step int
+}
+
+func (s *counterSource) Next() int {
+    v := s.next
+    s.next += s.step
+    return v
+}
+
+const (
+    randomWalkMin      = 0
+    randomWalkMax      = 100
+    randomWalkMaxDelta = 5
+)
+
+// randomWalkSource starts at the first number and moves by a random delta
+// in [-5,5] each step, staying within [0,100].
+type randomWalkSource struct {
+    value int
+    rng   *rand.Rand
+}
+
+func newRandomWalkSource(start int, rng *rand.Rand) *randomWalkSource {
+    return &randomWalkSource{value: clamp(start, randomWalkMin, randomWalkMax), rng: rng}
+}
+
+func (s *randomWalkSource) Next() int {
+    v := s.value
+    delta := s.rng.Intn(2*randomWalkMaxDelta+1) - randomWalkMaxDelta
+    s.value = clamp(s.value+delta, randomWalkMin, randomWalkMax)
+    return v
+}
+
+func clamp(v, lo, hi int) int {
+    return max(lo, min(v, hi))
+}
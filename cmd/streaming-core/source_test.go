@@ -0,0 +1,139 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "math"
+    "math/rand"
+    "net/http"
+    "net/http/httptest"
+    "slices"
+    "strconv"
+    "testing"
+    "time"
+)
+
+// useSource registers src as ?source=name for the test.
+func useSource(t *testing.T, name string, src Source) {
+    t.Helper()
+    registerSource(name, src)
+    t.Cleanup(func() { delete(sources, name) })
+}
+
+func TestSourceFailingMidStream(t *testing.T) {
+    buf := captureLog(t)
+    useSource(t, "flaky", SourceFunc(func(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error {
+        for i := 1; i <= 2; i++ {
+            if err := emitEvent(ctx, out, SSEEvent{ID: "f" + strconv.Itoa(i), Event: "reading", Data: "ok"}); err != nil {
+                return err
+            }
+        }
+        return errors.New("sensor unplugged")
+    }))
+    srv := httptest.NewServer(http.HandlerFunc(streamHandler))
+    t.Cleanup(srv.Close)
+
+    resp := openStream(t, srv, "/stream?source=flaky")
+    got, err := scanSSE(resp.Body, math.MaxInt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(got) != 3 || got[0].ID != "f1" || got[1].ID != "f2" {
+        t.Fatalf("events %+v, want f1, f2 and an error", got)
+    }
+    // The error event is the last one; no eof claims a clean end.
+    if e := got[2]; e.Event != "error" || e.Data != `{"error":"source failed"}` {
+        t.Errorf("last event %+v, want the source failed error", e)
+    }
+
+    rec := logRecord(t, buf, "stream source failed")
+    if rec["level"] != "ERROR" || rec["source"] != "flaky" || rec["error"] != "source failed: sensor unplugged" {
+        t.Errorf("source failure logged as %v", rec)
+    }
+    if rec := logRecord(t, buf, "stream closed"); rec["reason"] != "source_error" {
+        t.Errorf("stream closed with reason %v, want source_error", rec["reason"])
+    }
+}
+
+func TestRegisterSourceTwicePanics(t *testing.T) {
+    defer func() {
+        if recover() == nil {
+            t.Error("registering counter again did not panic")
+        }
+    }()
+    registerSource("counter", sources["counter"])
+}
+
+func TestRandomWalkSource(t *testing.T) {
+    for start, first := range map[int]int{50: 50, -10: randomWalkMin, 200: randomWalkMax} {
+        s := newRandomWalkSource(start, rand.New(rand.NewSource(1)))
+        prev := s.Next()
+        if prev != first {
+            t.Errorf("start %d: first value %d, want %d", start, prev, first)
+        }
+        for range 1000 {
+            v := s.Next()
+            if v < randomWalkMin || v > randomWalkMax {
+                t.Fatalf("start %d: value %d outside [%d,%d]", start, v, randomWalkMin, randomWalkMax)
+            }
+            if d := v - prev; d < -randomWalkMaxDelta || d > randomWalkMaxDelta {
+                t.Fatalf("start %d: step %d to %d, want at most %d", start, prev, v, randomWalkMaxDelta)
+            }
+            prev = v
+        }
+    }
+}
+
+func TestRandomWalkSourceSameSeed(t *testing.T) {
+    walk := func(seed int64) []int {
+        s := newRandomWalkSource(50, rand.New(rand.NewSource(seed)))
+        var values []int
+        for range 100 {
+            values = append(values, s.Next())
+        }
+        return values
+    }
+    if a, b := walk(7), walk(7); !slices.Equal(a, b) {
+        t.Errorf("seed 7 walked %v, then %v", a, b)
+    }
+    if a, b := walk(7), walk(8); slices.Equal(a, b) {
+        t.Errorf("seeds 7 and 8 both walked %v", a)
+    }
+}
+
+func TestClockFormats(t *testing.T) {
+    srv := newStreamServer(t)
+    for _, tt := range []struct {
+        format string
+        parse  func(string) (time.Time, error)
+    }{
+        {"", func(s string) (time.Time, error) { return time.Parse(time.RFC3339Nano, s) }},
+        {"rfc3339", func(s string) (time.Time, error) { return time.Parse(time.RFC3339Nano, s) }},
+        {"unix", func(s string) (time.Time, error) {
+            n, err := strconv.ParseInt(s, 10, 64)
+            return time.Unix(n, 0), err
+        }},
+        {"unix_ms", func(s string) (time.Time, error) {
+            n, err := strconv.ParseInt(s, 10, 64)
+            return time.UnixMilli(n), err
+        }},
+    } {
+        start := time.Now().Truncate(time.Second)
+        e := readSSE(t, srv, "/stream?source=clock&intervalMs=10&format="+tt.format, nil, 1)[0]
+        got, err := tt.parse(e.Data)
+        if e.Event != "time" || err != nil || got.Before(start) || got.After(time.Now()) {
+            t.Errorf("format %q: event %+v, want the current time", tt.format, e)
+        }
+    }
+
+    for _, format := range []string{"unixms", "number", "RFC3339"} {
+        resp, err := http.Get(srv.URL + "/stream?source=clock&format=" + format)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusBadRequest {
+            t.Errorf("format %q: status %d, want 400", format, resp.StatusCode)
+        }
+    }
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+    "math"
+    "math/rand"
+    "net/http"
+    "strconv"
+    "time"
+
+    "github.com/Amarifields/streaming-core/streamingcore"
+)
+
+// SSEEvent is a single Server-Sent Events message. Empty fields are omitted
+// from the wire; a zero Retry sends no retry field.
+type SSEEvent struct {
+    ID    string `json:"id,omitempty"`
+    Event string `json:"event,omitempty"`
+    Data  string `json:"data"`
+    Retry int    `json:"retry,omitempty"`
+}
+
+// core converts e to the library's event type.
+func (e SSEEvent) core() streamingcore.Event {
+    return streamingcore.Event{ID: e.ID, Name: e.Event, Data: e.Data, Retry: e.Retry}
+}
+
+// sseWriter is the server's streamingcore.Writer: it takes its write
+// timeout from the environment, refuses events over MAX_EVENT_BYTES and
+// records every write in the metrics.
+type sseWriter struct {
+    core    *streamingcore.Writer
+    metrics *metricsRegistry
+}
+
+// newSSEWriter returns false when nothing under w can flush, since events
+// would then sit in a buffer instead of reaching the client.
+func newSSEWriter(w http.ResponseWriter, m *metricsRegistry) (*sseWriter, bool) {
+    core, err := streamingcore.NewWriter(w)
+    if err != nil {
+        return nil, false
+    }
+    core.WriteTimeout = writeTimeout()
+    core.OnWrite = m.recordWrite
+    core.MaxEventBytes = maxEventBytes
+    return &sseWriter{core: core, metrics: m}, true
+}
+
+// Write sends e, flushes it and counts it as sent.
+func (w *sseWriter) Write(e SSEEvent) error {
+    if err := w.core.Write(e.core()); err != nil {
+        return err
+    }
+    w.metrics.eventsSent.Inc()
+    return nil
+}
+
+// writeTimeout is how long a single event may take to write and flush,
+// from WRITE_TIMEOUT_MS (alias WRITE_DEADLINE_MS). A blanket
+// http.Server.WriteTimeout would cut off every long-lived stream, so the
+// deadline is set per write instead.
+func writeTimeout() time.Duration {
+    ms, _ := strconv.Atoi(getEnv("WRITE_TIMEOUT_MS", getEnv("WRITE_DEADLINE_MS", "2000")))
+    if ms < 0 {
+        ms = 0
+    }
+    return time.Duration(ms) * time.Millisecond
+}
+
+// enableGzip compresses everything written from now on. It must be called
+// before the first write, while headers can still be set.
+func (w *sseWriter) enableGzip() {
+    w.core.EnableGzip()
+}
+
+// Flush sends the events held back by batchMs.
+func (w *sseWriter) Flush() error {
+    return w.core.Flush()
+}
+
+// Close sends any events held back and ends the gzip stream, if any.
+func (w *sseWriter) Close() error {
+    return w.core.Close()
+}
+
+// compressionEnabled reports whether /stream may gzip its responses. It
+// is on by default; DISABLE_COMPRESSION=true, or the older
+// ENABLE_GZIP=false, turns it off, e.g. behind a proxy that compresses or
+// buffers compressed bodies.
+func compressionEnabled() bool {
+    if disabled, _ := strconv.ParseBool(getEnv("DISABLE_COMPRESSION", "false")); disabled {
+        return false
+    }
+    enabled, err := strconv.ParseBool(getEnv("ENABLE_GZIP", "true"))
+    return enabled || err != nil
+}
+
+// writeRetry sends a retry-only record. It carries no event, so it is
+// not counted as sent.
+func (w *sseWriter) writeRetry(ms int) error {
+    return w.core.Write(SSEEvent{Retry: ms}.core())
+}
+
+// jitterRetry moves base ms randomly by up to jitterPct percent either way,
+// so clients dropped together, e.g. by a restart, do not all reconnect in
+// the same instant. The result is at least 1ms.
+func jitterRetry(base int, jitterPct float64) int {
+    if jitterPct <= 0 {
+        return base
+    }
+    spread := float64(base) * jitterPct / 100
+    ms := int(math.Round(float64(base) + (rand.Float64()*2-1)*spread))
+    return max(ms, 1)
+}
+
+// retryJitterPct is RETRY_JITTER_PCT, the jitter applied to the default
+// retry delay; 0 disables it. main sets it at startup.
+var retryJitterPct = 20.0
+
+// WriteComment sends a comment line, which clients ignore but which keeps
+// idle connections open through proxies.
+func (w *sseWriter) WriteComment(text string) error {
+    return w.core.WriteComment(text)
+}
+
+// Keepalive sends a ping comment.
+func (w *sseWriter) Keepalive() error {
+    return w.WriteComment("ping")
+}
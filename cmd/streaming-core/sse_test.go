@@ -0,0 +1,284 @@
+package main
+
+import (
+    "bufio"
+    "compress/gzip"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestSSEWriterMultilineData(t *testing.T) {
+    rr := httptest.NewRecorder()
+    sw, ok := newSSEWriter(rr, newMetricsRegistry())
+    if !ok {
+        t.Fatal("recorder cannot flush")
+    }
+    if err := sw.Write(SSEEvent{ID: "1", Event: "number", Data: "line one\nline two\nline three"}); err != nil {
+        t.Fatal(err)
+    }
+    want := "id: 1\nevent: number\ndata: line one\ndata: line two\ndata: line three\n\n"
+    if got := rr.Body.String(); got != want {
+        t.Fatalf("wire bytes = %q, want %q", got, want)
+    }
+}
+
+func TestSSEWriterMultilineJSONReassembles(t *testing.T) {
+    payloads := []string{
+        "{\n  \"seq\": 1,\n  \"tags\": [\"a\", \"b\"]\n}",
+        "trailing newline\n",
+        "crlf\r\nline",
+        "lone\rcr",
+        "",
+    }
+    want := []string{payloads[0], payloads[1], "crlf\nline", "lone\ncr", ""}
+
+    rr := httptest.NewRecorder()
+    sw, _ := newSSEWriter(rr, newMetricsRegistry())
+    for i, p := range payloads {
+        if err := sw.Write(SSEEvent{ID: strconv.Itoa(i), Data: p}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if strings.Contains(rr.Body.String(), "\r") {
+        t.Errorf("carriage return on the wire: %q", rr.Body.String())
+    }
+    got, err := scanSSE(rr.Body, len(payloads))
+    if err != nil || len(got) != len(payloads) {
+        t.Fatalf("parsed %d events (%v) from %q", len(got), err, rr.Body.String())
+    }
+    for i, e := range got {
+        if e.Data != want[i] {
+            t.Errorf("event %d reassembled as %q, want %q", i, e.Data, want[i])
+        }
+    }
+}
+
+// hideFlush wraps a response writer without passing Flush on, like a
+// third-party middleware.
+type hideFlush struct{ http.ResponseWriter }
+
+// unwrapHideFlush also hides Flush but exposes the writer it wraps.
+type unwrapHideFlush struct{ hideFlush }
+
+func (h unwrapHideFlush) Unwrap() http.ResponseWriter { return h.ResponseWriter }
+
+func TestStreamThroughNonFlushingMiddleware(t *testing.T) {
+    t.Setenv("DISABLE_COMPRESSION", "true")
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        streamHandler(unwrapHideFlush{hideFlush{w}}, r)
+    }))
+    t.Cleanup(srv.Close)
+
+    // The stream stays open after the burst, so the events only arrive if
+    // they were flushed through the wrapper.
+    resp := openStream(t, srv, "/stream?intervalMs=60000&burst=3")
+    events, err := scanSSE(resp.Body, 3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := eventIDs(events); strings.Join(got, ",") != "0,1,2" {
+        t.Errorf("event ids %v, want 0,1,2", got)
+    }
+}
+
+func TestStreamWithoutFlushIs500(t *testing.T) {
+    rr := httptest.NewRecorder()
+    streamHandler(hideFlush{rr}, httptest.NewRequest(http.MethodGet, "/stream", nil))
+    if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), "streaming unsupported") {
+        t.Fatalf("status %d, body %q; want 500 streaming unsupported", rr.Code, rr.Body)
+    }
+}
+
+// connListener hands out a single connection, then blocks until closed.
+type connListener struct {
+    conn   chan net.Conn
+    closed chan struct{}
+    once   sync.Once
+}
+
+func listenOn(c net.Conn) *connListener {
+    l := &connListener{conn: make(chan net.Conn, 1), closed: make(chan struct{})}
+    l.conn <- c
+    return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+    select {
+    case c := <-l.conn:
+        return c, nil
+    case <-l.closed:
+        return nil, net.ErrClosed
+    }
+}
+
+func (l *connListener) Close() error {
+    l.once.Do(func() { close(l.closed) })
+    return nil
+}
+
+func (l *connListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func TestWriteDeadlineOnStalledConnection(t *testing.T) {
+    t.Setenv("WRITE_TIMEOUT_MS", "100")
+    m := useMetrics(t)
+    // A pipe has no buffer: with nobody reading the client end, every
+    // write the server makes blocks, like a TCP connection whose window
+    // has filled up.
+    server, client := net.Pipe()
+    defer client.Close()
+    returned := make(chan time.Time, 1)
+    srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        streamHandler(w, r)
+        returned <- time.Now()
+    })}
+    l := listenOn(server)
+    go srv.Serve(l)
+    defer srv.Close()
+
+    if _, err := io.WriteString(client, "GET /stream?intervalMs=10 HTTP/1.1\r\nHost: x\r\n\r\n"); err != nil {
+        t.Fatal(err)
+    }
+    started := time.Now()
+    select {
+    case at := <-returned:
+        if d := at.Sub(started); d > time.Second {
+            t.Errorf("handler returned after %v, want about 100ms", d)
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatal("handler still blocked writing to a stalled connection")
+    }
+    if m.writeErrors.Value() == 0 {
+        t.Error("stalled write not counted as an error")
+    }
+}
+
+func TestStreamGzip(t *testing.T) {
+    srv := newStreamServer(t)
+    get := func(path string) *http.Response {
+        req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+        // Set by hand, the transport leaves the body compressed.
+        req.Header.Set("Accept-Encoding", "gzip")
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        t.Cleanup(func() { resp.Body.Close() })
+        return resp
+    }
+
+    // The burst arrives while the stream stays open, so the gzip writer is
+    // flushed after every event.
+    resp := get("/stream?intervalMs=60000&burst=2")
+    if resp.Header.Get("Content-Encoding") != "gzip" || resp.Header.Get("Vary") == "" {
+        t.Fatalf("headers %v, want gzip", resp.Header)
+    }
+    zr, err := gzip.NewReader(resp.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    events, err := scanSSE(zr, 2)
+    if err != nil || len(events) != 2 || events[0].Data != "0" || events[1].Data != "1" {
+        t.Fatalf("decompressed %+v, %v; want 0 and 1", events, err)
+    }
+
+    // A finished stream is a complete gzip member.
+    resp = get("/stream?intervalMs=1&limit=3&send_eof=true")
+    zr, err = gzip.NewReader(resp.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, err := io.ReadAll(zr)
+    if err != nil {
+        t.Fatalf("gzip stream not terminated cleanly: %v", err)
+    }
+    if events, _ := scanSSE(strings.NewReader(string(body)), 10); len(events) != 4 || events[3].Event != "eof" {
+        t.Errorf("decompressed %q", body)
+    }
+}
+
+func TestStreamCompressionDisabled(t *testing.T) {
+    t.Setenv("DISABLE_COMPRESSION", "true")
+    r := httptest.NewRequest(http.MethodGet, "/stream?intervalMs=1&limit=1", nil)
+    r.Header.Set("Accept-Encoding", "gzip")
+    rr := httptest.NewRecorder()
+    streamHandler(rr, r)
+    if rr.Header().Get("Content-Encoding") != "" || !strings.Contains(rr.Body.String(), "data: 0\n") {
+        t.Errorf("DISABLE_COMPRESSION=true: Content-Encoding %q, body %q", rr.Header().Get("Content-Encoding"), rr.Body)
+    }
+}
+
+func TestJitterRetryStaysInBand(t *testing.T) {
+    for i := 0; i < 1000; i++ {
+        if ms := jitterRetry(1000, 20); ms < 800 || ms > 1200 {
+            t.Fatalf("jitterRetry(1000, 20) = %d, outside 800-1200", ms)
+        }
+    }
+    if ms := jitterRetry(1, 100); ms < 1 {
+        t.Errorf("jitterRetry(1, 100) = %d, want at least 1", ms)
+    }
+    if ms := jitterRetry(1000, 0); ms != 1000 {
+        t.Errorf("jitterRetry(1000, 0) = %d, want 1000", ms)
+    }
+}
+
+// retryLines reads the stream at path until its first event and returns
+// the retry values sent before it.
+func retryLines(t *testing.T, srv *httptest.Server, path string) []int {
+    t.Helper()
+    resp := openStream(t, srv, path)
+    var retries []int
+    sc := bufio.NewScanner(resp.Body)
+    for sc.Scan() {
+        line := sc.Text()
+        if strings.HasPrefix(line, "data:") {
+            return retries
+        }
+        if v, ok := strings.CutPrefix(line, "retry: "); ok {
+            ms, err := strconv.Atoi(v)
+            if err != nil {
+                t.Fatalf("retry line %q", line)
+            }
+            retries = append(retries, ms)
+        }
+    }
+    t.Fatalf("stream ended before an event: %v", sc.Err())
+    return nil
+}
+
+// useRetryJitterPct sets RETRY_JITTER_PCT to pct for the test.
+func useRetryJitterPct(t *testing.T, pct float64) {
+    t.Helper()
+    old := retryJitterPct
+    retryJitterPct = pct
+    t.Cleanup(func() { retryJitterPct = old })
+}
+
+func TestStreamSendsJitteredRetryOnce(t *testing.T) {
+    t.Setenv("DISABLE_COMPRESSION", "true")
+    t.Setenv("RETRY_MS", "1000")
+    useRetryJitterPct(t, 20)
+    srv := newStreamServer(t)
+    seen := map[int]bool{}
+    for i := 0; i < 10; i++ {
+        retries := retryLines(t, srv, "/stream?intervalMs=60000&burst=1")
+        if len(retries) != 1 || retries[0] < 800 || retries[0] > 1200 {
+            t.Fatalf("retry lines %v, want one within 800-1200", retries)
+        }
+        seen[retries[0]] = true
+    }
+    if len(seen) == 1 {
+        t.Errorf("ten streams all got retry %v", seen)
+    }
+
+    // A retryMs the client chose is not jittered.
+    if retries := retryLines(t, srv, "/stream?intervalMs=60000&burst=1&retryMs=5000"); len(retries) != 1 || retries[0] != 5000 {
+        t.Errorf("retryMs=5000: retry lines %v, want [5000]", retries)
+    }
+}
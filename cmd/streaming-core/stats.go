@@ -0,0 +1,78 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "time"
+)
+
+var processStart = time.Now()
+
+type connStats struct {
+    ID         string     `json:"id"`
+    StreamID   string     `json:"stream_id"`
+    RemoteAddr string     `json:"remote_addr"`
+    ClientIP   string     `json:"client_ip"`
+    Subject    string     `json:"subject,omitempty"`
+    Path       string     `json:"path"`
+    Started    time.Time  `json:"started"`
+    EventsSent int64      `json:"events_sent"`
+    LastSeq    *int64     `json:"last_seq"`
+    Query      url.Values `json:"query"`
+}
+
+type stats struct {
+    UptimeSeconds float64 `json:"uptime_seconds"`
+    OpenStreams   int     `json:"open_streams"`
+    // MaxConnections is MAX_CONNECTIONS, 0 when unlimited, and
+    // SlotsInUse how many of them are taken.
+    MaxConnections int            `json:"max_connections"`
+    SlotsInUse     int            `json:"slots_in_use"`
+    StreamsPerIP   map[string]int `json:"streams_per_ip"`
+    Connections    []connStats    `json:"connections"`
+}
+
+// statsTokens returns the bearer tokens guarding /stats. The endpoint
+// exposes client addresses, so it is disabled unless STATS_TOKEN is set.
+func statsTokens() []string {
+    return splitList(getEnv("STATS_TOKEN", ""))
+}
+
+// statsHandler reports the open streams and process uptime as JSON. It is
+// mounted behind bearerAuthMiddleware(statsTokens).
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+    if len(statsTokens()) == 0 {
+        http.NotFound(w, r)
+        return
+    }
+    conns := openStreams.snapshot()
+    s := stats{
+        UptimeSeconds:  time.Since(processStart).Seconds(),
+        OpenStreams:    len(conns),
+        MaxConnections: cap(streamSlots),
+        SlotsInUse:     len(streamSlots),
+        StreamsPerIP:   streamsPerIP.snapshot(),
+        Connections:    make([]connStats, 0, len(conns)),
+    }
+    for _, c := range conns {
+        meta, _ := streamContextFrom(c.ctx)
+        cs := connStats{
+            ID:         c.id,
+            StreamID:   meta.StreamID,
+            RemoteAddr: c.remote,
+            ClientIP:   meta.ClientIP,
+            Subject:    meta.Subject,
+            Path:       c.path,
+            Started:    meta.StartedAt.UTC(),
+            EventsSent: c.sent.Load(),
+            Query:      c.query,
+        }
+        if seq := c.lastSeq.Load(); seq >= 0 {
+            cs.LastSeq = &seq
+        }
+        s.Connections = append(s.Connections, cs)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    _ = json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+// getStats fetches /stats with token.
+func getStats(t *testing.T, token string) (int, stats) {
+    t.Helper()
+    h := bearerAuthMiddleware(statsTokens, nil)(http.HandlerFunc(statsHandler))
+    r := httptest.NewRequest(http.MethodGet, "/stats", nil)
+    if token != "" {
+        r.Header.Set("Authorization", "Bearer "+token)
+    }
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, r)
+    var s stats
+    if rr.Code == http.StatusOK {
+        if err := json.Unmarshal(rr.Body.Bytes(), &s); err != nil {
+            t.Fatalf("decoding /stats: %v", err)
+        }
+    }
+    return rr.Code, s
+}
+
+func TestStatsListsOpenStreams(t *testing.T) {
+    t.Setenv("STATS_TOKEN", "st")
+    srv := newStreamServer(t)
+    // Each stream sends a burst at once, then waits a minute.
+    for _, s := range []struct {
+        path string
+        n    int
+    }{{"/stream?intervalMs=60000&burst=2", 2}, {"/stream?intervalMs=60000&burst=3&start=5", 3}} {
+        resp := openStream(t, srv, s.path)
+        if _, err := scanSSE(resp.Body, s.n); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    // The counters move just after each write reaches the client.
+    var s stats
+    got := map[int64]int64{} // last_seq -> events_sent
+    waitFor(t, "both streams in /stats", func() bool {
+        var code int
+        code, s = getStats(t, "st")
+        clear(got)
+        for _, c := range s.Connections {
+            if c.LastSeq != nil {
+                got[*c.LastSeq] = c.EventsSent
+            }
+        }
+        return code == http.StatusOK && len(got) == 2 && got[1] == 2 && got[7] == 3
+    })
+    if s.OpenStreams != 2 || len(s.Connections) != 2 {
+        t.Fatalf("open streams %d with %d connections, want 2", s.OpenStreams, len(s.Connections))
+    }
+    for _, c := range s.Connections {
+        if c.Path != "/stream" || c.RemoteAddr == "" || c.Started.IsZero() || c.Query.Get("intervalMs") != "60000" {
+            t.Errorf("connection %+v", c)
+        }
+    }
+    if s.UptimeSeconds <= 0 {
+        t.Errorf("uptime %v", s.UptimeSeconds)
+    }
+}
+
+func TestStatsGuardedByToken(t *testing.T) {
+    if code, _ := getStats(t, ""); code != http.StatusNotFound {
+        t.Errorf("without STATS_TOKEN: status %d, want 404", code)
+    }
+    t.Setenv("STATS_TOKEN", "st")
+    if code, _ := getStats(t, "wrong"); code != http.StatusUnauthorized {
+        t.Errorf("wrong token: status %d, want 401", code)
+    }
+}
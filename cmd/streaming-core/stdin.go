@@ -0,0 +1,94 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "io"
+    "log/slog"
+    "os"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+// stdinMaxLine is the longest stdin line sent; longer ones are cut.
+const stdinMaxLine = 64 << 10
+
+// stdinEOF names the marker that ends the relays once stdin is exhausted.
+const stdinEOF = "stdin-eof"
+
+// stdinSource streams the lines of the server's stdin as "line" events, for
+// running at the end of a pipeline: some-producer | streaming-core
+// --source=stdin. Lines are read as they come whether or not anyone is
+// connected, and kept for Last-Event-ID resume. Once stdin closes every
+// stream completes, ending with the usual "eof" event.
+type stdinSource struct {
+    lines *tailer
+    // eofSeq is the ID of the marker published when stdin is exhausted, 0
+    // until then.
+    eofSeq atomic.Int64
+    // active counts the streams relaying stdin.
+    active atomic.Int64
+}
+
+// newStdinSource starts reading r. With exitOnEOF the server shuts down
+// once r is exhausted and the open streams have completed.
+func newStdinSource(r io.Reader, cfg brokerConfig, exitOnEOF bool, logger *slog.Logger) *stdinSource {
+    s := &stdinSource{lines: &tailer{broker: newBroker(cfg), maxLine: stdinMaxLine, log: logger.With(slog.String("source", "stdin"))}}
+    go s.read(r, exitOnEOF)
+    return s
+}
+
+func (s *stdinSource) read(r io.Reader, exitOnEOF bool) {
+    t := s.lines
+    buf := make([]byte, 32<<10)
+    for {
+        n, err := r.Read(buf)
+        t.consume(buf[:n])
+        if err != nil {
+            if !errors.Is(err, io.EOF) {
+                t.log.Warn("stdin read failed; treating as end of input", slog.Any("error", err))
+            }
+            break
+        }
+    }
+    if len(t.partial) > 0 {
+        t.publishLine()
+    }
+    n := t.lines.Load()
+    // The marker ends the relays without being sent; runStream then sends
+    // eof. Only this goroutine publishes, so the broker numbers it n+1.
+    t.broker.Publish(SSEEvent{Event: stdinEOF})
+    s.eofSeq.Store(n + 1)
+    t.log.Info("stdin closed", slog.Int64("lines", n))
+    if !exitOnEOF {
+        return
+    }
+    // Give open streams a moment to complete before shutting down.
+    for deadline := time.Now().Add(5 * time.Second); s.active.Load() > 0 && time.Now().Before(deadline); {
+        time.Sleep(50 * time.Millisecond)
+    }
+    t.log.Info("exiting on end of stdin")
+    _ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+}
+
+// sendsEOF makes stdin streams end with eof by default: it is how clients
+// learn that stdin closed.
+func (s *stdinSource) sendsEOF() bool { return true }
+
+// Run relays stdin's lines until the end of stdin, which completes the
+// stream. A stream opened after stdin closed gets the lines after its
+// resume point, if any, and completes straight away.
+func (s *stdinSource) Run(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error {
+    s.active.Add(1)
+    defer s.active.Add(-1)
+    // Resume from the current line rather than subscribing, so the end
+    // marker published meanwhile is replayed instead of missed.
+    if opts.lastID < 0 {
+        opts.lastID = int(s.lines.lines.Load())
+    }
+    if eof := s.eofSeq.Load(); eof > 0 {
+        opts.lastID = min(opts.lastID, int(eof)-1)
+    }
+    return relayBroker(ctx, s.lines.broker, opts, out, func(e SSEEvent) bool { return e.Event == stdinEOF })
+}
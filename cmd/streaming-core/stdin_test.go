@@ -0,0 +1,37 @@
+package main
+
+import (
+    "io"
+    "log/slog"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestStdinStreamEndsWithOneEOF(t *testing.T) {
+    cfg := brokerConfig{history: 16, buffer: 16, policy: dropNewest}
+    logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+    src := newStdinSource(strings.NewReader("a\nb\n"), cfg, false, logger)
+    for src.eofSeq.Load() == 0 {
+        time.Sleep(time.Millisecond)
+    }
+    registerSource("stdin-test", src)
+    defer delete(sources, "stdin-test")
+
+    r := httptest.NewRequest(http.MethodGet, "/stream?source=stdin-test", nil)
+    r.Header.Set("Last-Event-ID", "0")
+    rr := httptest.NewRecorder()
+    streamHandler(rr, r)
+    body := rr.Body.String()
+    if !strings.Contains(body, "data: a\n") || !strings.Contains(body, "data: b\n") {
+        t.Errorf("lines missing from %q", body)
+    }
+    if n := strings.Count(body, "event: eof"); n != 1 {
+        t.Errorf("%d eof events in %q, want 1", n, body)
+    }
+    if !strings.HasSuffix(body, "event: eof\ndata: {\"reason\":\"source_ended\",\"total\":2}\n\n") {
+        t.Errorf("stream %q does not end with eof for 2 lines", body)
+    }
+}
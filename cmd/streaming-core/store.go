@@ -0,0 +1,51 @@
+package main
+
+// storedEvent is an event together with the broker sequence it was published at.
+type storedEvent struct {
+    seq   int
+    event SSEEvent
+}
+
+// EventStore is a fixed-size ring buffer of the most recently published
+// events. It is not safe for concurrent use; only the Broker goroutine touches it.
+type EventStore struct {
+    events []storedEvent
+    next   int
+    count  int
+}
+
+func newEventStore(size int) *EventStore {
+    if size < 0 {
+        size = 0
+    }
+    return &EventStore{events: make([]storedEvent, size)}
+}
+
+// Append records e, evicting the oldest event once the buffer is full.
+func (s *EventStore) Append(seq int, e SSEEvent) {
+    if len(s.events) == 0 {
+        return
+    }
+    s.events[s.next] = storedEvent{seq: seq, event: e}
+    s.next = (s.next + 1) % len(s.events)
+    if s.count < len(s.events) {
+        s.count++
+    }
+}
+
+// Since returns the buffered events published after seq, oldest first.
+// complete is false when events after seq have already been evicted.
+func (s *EventStore) Since(seq int) (events []SSEEvent, complete bool) {
+    if s.count == 0 {
+        return nil, true
+    }
+    first := (s.next - s.count + len(s.events)) % len(s.events)
+    complete = s.events[first].seq <= seq+1
+    for i := 0; i < s.count; i++ {
+        se := s.events[(first+i)%len(s.events)]
+        if se.seq > seq {
+            events = append(events, se.event)
+        }
+    }
+    return events, complete
+}
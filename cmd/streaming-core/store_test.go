@@ -0,0 +1,49 @@
+package main
+
+import (
+    "slices"
+    "strconv"
+    "testing"
+)
+
+func TestEventStoreEvictionBoundary(t *testing.T) {
+    s := newEventStore(3)
+    for seq := 1; seq <= 5; seq++ {
+        s.Append(seq, SSEEvent{Data: strconv.Itoa(seq)})
+    }
+    // 3, 4 and 5 are held; 1 and 2 are gone.
+    tests := []struct {
+        after    int
+        want     []string
+        complete bool
+    }{
+        {0, []string{"3", "4", "5"}, false},
+        {1, []string{"3", "4", "5"}, false},
+        {2, []string{"3", "4", "5"}, true}, // the oldest kept event is next
+        {3, []string{"4", "5"}, true},
+        {4, []string{"5"}, true},
+        {5, nil, true},
+        {9, nil, true},
+    }
+    for _, tt := range tests {
+        events, complete := s.Since(tt.after)
+        var got []string
+        for _, e := range events {
+            got = append(got, e.Data)
+        }
+        if !slices.Equal(got, tt.want) || complete != tt.complete {
+            t.Errorf("Since(%d) = %v, %v; want %v, %v", tt.after, got, complete, tt.want, tt.complete)
+        }
+    }
+}
+
+func TestEventStoreEmptyAndDisabled(t *testing.T) {
+    if events, complete := newEventStore(3).Since(0); events != nil || !complete {
+        t.Errorf("empty store: Since(0) = %v, %v; want nil, true", events, complete)
+    }
+    s := newEventStore(0)
+    s.Append(1, SSEEvent{Data: "1"})
+    if events, complete := s.Since(0); events != nil || !complete {
+        t.Errorf("zero-size store: Since(0) = %v, %v; want nil, true", events, complete)
+    }
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log/slog"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/Amarifields/streaming-core/params"
+    "github.com/Amarifields/streaming-core/streamingcore"
+)
+
+// formats lists the accepted values of the format query param.
+var formats = map[string]bool{"number": true, "json": true}
+
+// payloads lists the accepted values of the payload query param, which picks
+// the serialiser for number events.
+var payloads = map[string]bool{"text": true, "json": true}
+
+// shutdownCtx is cancelled when the server starts shutting down, so open
+// streams can send a shutdown event and return before the server waits on them.
+var shutdownCtx, beginShutdown = context.WithCancel(context.Background())
+
+// streamSlots caps concurrent streams across all transports. It is nil, and
+// streams are unlimited, unless main sets it from MAX_CONNECTIONS.
+var streamSlots chan struct{}
+
+// connLimitRetryAfterSec is the Retry-After sent when MAX_CONNECTIONS is
+// reached, long enough for a reconnect storm to spread out.
+const connLimitRetryAfterSec = 5
+
+// acquireStreamSlot reserves room for one stream. The returned func frees it.
+func acquireStreamSlot() (release func(), ok bool) {
+    if streamSlots == nil {
+        return func() {}, true
+    }
+    select {
+    case streamSlots <- struct{}{}:
+        return func() { <-streamSlots }, true
+    default:
+        return nil, false
+    }
+}
+
+// maxEventsPerSecond is MAX_EVENTS_PER_SECOND, the cap on eventsPerSecond.
+func maxEventsPerSecond() float64 {
+    v, err := strconv.ParseFloat(getEnv("MAX_EVENTS_PER_SECOND", "1000"), 64)
+    if err != nil || !(v > 0) {
+        return 1000
+    }
+    return v
+}
+
+// maxBurst is MAX_BURST, the cap on burst.
+func maxBurst() int {
+    v, err := strconv.Atoi(getEnv("MAX_BURST", "10000"))
+    if err != nil || v < 0 {
+        return 10000
+    }
+    return v
+}
+
+// maxEventBytes is MAX_EVENT_BYTES, the largest event data an SSE stream
+// sends, 0 for no limit. main sets it at startup.
+var maxEventBytes = 65536
+
+// streamOpts are the per-connection settings shared by every transport.
+type streamOpts struct {
+    format    string
+    payload   string
+    event     string // name of number events, "" for the payload's default
+    source    string
+    file      string          // file for the tail source, relative to TAIL_DIR
+    seed      int             // seed of the synthetic source's payloads
+    numbers   bool            // false for a pure event feed without the number feed
+    types     map[string]bool // event names to deliver, nil for all
+    summary   bool            // send a "done" event when the stream completes
+    sendEOF   bool            // end a completed stream with an "eof" event
+    interval  time.Duration
+    heartbeat time.Duration
+    retry     int // reconnect delay in ms advertised over SSE, 0 to omit
+    step      int
+    modulo    int // only numbers divisible by it are sent
+    first     int // first number to emit
+    end       int // last number to emit, -1 when unbounded
+    limit     int // numbers to emit, 0 when unlimited
+    burst     int // numbers to emit at once before pacing starts
+    lastID    int // resume point of the feed, -1 when not resuming
+    requestID string
+
+    // lastTopicID is the resume point for replaying the topic's published
+    // events, -1 when not resuming.
+    lastTopicID int
+    // maxDuration ends the stream with a "timeout" event, 0 for no limit.
+    maxDuration time.Duration
+    // payloadBytes is the size of the synthetic source's payloads.
+    payloadBytes int
+    // batch is the least time between SSE flushes, 0 to flush every event.
+    batch time.Duration
+}
+
+// wants reports whether e passes the types filter. Unnamed events go by
+// "message", the name EventSource dispatches them under.
+func (o streamOpts) wants(e SSEEvent) bool {
+    if o.types == nil {
+        return true
+    }
+    name := e.Event
+    if name == "" {
+        name = "message"
+    }
+    return o.types[name]
+}
+
+// parseStreamOpts reads and validates the stream query params; the error
+// names the first offending param. lastEventID is the resume point, taken
+// from Last-Event-ID or the transport's equivalent.
+func parseStreamOpts(r *http.Request, lastEventID string) (streamOpts, error) {
+    opts := streamOpts{format: r.URL.Query().Get("format"), lastID: -1, lastTopicID: -1, requestID: requestIDFrom(r.Context())}
+    opts.payload = r.URL.Query().Get("payload")
+    if opts.payload == "" {
+        opts.payload = "text"
+    }
+    if !payloads[opts.payload] {
+        return opts, fmt.Errorf("unknown payload: %s", opts.payload)
+    }
+    opts.numbers = true
+    if q := r.URL.Query().Get("numbers"); q != "" {
+        v, err := strconv.ParseBool(q)
+        if err != nil {
+            return opts, fmt.Errorf("invalid numbers: %q is not a boolean", q)
+        }
+        opts.numbers = v
+    }
+    if q := r.URL.Query().Get("summary"); q != "" {
+        v, err := strconv.ParseBool(q)
+        if err != nil {
+            return opts, fmt.Errorf("invalid summary: %q is not a boolean", q)
+        }
+        opts.summary = v
+    }
+    opts.event = strings.TrimSpace(r.URL.Query().Get("event"))
+    if strings.ContainsAny(opts.event, "\r\n") {
+        return opts, errors.New("invalid event: must not contain line breaks")
+    }
+    if q := r.URL.Query().Get("types"); q != "" {
+        opts.types = make(map[string]bool)
+        for _, name := range splitList(q) {
+            if strings.ContainsAny(name, "\r\n") {
+                return opts, errors.New("invalid types: names must not contain line breaks")
+            }
+            opts.types[name] = true
+        }
+    }
+    opts.source = r.URL.Query().Get("source")
+    if opts.source == "" {
+        opts.source = defaultSource
+    }
+    src, ok := sources[opts.source]
+    if !ok {
+        return opts, fmt.Errorf("unknown source: %s", opts.source)
+    }
+    if e, ok := src.(eofSource); ok {
+        opts.sendEOF = e.sendsEOF()
+    }
+    if q := r.URL.Query().Get("send_eof"); q != "" {
+        v, err := strconv.ParseBool(q)
+        if err != nil {
+            return opts, fmt.Errorf("invalid send_eof: %q is not a boolean", q)
+        }
+        opts.sendEOF = v
+    }
+    accepted, defaultFormat := formats, getEnv("STREAM_FORMAT", "number")
+    if f, ok := src.(formatSource); ok {
+        accepted, defaultFormat = f.formats()
+    }
+    if opts.format == "" {
+        opts.format = defaultFormat
+    }
+    if !accepted[opts.format] {
+        return opts, fmt.Errorf("unknown format: %s", opts.format)
+    }
+    opts.file = r.URL.Query().Get("file")
+
+    defaultInterval, _ := strconv.Atoi(getEnv("STREAM_INTERVAL_MS", "100"))
+    topic := r.PathValue("topic")
+    if topic == "" {
+        topic = defaultTopic
+    }
+    if ms, ok := topicIntervals()[topic]; ok {
+        defaultInterval = ms
+    }
+    defaultHeartbeat, _ := strconv.Atoi(getEnv("KEEPALIVE_MS", getEnv("HEARTBEAT_MS", "15000")))
+    defaultRetry, _ := strconv.Atoi(getEnv("RETRY_MS", "1000"))
+    var err error
+    if opts.interval, err = params.ParseInterval(r, defaultInterval); err != nil {
+        return opts, err
+    }
+    rate, err := params.ParseRate(r)
+    if err != nil {
+        return opts, err
+    }
+    if rate > 0 {
+        if r.URL.Query().Has("intervalMs") {
+            return opts, errors.New("intervalMs and eventsPerSecond are mutually exclusive")
+        }
+        opts.interval = params.RateInterval(rate, maxEventsPerSecond())
+    }
+    start, err := params.ParseStart(r)
+    if err != nil {
+        return opts, err
+    }
+    if opts.limit, err = params.ParseLimit(r); err != nil {
+        return opts, err
+    }
+    defaultMaxDuration, _ := strconv.Atoi(getEnv("MAX_STREAM_DURATION_MS", "0"))
+    var heartbeatMs, maxDurationMs, batchMs int
+    ints := []struct {
+        name     string
+        dst      *int
+        def, min int
+    }{
+        {"heartbeatMs", &heartbeatMs, defaultHeartbeat, 0},
+        {"retryMs", &opts.retry, defaultRetry, 0},
+        {"step", &opts.step, 1, 1},
+        {"modulo", &opts.modulo, 1, 1},
+        {"end", &opts.end, -1, 0},
+        {"maxDurationMs", &maxDurationMs, max(defaultMaxDuration, 0), 0},
+        {"batchMs", &batchMs, 0, 0},
+        {"burst", &opts.burst, 0, 0},
+        {"payloadBytes", &opts.payloadBytes, 1024, 1},
+        {"seed", &opts.seed, 0, 0},
+    }
+    for _, p := range ints {
+        if *p.dst, err = params.Int(r, p.name, p.def, p.min); err != nil {
+            return opts, err
+        }
+    }
+    if start >= 0 && opts.end >= 0 && opts.end < start {
+        return opts, errors.New("invalid end: must be >= start")
+    }
+    opts.heartbeat = time.Duration(heartbeatMs) * time.Millisecond
+    opts.maxDuration = time.Duration(maxDurationMs) * time.Millisecond
+    opts.batch = time.Duration(batchMs) * time.Millisecond
+    opts.burst = min(opts.burst, maxBurst())
+
+    if n, topic, ok := parseEventID(lastEventID, opts.numbers); ok && topic {
+        opts.lastTopicID = n
+    } else if ok {
+        opts.lastID = n
+        opts.first = n + opts.step
+    }
+    if start >= 0 {
+        opts.first = start
+    }
+    if c, ok := src.(optsChecker); ok {
+        if err := c.checkOpts(opts); err != nil {
+            return opts, err
+        }
+    }
+    return opts, nil
+}
+
+// eventSink is where a stream's events are delivered: an SSE response or a
+// WebSocket.
+type eventSink interface {
+    Write(e SSEEvent) error
+    Keepalive() error
+}
+
+// shutdownEvent is the last event every open stream receives when the server
+// shuts down. Its retry field and data suggest how long clients should wait
+// before reconnecting, giving a restarted or replacement instance time to
+// come up.
+func shutdownEvent() SSEEvent {
+    delayMs, _ := strconv.Atoi(getEnv("SHUTDOWN_RETRY_MS", "3000"))
+    return SSEEvent{
+        Event: "shutdown",
+        Data:  fmt.Sprintf(`{"reason":"server shutting down","reconnectMs":%d}`, delayMs),
+        Retry: delayMs,
+    }
+}
+
+var (
+    // errStreamComplete means the stream reached its end or limit.
+    errStreamComplete = errors.New("stream complete")
+    // errShuttingDown means the server began shutting down.
+    errShuttingDown = errors.New("server shutting down")
+    // errSlowConsumer means the broker disconnected the stream for falling
+    // behind, under BACKPRESSURE_POLICY=disconnect.
+    errSlowConsumer = errors.New("subscriber too slow")
+    // errMaxDuration means the stream ran for its maxDurationMs.
+    errMaxDuration = errors.New("max stream duration reached")
+)
+
+// topicIDPrefix marks the IDs of published events in streams that also
+// carry the feed, whose IDs are bare numbers: the two count independently,
+// so a resuming client's Last-Event-ID must say which one it belongs to.
+// /poll marks them the same way.
+const topicIDPrefix = "t"
+
+// parseEventID reads a Last-Event-ID or /poll's after: a number with
+// topicIDPrefix is a position in the topic, and a bare number one in the
+// feed, or in the topic when there is no feed. ok is false for anything
+// else, e.g. an ID chosen by a publisher, which resumes nothing.
+func parseEventID(id string, numbers bool) (n int, topic, ok bool) {
+    id, topic = strings.CutPrefix(id, topicIDPrefix)
+    topic = topic || !numbers
+    n, err := strconv.Atoi(id)
+    if err != nil || n < 0 {
+        return 0, false, false
+    }
+    return n, topic, true
+}
+
+// runStream replays topic events missed since opts.lastTopicID, then interleaves
+// live broker events and keep-alives with the events from feed on sink. It
+// returns why it stopped: ctx's error when the client went away,
+// errStreamComplete once feed is closed, errShuttingDown, errMaxDuration
+// once opts.maxDuration has passed, or the sink's write error. The caller
+// stops the producer behind feed by cancelling ctx.
+func runStream(ctx context.Context, sc *streamConn, sink eventSink, feed <-chan SSEEvent) (err error) {
+    defer func() { sc.err = err }()
+    opts := sc.opts
+    // A batching sink holds events back between flushes; flushBatch sends
+    // them at least every opts.batch.
+    var flushBatch <-chan time.Time
+    batcher, ok := sink.(interface{ Flush() error })
+    if ok && opts.batch > 0 {
+        batchTicker := time.NewTicker(opts.batch)
+        defer batchTicker.Stop()
+        flushBatch = batchTicker.C
+    }
+    counted := countingSink{eventSink: sink, conn: sc}
+    sink = counted
+    if opts.maxDuration > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeoutCause(ctx, opts.maxDuration, errMaxDuration)
+        defer cancel()
+    }
+
+    var heartbeat <-chan time.Time
+    if opts.heartbeat > 0 {
+        heartbeatTicker := time.NewTicker(opts.heartbeat)
+        defer heartbeatTicker.Stop()
+        heartbeat = heartbeatTicker.C
+    }
+
+    var events <-chan SSEEvent
+    var missed []SSEEvent
+    complete := true
+    total := 0    // feed events sent, reported by the summary
+    produced := 0 // feed events, whether sent, filtered out or dropped
+    if opts.lastTopicID >= 0 {
+        events, missed, complete = sc.broker.Resume(opts.lastTopicID)
+    } else {
+        events = sc.broker.Subscribe()
+    }
+    defer sc.broker.Unsubscribe(events)
+    if !complete {
+        loggerFrom(ctx).Warn("Last-Event-ID is older than history", slog.Int("last_event_id", opts.lastTopicID), slog.Int("replayed", len(missed)))
+        reset := SSEEvent{Event: "reset", Data: fmt.Sprintf(`{"lastEventId":%d}`, opts.lastTopicID)}
+        if err := sink.Write(reset); err != nil {
+            return err
+        }
+    }
+    for _, e := range missed {
+        if err := writeBrokerEvent(sink, e, opts, loggerFrom(ctx)); err != nil {
+            return err
+        }
+    }
+
+    for {
+        select {
+        case <-ctx.Done():
+            if context.Cause(ctx) == errMaxDuration {
+                timeout := SSEEvent{Event: "timeout", Data: fmt.Sprintf(`{"maxDurationMs":%d}`, opts.maxDuration.Milliseconds())}
+                if err := sink.Write(timeout); err != nil {
+                    return err
+                }
+                return errMaxDuration
+            }
+            return ctx.Err()
+        case <-shutdownCtx.Done():
+            return errShuttingDown
+        case e, ok := <-events:
+            if !ok {
+                return errSlowConsumer
+            }
+            if err := writeBrokerEvent(sink, e, opts, loggerFrom(ctx)); err != nil {
+                return err
+            }
+        case <-heartbeat:
+            if err := sink.Keepalive(); err != nil {
+                return err
+            }
+        case <-flushBatch:
+            if err := batcher.Flush(); err != nil {
+                return err
+            }
+        case e, ok := <-feed:
+            if !ok {
+                if ctx.Err() != nil {
+                    return ctx.Err()
+                }
+                if sc.sourceErr != nil {
+                    loggerFrom(ctx).Error("stream source failed", slog.String("source", opts.source), slog.Any("error", sc.sourceErr))
+                    failed := SSEEvent{Event: "error", Data: `{"error":"source failed"}`}
+                    if err := sink.Write(failed); err != nil {
+                        return err
+                    }
+                    return sc.sourceErr
+                }
+                if opts.summary {
+                    done := SSEEvent{Event: "done", Data: fmt.Sprintf(`{"total":%d}`, total)}
+                    if err := sink.Write(done); err != nil {
+                        return err
+                    }
+                }
+                if opts.sendEOF {
+                    eof := SSEEvent{Event: "eof", Data: fmt.Sprintf(`{"reason":%q,"total":%d}`, eofReason(opts, produced), total)}
+                    if err := sink.Write(eof); err != nil {
+                        return err
+                    }
+                }
+                return errStreamComplete
+            }
+            produced++
+            if !opts.wants(e) {
+                continue
+            }
+            sent, err := counted.send(e)
+            if err != nil {
+                return err
+            }
+            if sent {
+                total++
+            }
+            if seq, err := strconv.Atoi(e.ID); err == nil {
+                sc.lastSeq.Store(int64(seq))
+            }
+        }
+    }
+}
+
+// eofReason says why a stream whose source produced n events completed:
+// its limit or end was reached, or its source ran out. n counts the events
+// the types filter held back or that were dropped, as limit does.
+func eofReason(opts streamOpts, n int) string {
+    switch {
+    case opts.limit > 0 && n >= opts.limit:
+        return "limit_reached"
+    case opts.end >= 0:
+        return "end_reached"
+    default:
+        return "source_ended"
+    }
+}
+
+// generate calls emit with the number sequence described by opts, one per
+// interval, until the end or limit is reached (errStreamComplete), ctx is
+// done (ctx.Err()) or emit fails. The first opts.burst numbers are emitted
+// at once, counting against the limit like the rest. Numbers not divisible
+// by opts.modulo take their tick but are not emitted, nor counted against
+// the limit or burst. An interval set through /admin/interval replaces
+// opts.interval, also mid-stream.
+func generate(ctx context.Context, opts streamOpts, emit func(seq int) error) error {
+    seq := opts.first
+    if opts.end >= 0 && seq > opts.end {
+        return errStreamComplete
+    }
+    sent := 0
+    // next emits seq unless modulo skips it and moves on to the next number.
+    next := func() (emitted bool, err error) {
+        skip := opts.modulo > 1 && seq%opts.modulo != 0
+        if !skip {
+            if err := emit(seq); err != nil {
+                return false, err
+            }
+        }
+        seq += opts.step
+        if opts.end >= 0 && seq > opts.end {
+            return !skip, errStreamComplete
+        }
+        if opts.limit > 0 && !skip {
+            sent++
+            if sent >= opts.limit {
+                return true, errStreamComplete
+            }
+        }
+        return !skip, nil
+    }
+    for burst := opts.burst; burst > 0; {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        emitted, err := next()
+        if err != nil {
+            return err
+        }
+        if emitted {
+            burst--
+        }
+    }
+
+    interval := runtimeInterval.interval(opts.interval)
+    changed := runtimeInterval.watch()
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-changed:
+            changed = runtimeInterval.watch()
+            if d := runtimeInterval.interval(opts.interval); d != interval {
+                interval = d
+                ticker.Reset(d)
+            }
+        case <-ticker.C:
+            if _, err := next(); err != nil {
+                return err
+            }
+        }
+    }
+}
+
+// numberEvent builds the event for seq carrying value: a "number" event in
+// opts.format, or a "tick" event when opts.payload is json. opts.event
+// overrides either name.
+func numberEvent(seq, value int, opts streamOpts) (SSEEvent, error) {
+    e := SSEEvent{ID: strconv.Itoa(seq), Event: "number"}
+    var err error
+    if opts.payload == "json" {
+        e.Event = "tick"
+        e.Data, err = jsonEnvelope.EncodeTick(seq, value)
+    } else {
+        e.Data, err = formatEvent(seq, value, opts)
+    }
+    if opts.event != "" {
+        e.Event = opts.event
+    }
+    return e, err
+}
+
+// writeBrokerEvent sends a published event, its ID marked with
+// topicIDPrefix when the stream also carries the feed.
+func writeBrokerEvent(sink eventSink, e SSEEvent, opts streamOpts, logger *slog.Logger) error {
+    if !opts.wants(e) {
+        return nil
+    }
+    e, err := formatBrokerEvent(e, opts)
+    if err != nil {
+        logger.Error("encode event", slog.Any("error", err))
+        return err
+    }
+    if opts.numbers && e.ID != "" {
+        e.ID = topicIDPrefix + e.ID
+    }
+    return sink.Write(e)
+}
+
+// beginStream does the checks shared by every streaming endpoint and writes
+// the error response itself when one fails. On success the caller must
+// close the returned streamConn once the stream ends. kind names the
+// transport: "sse", "ndjson", "ws" or "binary".
+func beginStream(w http.ResponseWriter, r *http.Request, kind, lastEventID string) (*streamConn, bool) {
+    opts, err := parseStreamOpts(r, lastEventID)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return nil, false
+    }
+    broker, ok := topicBroker(w, r.PathValue("topic"))
+    if !ok {
+        return nil, false
+    }
+    release, ok := acquireStreamSlot()
+    if !ok {
+        w.Header().Set("Retry-After", strconv.Itoa(connLimitRetryAfterSec))
+        http.Error(w, "too many connections", http.StatusServiceUnavailable)
+        return nil, false
+    }
+    untrack := defaultMetrics.trackConnection()
+    meta := StreamContext{StartedAt: time.Now(), ClientIP: clientIP(r), StreamID: newULID()}
+    if claims, ok := claimsFrom(r.Context()); ok {
+        meta.Subject = claims.Subject
+    }
+    ctx := withStreamContext(r.Context(), meta)
+    logger := loggerFrom(ctx).With(slog.String("stream_id", meta.StreamID), slog.String("remote_addr", r.RemoteAddr))
+    sc := &streamConn{
+        id:     requestIDFrom(r.Context()),
+        remote: r.RemoteAddr,
+        path:   r.URL.Path,
+        kind:   kind,
+        query:  redactedQuery(r),
+        opts:   opts,
+        broker: broker,
+        ctx:    context.WithValue(ctx, loggerKey{}, logger),
+        release: func() {
+            untrack()
+            release()
+        },
+    }
+    sc.lastSeq.Store(-1)
+    sc.retry = -1
+    openStreams.add(sc)
+    logger.Info("stream opened",
+        slog.String("method", r.Method),
+        slog.String("path", r.URL.Path),
+        slog.String("type", kind),
+        slog.String("query", redactedQuery(r).Encode()),
+    )
+    return sc, true
+}
+
+// streamJSONHandler serves /stream/json, which is /stream with
+// payload=json.
+func streamJSONHandler(w http.ResponseWriter, r *http.Request) {
+    r = r.Clone(r.Context())
+    q := r.URL.Query()
+    q.Set("payload", "json")
+    r.URL.RawQuery = q.Encode()
+    streamHandler(w, r)
+}
+
+// streamEOFHandler serves /stream/eof, which is /stream ending with an eof
+// event once it completes, unless send_eof=false.
+func streamEOFHandler(w http.ResponseWriter, r *http.Request) {
+    r = r.Clone(r.Context())
+    q := r.URL.Query()
+    if !q.Has("send_eof") {
+        q.Set("send_eof", "true")
+    }
+    r.URL.RawQuery = q.Encode()
+    streamHandler(w, r)
+}
+
+// tryPushRelatedStream asks an HTTP/2 client to preload the stream at url,
+// e.g. a second topic the page is about to open. It must be a local path;
+// on HTTP/1.1 it returns http.ErrNotSupported and does nothing.
+func tryPushRelatedStream(w http.ResponseWriter, url string) error {
+    if !strings.HasPrefix(url, "/") || strings.HasPrefix(url, "//") {
+        return fmt.Errorf("related %q is not a local path", url)
+    }
+    p, ok := w.(http.Pusher)
+    if !ok {
+        return http.ErrNotSupported
+    }
+    return p.Push(url, &http.PushOptions{
+        Header: http.Header{"Accept": []string{"text/event-stream"}},
+    })
+}
+
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+    if isWebSocketUpgrade(r) {
+        wsHandler(w, r)
+        return
+    }
+    switch mode := r.URL.Query().Get("mode"); mode {
+    case "", "sse":
+    case "ndjson":
+        ndjsonHandler(w, r)
+        return
+    default:
+        http.Error(w, "unknown mode: "+mode, http.StatusBadRequest)
+        return
+    }
+    sc, ok := beginStream(w, r, "sse", r.Header.Get("Last-Event-ID"))
+    if !ok {
+        return
+    }
+    defer sc.close()
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+
+    sw, ok := newSSEWriter(w, defaultMetrics)
+    if !ok {
+        http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+        return
+    }
+    if compressionEnabled() && streamingcore.AcceptsGzip(r) {
+        sw.enableGzip()
+    }
+    sw.core.BatchInterval = sc.opts.batch
+    defer sw.Close()
+
+    if related := r.URL.Query().Get("related"); related != "" {
+        if err := tryPushRelatedStream(w, related); err != nil {
+            loggerFrom(sc.ctx).Debug("push skipped", slog.String("related", related), slog.Any("error", err))
+        }
+    }
+
+    sc.retry = 0
+    if sc.opts.retry > 0 {
+        // A retryMs the client asked for is sent as is; only the server
+        // default is jittered.
+        jitter := retryJitterPct
+        if r.URL.Query().Has("retryMs") {
+            jitter = 0
+        }
+        sc.retry = jitterRetry(sc.opts.retry, jitter)
+        if err := sw.writeRetry(sc.retry); err != nil {
+            // The stream is dead before it started; log why, not what
+            // the next write would make of the broken connection.
+            sc.err = err
+            return
+        }
+    }
+
+    ctx, cancel := context.WithCancel(sc.ctx)
+    defer cancel()
+    if err := runStream(ctx, sc, sw, streamFeed(ctx, sc)); errors.Is(err, errShuttingDown) {
+        _ = sw.Write(shutdownEvent())
+    }
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "math"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestParseEventID(t *testing.T) {
+    tests := []struct {
+        id            string
+        numbers       bool
+        wantN         int
+        wantTopic, ok bool
+    }{
+        {"7", true, 7, false, true},
+        {"t7", true, 7, true, true},
+        {"7", false, 7, true, true},
+        {"t7", false, 7, true, true},
+        {"order-9", true, 0, false, false},
+        {"-1", true, 0, false, false},
+        {"", true, 0, false, false},
+    }
+    for _, tt := range tests {
+        n, topic, ok := parseEventID(tt.id, tt.numbers)
+        if n != tt.wantN || topic != tt.wantTopic || ok != tt.ok {
+            t.Errorf("parseEventID(%q, %v) = %d, %v, %v; want %d, %v, %v", tt.id, tt.numbers, n, topic, ok, tt.wantN, tt.wantTopic, tt.ok)
+        }
+    }
+}
+
+func TestResumeKeepsFeedAndTopicApart(t *testing.T) {
+    srv := newStreamServer(t)
+    topic := fmt.Sprintf("resume%d", time.Now().UnixNano())
+    b, _ := topics.get(topic)
+    for i := 1; i <= 3; i++ {
+        b.Publish(SSEEvent{Event: "order", Data: fmt.Sprint(i)})
+    }
+    time.Sleep(20 * time.Millisecond)
+
+    // A topic ID replays the topic and leaves the number feed alone.
+    got := readSSE(t, srv, "/stream/"+topic+"?intervalMs=1&limit=1", http.Header{"Last-Event-ID": {"t2"}}, 2)
+    if got[0].ID != "t3" || got[0].Data != "3" {
+        t.Errorf("replayed %+v, want id t3 data 3", got[0])
+    }
+    if got[1].ID != "0" {
+        t.Errorf("first number has id %q, want 0", got[1].ID)
+    }
+
+    // A number ID resumes the feed and replays nothing.
+    got = readSSE(t, srv, "/stream/"+topic+"?intervalMs=1&limit=1", http.Header{"Last-Event-ID": {"2"}}, 1)
+    if got[0].ID != "3" || got[0].Event != "number" {
+        t.Errorf("first event %+v, want number 3", got[0])
+    }
+}
+
+func TestLimitedStreamEndsWithEOF(t *testing.T) {
+    srv := newStreamServer(t)
+    for _, path := range []string{"/stream/eof?intervalMs=1&limit=3", "/stream?intervalMs=1&limit=3&send_eof=true"} {
+        got := readSSE(t, srv, path, nil, 4)
+        if got[3].Event != "eof" || got[3].Data != `{"reason":"limit_reached","total":3}` {
+            t.Errorf("%s: 4th event %+v, want eof with limit_reached", path, got[3])
+        }
+    }
+
+    for _, tt := range []struct {
+        path string
+        h    http.HandlerFunc
+    }{
+        {"/stream?intervalMs=1&limit=3", streamHandler},
+        {"/stream/eof?intervalMs=1&limit=3&send_eof=false", streamEOFHandler},
+    } {
+        code, got := recordStream(tt.h, tt.path, nil)
+        if code != http.StatusOK || len(got) != 3 || got[2].ID != "2" {
+            t.Errorf("%s: status %d, events %+v; want 0 to 2 without eof", tt.path, code, got)
+        }
+    }
+}
+
+func TestEOFReasonCountsFilteredEvents(t *testing.T) {
+    useSource(t, "mixed", SourceFunc(func(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error {
+        for i, name := range []string{"keep", "skip", "keep"} {
+            if err := emitEvent(ctx, out, SSEEvent{ID: strconv.Itoa(i), Event: name, Data: "x"}); err != nil {
+                return err
+            }
+        }
+        return nil
+    }))
+    // The source stops at the limit of 3, of which the filter lets 2 through.
+    _, got := recordStream(streamEOFHandler, "/stream/eof?source=mixed&limit=3&types=keep", nil)
+    if len(got) != 3 || got[2].Event != "eof" || got[2].Data != `{"reason":"limit_reached","total":2}` {
+        t.Errorf("events %+v, want two and eof with limit_reached", got)
+    }
+}
+
+func TestSummaryDoneArrivesLast(t *testing.T) {
+    srv := newStreamServer(t)
+    resp := openStream(t, srv, "/stream?intervalMs=1&limit=3&summary=true&send_eof=false")
+    // Read to the end: the handler has returned, so done was flushed
+    // before it did.
+    got, err := scanSSE(resp.Body, math.MaxInt)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(got) != 4 || !slices.Equal(eventIDs(got[:3]), []string{"0", "1", "2"}) {
+        t.Fatalf("events %+v, want three numbers and done", got)
+    }
+    if last := got[3]; last.Event != "done" || last.Data != `{"total":3}` {
+        t.Errorf("last event %+v, want done with total 3", last)
+    }
+
+    _, events := recordStream(streamHandler, "/stream?intervalMs=1&limit=3&send_eof=false", nil)
+    for _, e := range events {
+        if e.Event == "done" {
+            t.Errorf("done sent without summary=true: %+v", e)
+        }
+    }
+}
+
+func TestMaxDurationEndsStream(t *testing.T) {
+    buf := captureLog(t)
+    srv := newStreamServer(t)
+    start := time.Now()
+    resp := openStream(t, srv, "/stream?intervalMs=10&maxDurationMs=500&send_eof=false")
+    got, err := scanSSE(resp.Body, math.MaxInt)
+    elapsed := time.Since(start)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if elapsed < 500*time.Millisecond || elapsed > 900*time.Millisecond {
+        t.Errorf("stream lasted %v, want about 500ms", elapsed)
+    }
+    if len(got) < 10 {
+        t.Fatalf("only %d events in 500ms at intervalMs=10", len(got))
+    }
+    if last := got[len(got)-1]; last.Event != "timeout" || last.Data != `{"maxDurationMs":500}` {
+        t.Errorf("last event %+v, want timeout", last)
+    }
+    waitFor(t, "the stream closed log line", func() bool { return strings.Contains(buf.String(), `"stream closed"`) })
+    if rec := logRecord(t, buf, "stream closed"); rec["reason"] != "max_duration" {
+        t.Errorf("closed with reason %v, want max_duration", rec["reason"])
+    }
+}
+
+func TestMaxDurationDefault(t *testing.T) {
+    srv := newStreamServer(t)
+    tests := []struct {
+        env, query string
+        timeout    bool
+    }{
+        {"100", "", true},
+        {"100", "&maxDurationMs=0", false},
+        {"", "", false},
+    }
+    for _, tt := range tests {
+        t.Setenv("MAX_STREAM_DURATION_MS", tt.env)
+        // 30 events take 300ms, well past a 100ms limit.
+        got, err := scanSSE(openStream(t, srv, "/stream?intervalMs=10&send_eof=false"+tt.query).Body, 30)
+        if err != nil {
+            t.Fatal(err)
+        }
+        timedOut := len(got) > 0 && got[len(got)-1].Event == "timeout"
+        if timedOut != tt.timeout || (!tt.timeout && len(got) != 30) {
+            t.Errorf("MAX_STREAM_DURATION_MS=%q, query %q: %d events, timed out %v; want timed out %v", tt.env, tt.query, len(got), timedOut, tt.timeout)
+        }
+    }
+}
+
+// sliceSink collects the events written to it.
+type sliceSink struct{ events []SSEEvent }
+
+func (s *sliceSink) Write(e SSEEvent) error {
+    s.events = append(s.events, e)
+    return nil
+}
+
+func (s *sliceSink) Keepalive() error { return nil }
+
+func TestRunStreamDeliversFeedInOrder(t *testing.T) {
+    opts, err := parseStreamOpts(httptest.NewRequest(http.MethodGet, "/stream?summary=false&send_eof=false", nil), "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    feed := make(chan SSEEvent, 5)
+    for i := 1; i <= 5; i++ {
+        feed <- SSEEvent{ID: fmt.Sprint(i), Event: "number", Data: fmt.Sprint(i * 10)}
+    }
+    close(feed)
+    sc := &streamConn{opts: opts, broker: newBroker(brokerConfig{history: 8, buffer: 4, policy: dropNewest})}
+    sink := &sliceSink{}
+    if err := runStream(context.Background(), sc, sink, feed); err != errStreamComplete {
+        t.Fatalf("runStream = %v, want errStreamComplete", err)
+    }
+    if len(sink.events) != 5 {
+        t.Fatalf("got %d events, want 5: %+v", len(sink.events), sink.events)
+    }
+    for i, e := range sink.events {
+        if e.ID != fmt.Sprint(i+1) || e.Data != fmt.Sprint((i+1)*10) {
+            t.Errorf("event %d = %+v", i, e)
+        }
+    }
+    if sc.sent.Load() != 5 || sc.lastSeq.Load() != 5 {
+        t.Errorf("sent %d, lastSeq %d; want 5, 5", sc.sent.Load(), sc.lastSeq.Load())
+    }
+}
+
+// logBuffer collects log output from handlers still running while the
+// test reads it.
+type logBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+// captureLog sends the default logger's JSON records to the returned
+// buffer until the test ends.
+func captureLog(t *testing.T) *logBuffer {
+    t.Helper()
+    buf := &logBuffer{}
+    old := slog.Default()
+    slog.SetDefault(slog.New(slog.NewJSONHandler(buf, nil)))
+    t.Cleanup(func() { slog.SetDefault(old) })
+    return buf
+}
+
+// logRecord returns the first record with message msg.
+func logRecord(t *testing.T, buf fmt.Stringer, msg string) map[string]any {
+    t.Helper()
+    for _, line := range strings.Split(buf.String(), "\n") {
+        var rec map[string]any
+        if json.Unmarshal([]byte(line), &rec) == nil && rec["msg"] == msg {
+            return rec
+        }
+    }
+    t.Fatalf("no %q record in %s", msg, buf)
+    return nil
+}
+
+func TestRetryLoggedAsSent(t *testing.T) {
+    t.Setenv("RETRY_MS", "1000")
+    useRetryJitterPct(t, 50)
+    for _, tt := range []struct {
+        query string
+        want  int // -1 for the jittered default
+    }{
+        {"", -1},
+        {"&retryMs=2500", 2500},
+        {"&retryMs=0", 0},
+    } {
+        buf := captureLog(t)
+        rr := httptest.NewRecorder()
+        streamHandler(rr, httptest.NewRequest(http.MethodGet, "/stream?intervalMs=1&limit=1"+tt.query, nil))
+
+        sent := 0
+        if _, after, ok := strings.Cut(rr.Body.String(), "retry: "); ok {
+            sent, _ = strconv.Atoi(after[:strings.IndexByte(after, '\n')])
+        }
+        switch {
+        case tt.want >= 0 && sent != tt.want:
+            t.Errorf("%q: sent retry %d, want %d", tt.query, sent, tt.want)
+        case tt.want < 0 && (sent < 500 || sent > 1500):
+            t.Errorf("%q: sent retry %d, want 1000±50%%", tt.query, sent)
+        }
+        if got := logRecord(t, buf, "stream closed")["retry_ms"]; got != float64(sent) {
+            t.Errorf("%q: logged retry_ms %v, sent %d", tt.query, got, sent)
+        }
+    }
+}
+
+func TestStep(t *testing.T) {
+    tests := []struct {
+        query  string
+        header http.Header
+        want   []string
+    }{
+        {"", nil, []string{"0", "1", "2", "3"}},
+        {"&step=3", nil, []string{"0", "3", "6", "9"}},
+        {"&step=3&start=4", nil, []string{"4", "7", "10", "13"}},
+        // Resuming carries on one step after the last ID.
+        {"&step=3", http.Header{"Last-Event-ID": {"6"}}, []string{"9", "12", "15", "18"}},
+    }
+    for _, tt := range tests {
+        code, events := recordStream(streamHandler, "/stream?intervalMs=1&limit=4&send_eof=false"+tt.query, tt.header)
+        if got := eventIDs(events); code != http.StatusOK || !slices.Equal(got, tt.want) {
+            t.Errorf("%q: status %d, ids %v; want %v", tt.query, code, got, tt.want)
+        }
+        for _, e := range events {
+            if e.Data != e.ID {
+                t.Errorf("%q: event %s carries %q", tt.query, e.ID, e.Data)
+            }
+        }
+    }
+    for _, bad := range []string{"abc", "0", "-2"} {
+        if code, _ := recordStream(streamHandler, "/stream?limit=1&step="+bad, nil); code != http.StatusBadRequest {
+            t.Errorf("step=%s: status %d, want 400", bad, code)
+        }
+    }
+}
+
+func TestEnd(t *testing.T) {
+    tests := []struct {
+        query  string
+        header http.Header
+        want   []string
+    }{
+        {"&end=3", nil, []string{"0", "1", "2", "3"}},
+        {"&start=5&end=7", nil, []string{"5", "6", "7"}},
+        {"&start=5&end=5", nil, []string{"5"}},
+        // end need not be on a step: the last number is the one before it.
+        {"&step=3&end=10", nil, []string{"0", "3", "6", "9"}},
+        {"&end=9&limit=2", nil, []string{"0", "1"}},
+        {"&end=3", http.Header{"Last-Event-ID": {"1"}}, []string{"2", "3"}},
+        {"&end=3", http.Header{"Last-Event-ID": {"3"}}, nil},
+    }
+    for _, tt := range tests {
+        code, events := recordStream(streamHandler, "/stream?intervalMs=1&send_eof=true"+tt.query, tt.header)
+        if code != http.StatusOK || len(events) == 0 {
+            t.Fatalf("%q: status %d, events %+v", tt.query, code, events)
+        }
+        eof := events[len(events)-1]
+        if got := eventIDs(events[:len(events)-1]); !slices.Equal(got, tt.want) {
+            t.Errorf("%q: ids %v; want %v", tt.query, got, tt.want)
+        }
+        reason := "end_reached"
+        if strings.Contains(tt.query, "limit") {
+            reason = "limit_reached"
+        }
+        if want := fmt.Sprintf(`{"reason":%q,"total":%d}`, reason, len(tt.want)); eof.Event != "eof" || eof.Data != want {
+            t.Errorf("%q: last event %+v, want eof %s", tt.query, eof, want)
+        }
+    }
+    for _, bad := range []string{"start=5&end=4", "end=-1", "end=abc"} {
+        if code, _ := recordStream(streamHandler, "/stream?"+bad, nil); code != http.StatusBadRequest {
+            t.Errorf("%s: status %d, want 400", bad, code)
+        }
+    }
+}
+
+func TestEventsPerSecond(t *testing.T) {
+    t.Setenv("MAX_EVENTS_PER_SECOND", "100")
+    tests := []struct {
+        query string
+        want  time.Duration
+    }{
+        {"eventsPerSecond=20", 50 * time.Millisecond},
+        {"eventsPerSecond=0.5", 2 * time.Second},
+        // Capped at MAX_EVENTS_PER_SECOND.
+        {"eventsPerSecond=5000", 10 * time.Millisecond},
+    }
+    for _, tt := range tests {
+        opts, err := parseStreamOpts(httptest.NewRequest(http.MethodGet, "/stream?"+tt.query, nil), "")
+        if err != nil || opts.interval != tt.want {
+            t.Errorf("%s: interval %v, %v; want %v", tt.query, opts.interval, err, tt.want)
+        }
+    }
+    for _, bad := range []string{"eventsPerSecond=10&intervalMs=100", "eventsPerSecond=0", "eventsPerSecond=x"} {
+        if code, _ := recordStream(streamHandler, "/stream?limit=1&"+bad, nil); code != http.StatusBadRequest {
+            t.Errorf("%s: status %d, want 400", bad, code)
+        }
+    }
+}
+
+func TestBurstArrivesAtOnce(t *testing.T) {
+    srv := newStreamServer(t)
+    start := time.Now()
+    resp := openStream(t, srv, "/stream?intervalMs=300&burst=20")
+    got, err := scanSSE(resp.Body, 20)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if d := time.Since(start); d > 100*time.Millisecond {
+        t.Errorf("20 burst events took %v", d)
+    }
+    if ids := eventIDs(got); len(ids) != 20 || ids[0] != "0" || ids[19] != "19" {
+        t.Fatalf("burst ids %v, want 0 to 19", ids)
+    }
+    // Then pacing resumes.
+    next, err := scanSSE(resp.Body, 1)
+    if err != nil || len(next) != 1 || next[0].ID != "20" {
+        t.Fatalf("after the burst: %+v, %v", next, err)
+    }
+    if d := time.Since(start); d < 250*time.Millisecond {
+        t.Errorf("event after the burst came at %v, want one interval in", d)
+    }
+}
+
+func TestBurstCountsAgainstLimit(t *testing.T) {
+    code, events := recordStream(streamHandler, "/stream?intervalMs=60000&burst=5&limit=3&send_eof=true", nil)
+    if ids := eventIDs(events); code != http.StatusOK || !slices.Equal(ids, []string{"0", "1", "2", ""}) || events[3].Event != "eof" {
+        t.Errorf("status %d, events %+v; want 0 to 2 and eof", code, events)
+    }
+
+    t.Setenv("MAX_BURST", "2")
+    opts, err := parseStreamOpts(httptest.NewRequest(http.MethodGet, "/stream?burst=5", nil), "")
+    if err != nil || opts.burst != 2 {
+        t.Errorf("burst=5 with MAX_BURST=2: %d, %v", opts.burst, err)
+    }
+}
+
+// useMaxEventBytes sets MAX_EVENT_BYTES for the rest of the test.
+func useMaxEventBytes(t *testing.T, n int) {
+    t.Helper()
+    old := maxEventBytes
+    maxEventBytes = n
+    t.Cleanup(func() { maxEventBytes = old })
+}
+
+func TestMaxEventBytesDropsPublishedEvents(t *testing.T) {
+    useMaxEventBytes(t, 100)
+    m := useMetrics(t)
+    buf := captureLog(t)
+    srv := newStreamServer(t)
+    topic := uniqueTopic("sized")
+    resp := openStream(t, srv, "/stream/"+topic+"?numbers=false")
+    b, _ := topics.get(topic)
+    waitFor(t, "the subscriber", func() bool { return b.Subscribers() == 1 })
+
+    b.Publish(SSEEvent{Event: "big", Data: strings.Repeat("x", 101)})
+    b.Publish(SSEEvent{Event: "fits", Data: strings.Repeat("x", 100)})
+    got, err := scanSSE(resp.Body, 1)
+    if err != nil || len(got) != 1 || got[0].Event != "fits" {
+        t.Fatalf("first event %+v, %v; want the 100-byte one", got, err)
+    }
+    if rec := logRecord(t, buf, "event dropped"); rec["bytes"] != 101.0 || rec["max_bytes"] != 100.0 {
+        t.Errorf("drop logged as %v", rec)
+    }
+    if got := m.eventsDropped.Value(); got != 1 {
+        t.Errorf("events dropped = %d, want 1", got)
+    }
+}
+
+func TestMaxEventBytesDropsReplayedEvents(t *testing.T) {
+    useMaxEventBytes(t, 100)
+    m := useMetrics(t)
+    srv := newStreamServer(t)
+    big := strings.Repeat("x", 101)
+
+    // Events missed since Last-Event-ID.
+    topic := uniqueTopic("sized")
+    b, _ := topics.get(topic)
+    b.Publish(SSEEvent{Data: "before"})
+    b.Publish(SSEEvent{Event: "big", Data: big})
+    b.Publish(SSEEvent{Event: "fits", Data: "ok"})
+    time.Sleep(20 * time.Millisecond)
+    got := readSSE(t, srv, "/stream/"+topic+"?numbers=false", http.Header{"Last-Event-ID": {"1"}}, 1)
+    if got[0].Event != "fits" {
+        t.Errorf("resumed with %+v, want the fitting event", got[0])
+    }
+
+    // The canned events of /stream/replay.
+    events := url.QueryEscape(`{"event":"big","data":"` + big + `"},{"event":"fits","data":"ok"}`)
+    code, replayed := recordStream(replayHandler, "/stream/replay?intervalMs=1&events="+events, nil)
+    if code != http.StatusOK || len(replayed) != 1 || replayed[0].Event != "fits" {
+        t.Errorf("replay: status %d, events %+v; want only the fitting one", code, replayed)
+    }
+    if got := m.eventsDropped.Value(); got != 2 {
+        t.Errorf("events dropped = %d, want 2", got)
+    }
+}
+
+func TestModuloThinsNumbers(t *testing.T) {
+    tests := []struct {
+        query string
+        want  []string
+    }{
+        {"&modulo=1", []string{"0", "1", "2", "3"}},
+        {"&modulo=2", []string{"0", "2", "4", "6"}},
+        // The first number is skipped when start is not a multiple.
+        {"&modulo=2&start=3", []string{"4", "6", "8", "10"}},
+        {"&modulo=3&start=3", []string{"3", "6", "9", "12"}},
+    }
+    for _, tt := range tests {
+        // limit=4 counts the numbers sent, not the ones skipped.
+        code, events := recordStream(streamHandler, "/stream?intervalMs=1&limit=4&send_eof=false"+tt.query, nil)
+        if got := eventIDs(events); code != http.StatusOK || !slices.Equal(got, tt.want) {
+            t.Errorf("%q: status %d, ids %v; want %v", tt.query, code, got, tt.want)
+        }
+    }
+    for _, bad := range []string{"0", "-1", "x"} {
+        if code, _ := recordStream(streamHandler, "/stream?limit=1&modulo="+bad, nil); code != http.StatusBadRequest {
+            t.Errorf("modulo=%s: status %d, want 400", bad, code)
+        }
+    }
+}
+
+func TestResumePastHistorySendsReset(t *testing.T) {
+    srv := newStreamServer(t)
+    topic := uniqueTopic("evicted")
+    b, _ := topics.get(topic)
+    // TestMain keeps 512 events, so 1-88 are evicted by 600.
+    for i := 1; i <= 600; i++ {
+        b.Publish(SSEEvent{Data: fmt.Sprint(i)})
+    }
+    waitFor(t, "600 published", func() bool {
+        ch, missed, _ := b.Resume(599)
+        b.Unsubscribe(ch)
+        return len(missed) == 1
+    })
+
+    got := readSSE(t, srv, "/stream/"+topic+"?intervalMs=60000", http.Header{"Last-Event-ID": {"t5"}}, 2)
+    if got[0].Event != "reset" || got[0].Data != `{"lastEventId":5}` {
+        t.Errorf("first event %+v, want reset for 5", got[0])
+    }
+    if got[1].ID != "t89" {
+        t.Errorf("first replayed id %q, want t89, the oldest kept", got[1].ID)
+    }
+}
+
+// limitStreams sets MAX_CONNECTIONS to n for the rest of the test.
+func limitStreams(t *testing.T, n int) {
+    t.Helper()
+    old := streamSlots
+    streamSlots = make(chan struct{}, n)
+    t.Cleanup(func() { streamSlots = old })
+}
+
+func TestMaxConnectionsRejectsExtraStream(t *testing.T) {
+    const max = 3
+    limitStreams(t, max)
+    srv := newStreamServer(t)
+    var open []*http.Response
+    for i := 0; i < max; i++ {
+        open = append(open, openStream(t, srv, "/stream?intervalMs=60000"))
+    }
+
+    resp, err := http.Get(srv.URL + "/stream?intervalMs=60000")
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusServiceUnavailable || strings.TrimSpace(string(body)) != "too many connections" {
+        t.Fatalf("stream %d: status %d %q, want 503 too many connections", max+1, resp.StatusCode, body)
+    }
+    if ct := resp.Header.Get("Content-Type"); strings.HasPrefix(ct, "text/event-stream") {
+        t.Error("rejection was sent with SSE headers")
+    }
+
+    // Closing a stream frees its slot.
+    open[0].Body.Close()
+    waitFor(t, "a free slot", func() bool { return len(streamSlots) < max })
+    openStream(t, srv, "/stream?intervalMs=60000")
+}
+
+func TestMaxConnectionsConcurrent(t *testing.T) {
+    const max = 4
+    limitStreams(t, max)
+    t.Setenv("STATS_TOKEN", "st")
+    srv := newStreamServer(t)
+
+    type result struct {
+        resp *http.Response
+        err  error
+    }
+    results := make(chan result, max+1)
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    for i := 0; i < max+1; i++ {
+        go func() {
+            req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/stream?intervalMs=60000", nil)
+            resp, err := http.DefaultClient.Do(req)
+            results <- result{resp, err}
+        }()
+    }
+    var rejected []*http.Response
+    for i := 0; i < max+1; i++ {
+        r := <-results
+        if r.err != nil {
+            t.Fatal(r.err)
+        }
+        defer r.resp.Body.Close()
+        if r.resp.StatusCode != http.StatusOK {
+            rejected = append(rejected, r.resp)
+        }
+    }
+    if len(rejected) != 1 || rejected[0].StatusCode != http.StatusServiceUnavailable || rejected[0].Header.Get("Retry-After") != strconv.Itoa(connLimitRetryAfterSec) {
+        for _, r := range rejected {
+            t.Errorf("rejected: %d, Retry-After %q", r.StatusCode, r.Header.Get("Retry-After"))
+        }
+        t.Fatalf("%d of %d streams rejected, want 1 with 503 and Retry-After", len(rejected), max+1)
+    }
+
+    if _, s := getStats(t, "st"); s.MaxConnections != max || s.SlotsInUse != max {
+        t.Errorf("/stats max_connections %d, slots_in_use %d; want %d and %d", s.MaxConnections, s.SlotsInUse, max, max)
+    }
+    // Clients going away free every slot.
+    cancel()
+    waitFor(t, "all slots freed", func() bool { return len(streamSlots) == 0 })
+}
+
+func TestSlotFreedAfterWriteError(t *testing.T) {
+    limitStreams(t, 1)
+    m := useMetrics(t)
+    t.Setenv("WRITE_TIMEOUT_MS", "50")
+    server, client := net.Pipe()
+    defer client.Close()
+    srv := &http.Server{Handler: http.HandlerFunc(streamHandler)}
+    go srv.Serve(listenOn(server))
+    defer srv.Close()
+
+    // Nobody reads the client end, so the first write times out.
+    if _, err := io.WriteString(client, "GET /stream?intervalMs=10 HTTP/1.1\r\nHost: x\r\n\r\n"); err != nil {
+        t.Fatal(err)
+    }
+    waitFor(t, "the write to fail", func() bool { return m.writeErrors.Value() > 0 })
+    waitFor(t, "the slot freed", func() bool { return len(streamSlots) == 0 })
+}
+
+// pushRecorder is a recorder that supports HTTP/2 server push.
+type pushRecorder struct {
+    *httptest.ResponseRecorder
+    pushed []string
+    opts   []*http.PushOptions
+}
+
+func (p *pushRecorder) Push(target string, opts *http.PushOptions) error {
+    p.pushed = append(p.pushed, target)
+    p.opts = append(p.opts, opts)
+    return nil
+}
+
+func TestStreamPushesRelated(t *testing.T) {
+    rec := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+    streamHandler(rec, httptest.NewRequest(http.MethodGet, "/stream?intervalMs=1&limit=3&related=/stream/orders", nil))
+    if !slices.Equal(rec.pushed, []string{"/stream/orders"}) {
+        t.Fatalf("pushed %v, want /stream/orders once", rec.pushed)
+    }
+    if got := rec.opts[0].Header.Get("Accept"); got != "text/event-stream" {
+        t.Errorf("push Accept %q", got)
+    }
+
+    rec = &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+    streamHandler(rec, httptest.NewRequest(http.MethodGet, "/stream?intervalMs=1&limit=1", nil))
+    if len(rec.pushed) != 0 {
+        t.Errorf("pushed %v without related", rec.pushed)
+    }
+}
+
+func TestTryPushRelatedStream(t *testing.T) {
+    for _, url := range []string{"https://evil.example/x", "//evil.example/x", "stream"} {
+        rec := &pushRecorder{ResponseRecorder: httptest.NewRecorder()}
+        if err := tryPushRelatedStream(rec, url); err == nil || len(rec.pushed) != 0 {
+            t.Errorf("%q: err %v, pushed %v; want refused", url, err, rec.pushed)
+        }
+    }
+    if err := tryPushRelatedStream(httptest.NewRecorder(), "/stream"); !errors.Is(err, http.ErrNotSupported) {
+        t.Errorf("without push support: err %v, want http.ErrNotSupported", err)
+    }
+}
+
+func TestSlowClientIsDropped(t *testing.T) {
+    t.Setenv("WRITE_TIMEOUT_MS", "50")
+    // The client keeps up for the first keepUp bytes, then reads a byte at
+    // a time and far too slowly.
+    for _, keepUp := range []int64{0, 2048} {
+        logs := captureLog(t)
+        server, client := net.Pipe()
+        returned := make(chan struct{})
+        srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            streamHandler(w, r)
+            close(returned)
+        })}
+        go srv.Serve(listenOn(server))
+
+        if _, err := io.WriteString(client, "GET /stream?intervalMs=1 HTTP/1.1\r\nHost: x\r\n\r\n"); err != nil {
+            t.Fatal(err)
+        }
+        go func() {
+            if _, err := io.CopyN(io.Discard, client, keepUp); err != nil {
+                return
+            }
+            b := make([]byte, 1)
+            for {
+                if _, err := client.Read(b); err != nil {
+                    return
+                }
+                time.Sleep(200 * time.Millisecond)
+            }
+        }()
+        select {
+        case <-returned:
+        case <-time.After(3 * time.Second):
+            t.Fatalf("keepUp %d: handler still serving a client that cannot keep up", keepUp)
+        }
+        srv.Close()
+        client.Close()
+        rec := logRecord(t, logs, "stream closed")
+        if rec["reason"] != "write_timeout" || rec["level"] != "ERROR" || (rec["events"] == float64(0)) != (keepUp == 0) {
+            t.Errorf("keepUp %d: stream closed log %v, want an error with reason write_timeout", keepUp, rec)
+        }
+    }
+}
+
+func TestTypesFilter(t *testing.T) {
+    srv := newStreamServer(t)
+    topic := uniqueTopic("parity")
+    resp := openStream(t, srv, "/stream/"+topic+"?numbers=false&types=even")
+    b, _ := topics.get(topic)
+    waitFor(t, "subscriber", func() bool { return b.Subscribers() == 1 })
+    for i := 1; i <= 6; i++ {
+        name := "odd"
+        if i%2 == 0 {
+            name = "even"
+        }
+        b.Publish(SSEEvent{Event: name, Data: strconv.Itoa(i)})
+    }
+    b.Publish(SSEEvent{Data: "unnamed"})
+    b.Publish(SSEEvent{Event: "even", Data: "last"})
+    got, err := scanSSE(resp.Body, 4)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var data []string
+    for _, e := range got {
+        if e.Event != "even" {
+            t.Errorf("filtered stream sent %+v", e)
+        }
+        data = append(data, e.Data)
+    }
+    if want := []string{"2", "4", "6", "last"}; !slices.Equal(data, want) {
+        t.Errorf("data %v, want %v", data, want)
+    }
+}
+
+func TestTypesFilterEmptyAndMessage(t *testing.T) {
+    for _, tt := range []struct {
+        types string
+        e     SSEEvent
+        want  bool
+    }{
+        {"", SSEEvent{Event: "odd"}, true},
+        {"even", SSEEvent{Event: "odd"}, false},
+        {"even, odd", SSEEvent{Event: "odd"}, true},
+        {"message", SSEEvent{}, true},
+        {"even", SSEEvent{}, false},
+    } {
+        opts, err := parseStreamOpts(httptest.NewRequest(http.MethodGet, "/stream?types="+url.QueryEscape(tt.types), nil), "")
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got := opts.wants(tt.e); got != tt.want {
+            t.Errorf("types=%q, event %q: wants = %v, want %v", tt.types, tt.e.Event, got, tt.want)
+        }
+    }
+    // Control events are not subject to the filter.
+    got := readSSE(t, newStreamServer(t), "/stream?intervalMs=1&limit=2&types=nothing&send_eof=true", nil, 1)
+    if got[0].Event != "eof" {
+        t.Errorf("first event %+v, want eof", got[0])
+    }
+}
+
+func TestStreamJSON(t *testing.T) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/stream/json", streamJSONHandler)
+    srv := httptest.NewServer(mux)
+    t.Cleanup(srv.Close)
+
+    for i, e := range readSSE(t, srv, "/stream/json?intervalMs=1&limit=3&start=5", nil, 3) {
+        var tick map[string]any
+        if err := json.Unmarshal([]byte(e.Data), &tick); err != nil || e.Event != "tick" || len(tick) != 3 {
+            t.Fatalf("event %+v, want a tick of seq, ts and value", e)
+        }
+        if _, err := time.Parse(time.RFC3339Nano, tick["ts"].(string)); err != nil {
+            t.Errorf("tick ts: %v", err)
+        }
+        if seq := strconv.Itoa(int(tick["seq"].(float64))); seq != e.ID || tick["value"] != float64(5+i) {
+            t.Errorf("event %+v, want seq %s and value %d", e, e.ID, 5+i)
+        }
+    }
+
+    // Published events keep their data, wrapped in the envelope whose seq
+    // is the ID the broker gave them.
+    b, _ := topics.get(defaultTopic)
+    before := b.Subscribers()
+    resp := openStream(t, srv, "/stream/json?intervalMs=60000&format=json&types=order")
+    waitFor(t, "the subscriber", func() bool { return b.Subscribers() > before })
+    b.Publish(SSEEvent{Event: "order", Data: "o-1"})
+    got, err := scanSSE(resp.Body, 1)
+    if err != nil || len(got) != 1 {
+        t.Fatalf("published events %+v, %v", got, err)
+    }
+    var env envelope
+    if err := json.Unmarshal([]byte(got[0].Data), &env); err != nil || env.Data != "o-1" || topicIDPrefix+strconv.Itoa(env.Seq) != got[0].ID {
+        t.Errorf("published event %+v, want its data in an envelope with the broker ID as seq", got[0])
+    }
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math/rand/v2"
+    "strconv"
+)
+
+// syntheticAlphabet is what synthetic payloads are made of: printable ASCII
+// without the line breaks SSE would split data on.
+const syntheticAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// maxPayloadBytes is MAX_PAYLOAD_BYTES, the largest payloadBytes accepted.
+func maxPayloadBytes() int {
+    v, err := strconv.Atoi(getEnv("MAX_PAYLOAD_BYTES", "1048576"))
+    if err != nil || v < 1 {
+        return 1048576
+    }
+    return v
+}
+
+// syntheticSource sends "payload" events of opts.payloadBytes pseudo-random
+// ASCII characters, paced and numbered like the number feed, for
+// benchmarking what sits between the server and its clients. Each payload
+// depends only on opts.seed and the event's sequence number, so clients
+// using the same seed, including ones that resumed, receive the same data
+// for the same ID and can compare what arrived.
+type syntheticSource struct{}
+
+func (syntheticSource) checkOpts(opts streamOpts) error {
+    if limit := maxPayloadBytes(); opts.payloadBytes > limit {
+        return fmt.Errorf("invalid payloadBytes: %d exceeds MAX_PAYLOAD_BYTES (%d)", opts.payloadBytes, limit)
+    }
+    // Larger payloads would all be dropped.
+    if maxEventBytes > 0 && opts.payloadBytes > maxEventBytes {
+        return fmt.Errorf("invalid payloadBytes: %d exceeds MAX_EVENT_BYTES (%d)", opts.payloadBytes, maxEventBytes)
+    }
+    return nil
+}
+
+func (syntheticSource) Run(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error {
+    buf := make([]byte, opts.payloadBytes)
+    err := generate(ctx, opts, func(seq int) error {
+        rng := rand.New(rand.NewPCG(uint64(opts.seed), uint64(seq)))
+        for i := range buf {
+            buf[i] = syntheticAlphabet[rng.IntN(len(syntheticAlphabet))]
+        }
+        e := SSEEvent{ID: strconv.Itoa(seq), Event: "payload", Data: string(buf)}
+        if opts.event != "" {
+            e.Event = opts.event
+        }
+        return emitEvent(ctx, out, e)
+    })
+    if errors.Is(err, errStreamComplete) {
+        return nil
+    }
+    return err
+}
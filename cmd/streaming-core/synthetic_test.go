@@ -0,0 +1,68 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestSyntheticPayloadsAreDeterministic(t *testing.T) {
+    srv := newStreamServer(t)
+    a := readSSE(t, srv, "/stream?source=synthetic&payloadBytes=64&seed=7&intervalMs=1&limit=3", nil, 3)
+    b := readSSE(t, srv, "/stream?source=synthetic&payloadBytes=64&seed=7&intervalMs=1&limit=2", http.Header{"Last-Event-ID": {"0"}}, 2)
+    if a[1] != b[0] || a[2] != b[1] {
+        t.Errorf("same seed and IDs, different payloads:\n%+v\n%+v", a[1:], b)
+    }
+    for _, e := range a {
+        if len(e.Data) != 64 || strings.ContainsAny(e.Data, "\r\n") {
+            t.Errorf("payload %q: want 64 bytes without line breaks", e.Data)
+        }
+    }
+    c := readSSE(t, srv, "/stream?source=synthetic&payloadBytes=64&seed=8&intervalMs=1&limit=1", nil, 1)
+    if c[0].Data == a[0].Data {
+        t.Error("different seeds, same payload")
+    }
+}
+
+func TestSyntheticPayloadBytesLimits(t *testing.T) {
+    t.Setenv("MAX_PAYLOAD_BYTES", "1000")
+    useMaxEventBytes(t, 100)
+    for q, want := range map[string]int{
+        "payloadBytes=100":  http.StatusOK,
+        "payloadBytes=101":  http.StatusBadRequest,
+        "payloadBytes=1001": http.StatusBadRequest,
+    } {
+        r := httptest.NewRequest(http.MethodGet, "/stream?source=synthetic&limit=1&intervalMs=1&"+q, nil)
+        rr := httptest.NewRecorder()
+        streamHandler(rr, r)
+        if rr.Code != want {
+            t.Errorf("%s: status %d, want %d", q, rr.Code, want)
+        }
+    }
+}
+
+func TestOversizedFeedEventsAreDropped(t *testing.T) {
+    useMaxEventBytes(t, 100)
+    useSource(t, "sized", SourceFunc(func(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error {
+        for _, e := range []SSEEvent{{ID: "1", Data: "a"}, {ID: "2", Data: strings.Repeat("x", 101)}, {ID: "3", Data: "b"}} {
+            if err := emitEvent(ctx, out, e); err != nil {
+                return err
+            }
+        }
+        return nil
+    }))
+    srv := newStreamServer(t)
+    // The dropped event is left out of the totals.
+    got := readSSE(t, srv, "/stream?source=sized&summary=true&send_eof=true", nil, 4)
+    if got[0].ID != "1" || got[1].ID != "3" {
+        t.Errorf("events %+v, want 1 and 3", got[:2])
+    }
+    if got[2].Event != "done" || got[2].Data != `{"total":2}` {
+        t.Errorf("summary %+v, want total 2", got[2])
+    }
+    if got[3].Event != "eof" || got[3].Data != `{"reason":"source_ended","total":2}` {
+        t.Errorf("eof %+v, want source_ended with total 2", got[3])
+    }
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// tailSource streams the lines appended to a file as "line" events:
+// TAIL_FILE, or the file param naming a file in TAIL_DIR. Each file is
+// followed by one tailer shared by every stream, which numbers its lines and
+// keeps the recent ones for Last-Event-ID resume.
+type tailSource struct {
+    file string
+    dir  string
+    // root is dir with symlinks resolved; files served from dir must
+    // resolve to a path under it.
+    root    string
+    cfg     brokerConfig
+    poll    time.Duration
+    maxLine int
+    log     *slog.Logger
+
+    mu      sync.Mutex
+    tailers map[string]*tailer
+}
+
+// tailSourceFromEnv reads TAIL_FILE, TAIL_DIR, TAIL_POLL_MS and
+// TAIL_MAX_LINE_BYTES. It returns nil when neither TAIL_FILE nor TAIL_DIR is
+// set. TAIL_FILE is followed from startup, so its lines are buffered for
+// replay before the first client connects.
+func tailSourceFromEnv(cfg brokerConfig, logger *slog.Logger) (*tailSource, error) {
+    s := &tailSource{
+        file:    getEnv("TAIL_FILE", ""),
+        dir:     getEnv("TAIL_DIR", ""),
+        cfg:     cfg,
+        log:     logger,
+        tailers: make(map[string]*tailer),
+    }
+    if s.file == "" && s.dir == "" {
+        return nil, nil
+    }
+    pollMs, err := strconv.Atoi(getEnv("TAIL_POLL_MS", "250"))
+    if err != nil || pollMs < 10 {
+        return nil, errors.New("invalid TAIL_POLL_MS: must be an integer >= 10")
+    }
+    s.poll = time.Duration(pollMs) * time.Millisecond
+    if s.maxLine, err = strconv.Atoi(getEnv("TAIL_MAX_LINE_BYTES", "65536")); err != nil || s.maxLine < 1 {
+        return nil, errors.New("invalid TAIL_MAX_LINE_BYTES: must be an integer >= 1")
+    }
+    if s.dir != "" {
+        if fi, err := os.Stat(s.dir); err != nil || !fi.IsDir() {
+            return nil, fmt.Errorf("TAIL_DIR %s is not a directory", s.dir)
+        }
+        if s.root, err = filepath.EvalSymlinks(s.dir); err != nil {
+            return nil, fmt.Errorf("TAIL_DIR %s: %w", s.dir, err)
+        }
+    }
+    if s.file != "" {
+        s.tailer(s.file)
+    }
+    return s, nil
+}
+
+// checkOpts rejects a stream with no file to tail and a file param that is
+// not an existing file in TAIL_DIR. Requiring the file to exist bounds the
+// tailers clients can start by the files in TAIL_DIR. A symlink in TAIL_DIR
+// is followed only if it resolves to a file inside TAIL_DIR, so one
+// pointing at, say, /etc/passwd cannot be read through the stream.
+func (s *tailSource) checkOpts(opts streamOpts) error {
+    if opts.file == "" {
+        if s.file == "" {
+            return errors.New("missing file: TAIL_FILE is not set")
+        }
+        return nil
+    }
+    if s.dir == "" {
+        return errors.New("invalid file: TAIL_DIR is not set")
+    }
+    if !filepath.IsLocal(opts.file) {
+        return fmt.Errorf("invalid file: %q is not a path inside TAIL_DIR", opts.file)
+    }
+    resolved, err := resolveInside(s.root, filepath.Join(s.dir, opts.file))
+    if err != nil {
+        return fmt.Errorf("invalid file: %q is not a file in TAIL_DIR", opts.file)
+    }
+    if fi, err := os.Stat(resolved); err != nil || !fi.Mode().IsRegular() {
+        return fmt.Errorf("invalid file: %q is not a file in TAIL_DIR", opts.file)
+    }
+    return nil
+}
+
+// errOutsideRoot means a path resolved to somewhere outside its root.
+var errOutsideRoot = errors.New("path resolves outside the tailed directory")
+
+// resolveInside resolves the symlinks in path and returns the result if it
+// lies under root, itself already resolved.
+func resolveInside(root, path string) (string, error) {
+    resolved, err := filepath.EvalSymlinks(path)
+    if err != nil {
+        return "", err
+    }
+    if rel, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(rel) {
+        return "", errOutsideRoot
+    }
+    return resolved, nil
+}
+
+// tailer returns the tailer following path, starting it on first use.
+func (s *tailSource) tailer(path string) *tailer {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if t, ok := s.tailers[path]; ok {
+        return t
+    }
+    t := &tailer{path: path, broker: newBroker(s.cfg), poll: s.poll, maxLine: s.maxLine, log: s.log.With(slog.String("file", path))}
+    if path != s.file {
+        t.root = s.root
+    }
+    s.tailers[path] = t
+    go t.run()
+    return t
+}
+
+// Run sends the file's lines from the resume point, or those appended from
+// now on, until limit lines were sent or ctx is done.
+func (s *tailSource) Run(ctx context.Context, opts streamOpts, out chan<- SSEEvent) error {
+    path := s.file
+    if opts.file != "" {
+        path = filepath.Join(s.dir, opts.file)
+    }
+    return relayBroker(ctx, s.tailer(path).broker, opts, out, nil)
+}
+
+// tailer follows one file by polling it, publishing each complete line to
+// its broker. It handles the file not existing yet (its lines are read from
+// the start once it appears), truncation (reading restarts at the top) and
+// rotation, i.e. path naming a new file (the old one is read to the end
+// first).
+type tailer struct {
+    path string
+    // root, when set, is the resolved TAIL_DIR path must stay inside, also
+    // when it is reopened after rotation.
+    root    string
+    broker  *Broker
+    poll    time.Duration
+    maxLine int
+    log     *slog.Logger
+
+    f      *os.File
+    fi     os.FileInfo
+    offset int64
+    // partial holds a line whose newline has not been written yet.
+    partial []byte
+    // overlong is set while skipping the rest of a line cut at maxLine.
+    overlong bool
+    // refused is set while path resolves outside root, so that is logged
+    // once rather than every poll.
+    refused bool
+    // lines counts the lines published.
+    lines atomic.Int64
+}
+
+func (t *tailer) run() {
+    buf := make([]byte, 32<<10)
+    t.open(true)
+    for {
+        if t.f != nil {
+            t.readAll(buf)
+            t.checkRotation()
+        } else {
+            t.open(false)
+        }
+        time.Sleep(t.poll)
+    }
+}
+
+// open opens the file, at its end when atEnd is set, so what was written
+// before tailing began is not sent.
+func (t *tailer) open(atEnd bool) {
+    path := t.path
+    if t.root != "" {
+        resolved, err := resolveInside(t.root, t.path)
+        if errors.Is(err, errOutsideRoot) {
+            if !t.refused {
+                t.log.Warn("tail open refused", slog.Any("error", err))
+            }
+            t.refused = true
+            return
+        }
+        if err != nil {
+            if !errors.Is(err, os.ErrNotExist) {
+                t.log.Warn("tail open failed", slog.Any("error", err))
+            }
+            return
+        }
+        path, t.refused = resolved, false
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        if !errors.Is(err, os.ErrNotExist) {
+            t.log.Warn("tail open failed", slog.Any("error", err))
+        }
+        return
+    }
+    fi, err := f.Stat()
+    if err != nil {
+        f.Close()
+        t.log.Warn("tail stat failed", slog.Any("error", err))
+        return
+    }
+    t.f, t.fi, t.offset = f, fi, 0
+    if atEnd {
+        t.offset, _ = f.Seek(0, io.SeekEnd)
+    }
+    t.log.Info("tailing file", slog.Int64("offset", t.offset))
+}
+
+// readAll reads what was appended since the last poll.
+func (t *tailer) readAll(buf []byte) {
+    for {
+        n, err := t.f.Read(buf)
+        t.offset += int64(n)
+        t.consume(buf[:n])
+        if err != nil {
+            if !errors.Is(err, io.EOF) {
+                t.log.Warn("tail read failed", slog.Any("error", err))
+            }
+            return
+        }
+    }
+}
+
+// checkRotation reopens the file when path now names a different file and
+// rewinds when it shrank below what was read.
+func (t *tailer) checkRotation() {
+    fi, err := os.Stat(t.path)
+    switch {
+    case err != nil || !os.SameFile(t.fi, fi):
+        // Rotated or removed: what was read of the old file is complete,
+        // so its unterminated last line is sent as is.
+        if len(t.partial) > 0 {
+            t.publishLine()
+        }
+        t.overlong = false
+        t.f.Close()
+        t.f = nil
+        t.log.Info("tailed file rotated")
+        if err == nil {
+            t.open(false)
+        }
+    case fi.Size() < t.offset:
+        t.log.Info("tailed file truncated")
+        t.partial, t.overlong = t.partial[:0], false
+        t.offset, _ = t.f.Seek(0, io.SeekStart)
+    }
+}
+
+// consume splits b into lines, keeping an unterminated tail for the next
+// read. Lines longer than maxLine are cut, the rest up to the newline being
+// dropped.
+func (t *tailer) consume(b []byte) {
+    for len(b) > 0 {
+        i := bytes.IndexByte(b, '\n')
+        chunk := b
+        if i >= 0 {
+            chunk = b[:i]
+        }
+        if !t.overlong {
+            room := t.maxLine - len(t.partial)
+            if len(chunk) > room {
+                t.partial = append(t.partial, chunk[:room]...)
+                t.log.Warn("line too long; truncated", slog.Int("max_bytes", t.maxLine))
+                t.publishLine()
+                t.overlong = true
+            } else {
+                t.partial = append(t.partial, chunk...)
+            }
+        }
+        if i < 0 {
+            return
+        }
+        if !t.overlong {
+            t.publishLine()
+        }
+        t.overlong = false
+        b = b[i+1:]
+    }
+}
+
+// publishLine publishes partial as a line and empties it.
+func (t *tailer) publishLine() {
+    line := string(bytes.TrimSuffix(t.partial, []byte("\r")))
+    t.partial = t.partial[:0]
+    t.broker.Publish(SSEEvent{Event: "line", Data: line})
+    t.lines.Add(1)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+    "log/slog"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func newTestTailSource(t *testing.T, dir string) *tailSource {
+    t.Helper()
+    t.Setenv("TAIL_DIR", dir)
+    t.Setenv("TAIL_POLL_MS", "10")
+    s, err := tailSourceFromEnv(brokerConfig{history: 16, buffer: 16, policy: dropNewest}, slog.Default())
+    if err != nil {
+        t.Fatal(err)
+    }
+    return s
+}
+
+func TestTailCheckOptsSymlinks(t *testing.T) {
+    dir, outside := t.TempDir(), t.TempDir()
+    secret := filepath.Join(outside, "secret")
+    os.WriteFile(secret, []byte("x\n"), 0o600)
+    os.WriteFile(filepath.Join(dir, "app.log"), nil, 0o600)
+    os.Mkdir(filepath.Join(dir, "sub"), 0o700)
+    if err := os.Symlink(secret, filepath.Join(dir, "escape")); err != nil {
+        t.Skip("symlinks unsupported:", err)
+    }
+    os.Symlink("app.log", filepath.Join(dir, "current"))
+    os.Symlink(outside, filepath.Join(dir, "outdir"))
+    s := newTestTailSource(t, dir)
+
+    for file, ok := range map[string]bool{
+        "app.log":       true,
+        "current":       true,
+        "escape":        false,
+        "outdir/secret": false,
+        "sub":           false,
+        "missing":       false,
+        "../secret":     false,
+    } {
+        err := s.checkOpts(streamOpts{file: file})
+        if (err == nil) != ok {
+            t.Errorf("checkOpts(%q) = %v, want ok %v", file, err, ok)
+        }
+    }
+}
+
+func TestTailReopenStaysInsideDir(t *testing.T) {
+    dir, outside := t.TempDir(), t.TempDir()
+    path := filepath.Join(dir, "app.log")
+    os.WriteFile(path, nil, 0o600)
+    secret := filepath.Join(outside, "secret")
+    os.WriteFile(secret, []byte("secret\n"), 0o600)
+    s := newTestTailSource(t, dir)
+    if err := s.checkOpts(streamOpts{file: "app.log"}); err != nil {
+        t.Fatal(err)
+    }
+    tl := s.tailer(path)
+    events := tl.broker.Subscribe()
+    defer tl.broker.Unsubscribe(events)
+    time.Sleep(50 * time.Millisecond)
+
+    // Rotate app.log into a symlink pointing outside TAIL_DIR.
+    os.Remove(path)
+    if err := os.Symlink(secret, path); err != nil {
+        t.Skip("symlinks unsupported:", err)
+    }
+    select {
+    case e := <-events:
+        t.Fatalf("tailer read %q through a symlink out of TAIL_DIR", e.Data)
+    case <-time.After(200 * time.Millisecond):
+    }
+}
+
+// startTailer starts a tailer on path cutting lines at maxLine and, if path
+// exists, waits for it to open it. Its lines are read from the returned
+// channel, its log from the returned buffer.
+func startTailer(t *testing.T, path string, maxLine int) (<-chan SSEEvent, *logBuffer) {
+    t.Helper()
+    buf := &logBuffer{}
+    tl := &tailer{path: path, broker: newBroker(testBrokerConfig()), poll: 10 * time.Millisecond, maxLine: maxLine, log: slog.New(slog.NewJSONHandler(buf, nil))}
+    events := tl.broker.Subscribe()
+    go tl.run()
+    if _, err := os.Stat(path); err == nil {
+        waitFor(t, "the tailer to open the file", func() bool { return strings.Contains(buf.String(), "tailing file") })
+    }
+    return events, buf
+}
+
+func appendFile(t *testing.T, path, s string) {
+    t.Helper()
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+    if _, err := f.WriteString(s); err != nil {
+        t.Fatal(err)
+    }
+}
+
+// lineData returns the data of events.
+func lineData(events []SSEEvent) []string {
+    var data []string
+    for _, e := range events {
+        data = append(data, e.Data)
+    }
+    return data
+}
+
+// expectNoLine fails if a line arrives within 50ms.
+func expectNoLine(t *testing.T, events <-chan SSEEvent) {
+    t.Helper()
+    select {
+    case e := <-events:
+        t.Fatalf("unexpected line %q", e.Data)
+    case <-time.After(50 * time.Millisecond):
+    }
+}
+
+func TestTailPartialLines(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "app.log")
+    os.WriteFile(path, []byte("written before tailing\n"), 0o600)
+    events, _ := startTailer(t, path, 64)
+
+    appendFile(t, path, "one\ntw")
+    if got := receive(t, events, 1); got[0].Data != "one" {
+        t.Fatalf("first line %q, want one", got[0].Data)
+    }
+    // The unterminated line waits for its newline.
+    expectNoLine(t, events)
+    appendFile(t, path, "o\r\n")
+    if got := receive(t, events, 1); got[0].Data != "two" {
+        t.Errorf("completed line %q, want two", got[0].Data)
+    }
+}
+
+func TestTailTruncatesLongLines(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "app.log")
+    os.WriteFile(path, nil, 0o600)
+    events, buf := startTailer(t, path, 8)
+
+    appendFile(t, path, "0123456789abc\nshort\n0123")
+    got := lineData(receive(t, events, 2))
+    if strings.Join(got, ",") != "01234567,short" {
+        t.Errorf("lines %q, want the long one cut at 8 bytes", got)
+    }
+    // A line growing past the limit over several reads is cut as well,
+    // once.
+    appendFile(t, path, "4567")
+    time.Sleep(50 * time.Millisecond)
+    appendFile(t, path, "89\nnext\n")
+    got = lineData(receive(t, events, 2))
+    if strings.Join(got, ",") != "01234567,next" {
+        t.Errorf("lines %q, want the long one cut at 8 bytes", got)
+    }
+    if rec := logRecord(t, buf, "line too long; truncated"); rec["max_bytes"] != 8.0 || rec["level"] != "WARN" {
+        t.Errorf("truncation logged as %v", rec)
+    }
+}
+
+func TestTailFileMissingAtStartup(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "app.log")
+    events, _ := startTailer(t, path, 64)
+    expectNoLine(t, events)
+
+    // A file appearing later is read from its start.
+    os.WriteFile(path, []byte("first\nsecond\n"), 0o600)
+    if got := lineData(receive(t, events, 2)); strings.Join(got, ",") != "first,second" {
+        t.Errorf("lines %q, want first and second", got)
+    }
+}
+
+func TestTailRotation(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "app.log")
+    os.WriteFile(path, nil, 0o600)
+    events, _ := startTailer(t, path, 64)
+
+    t.Run("rename", func(t *testing.T) {
+        appendFile(t, path, "a\nlast")
+        if got := receive(t, events, 1); got[0].Data != "a" {
+            t.Fatalf("line %q, want a", got[0].Data)
+        }
+        // The old file is read to its end, unterminated last line
+        // included, before the new one is read from its start.
+        if err := os.Rename(path, path+".1"); err != nil {
+            t.Fatal(err)
+        }
+        os.WriteFile(path, []byte("b\n"), 0o600)
+        if got := lineData(receive(t, events, 2)); strings.Join(got, ",") != "last,b" {
+            t.Errorf("lines %q, want last then b", got)
+        }
+    })
+    t.Run("truncation", func(t *testing.T) {
+        appendFile(t, path, "c\nd\n")
+        receive(t, events, 2)
+        // The rewritten file is shorter than what was read, so it is read
+        // again from the top.
+        os.WriteFile(path, []byte("e\n"), 0o600)
+        if got := receive(t, events, 1); got[0].Data != "e" {
+            t.Errorf("line %q after truncation, want e", got[0].Data)
+        }
+    })
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+    "context"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "errors"
+    "log/slog"
+    "math/big"
+    "net"
+    "net/http"
+    "os"
+    "path/filepath"
+    "slices"
+    "strings"
+    "testing"
+    "time"
+
+    "golang.org/x/net/http2"
+)
+
+func TestServeTLSRejectsMissingCert(t *testing.T) {
+    // Reserve a free port, then leave it for the server to claim.
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := l.Addr().String()
+    l.Close()
+
+    missing := filepath.Join(t.TempDir(), "missing.pem")
+    for _, tt := range []struct{ cert, key, want string }{
+        {missing, missing, "missing.pem"},
+        {missing, "", "both a certificate and a key"},
+        {"", missing, "both a certificate and a key"},
+    } {
+        srv := withServer(addr, http.NotFoundHandler())
+        err := gracefulServeTLS(srv, tt.cert, tt.key, slog.Default())
+        if err == nil || !strings.Contains(err.Error(), tt.want) {
+            t.Errorf("cert %q, key %q: err = %v, want it to mention %q", tt.cert, tt.key, err, tt.want)
+        }
+        // Nothing fell back to plain HTTP on the port.
+        if c, err := net.Dial("tcp", addr); err == nil {
+            c.Close()
+            t.Fatalf("cert %q, key %q: something is listening on %s", tt.cert, tt.key, addr)
+        }
+    }
+    if ready.Load() {
+        t.Error("server reported ready without serving")
+    }
+}
+
+func TestWithServerTLSDefaults(t *testing.T) {
+    srv := withServer(":0", http.NotFoundHandler())
+    if srv.TLSConfig.MinVersion != tls.VersionTLS12 {
+        t.Errorf("MinVersion = %x, want TLS 1.2", srv.TLSConfig.MinVersion)
+    }
+    if !slices.Equal(srv.TLSConfig.NextProtos, []string{"h2", "http/1.1"}) {
+        t.Errorf("NextProtos = %v", srv.TLSConfig.NextProtos)
+    }
+    if srv.WriteTimeout != 0 {
+        t.Errorf("WriteTimeout = %v would cut off streams", srv.WriteTimeout)
+    }
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 with the
+// given common name into dir and returns the cert and key paths.
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{
+        SerialNumber:          big.NewInt(time.Now().UnixNano()),
+        Subject:               pkix.Name{CommonName: name},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+        BasicConstraintsValid: true,
+        IsCA:                  true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+    if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    return certFile, keyFile
+}
+
+// startTLSServer serves h over TLS with the key pair like main does, and
+// returns a client that trusts the certificate.
+func startTLSServer(t *testing.T, h http.Handler, certs *certStore) (*http.Server, string, *http.Client) {
+    t.Helper()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv := withServer(l.Addr().String(), h)
+    srv.TLSConfig.GetCertificate = certs.GetCertificate
+    go serve(srv, l, true)
+    t.Cleanup(func() { srv.Close() })
+
+    pool := x509.NewCertPool()
+    pemBytes, err := os.ReadFile(certs.certFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pool.AppendCertsFromPEM(pemBytes)
+    client := &http.Client{Transport: &http.Transport{
+        TLSClientConfig:   &tls.Config{RootCAs: pool},
+        ForceAttemptHTTP2: true,
+    }}
+    t.Cleanup(client.CloseIdleConnections)
+    return srv, "https://" + l.Addr().String(), client
+}
+
+func TestTLSStreamFlushesAndShutsDown(t *testing.T) {
+    isolateShutdown(t)
+    certs, err := newCertStore(writeTestCert(t, t.TempDir(), "test"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv, url, client := startTLSServer(t, streamTracker.Middleware(http.HandlerFunc(streamHandler)), certs)
+
+    resp, err := client.Get(url + "/stream?intervalMs=60000&burst=2")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if resp.ProtoMajor != 2 {
+        t.Errorf("negotiated %s, want HTTP/2", resp.Proto)
+    }
+    // The burst arrives while the stream stays open, so each event was
+    // flushed through TLS and HTTP/2 framing. Nothing follows until
+    // shutdown, so scanSSE cannot have read past them.
+    events, err := scanSSE(resp.Body, 2)
+    if err != nil || len(events) != 2 || events[1].ID != "1" {
+        t.Fatalf("read %+v, %v; want events 0 and 1", events, err)
+    }
+
+    body := drainBody(resp)
+    if err := shutdown(srv, 2*time.Second, slog.Default()); !errors.Is(err, http.ErrServerClosed) {
+        t.Fatalf("shutdown() = %v", err)
+    }
+    if got := <-body; !strings.Contains(got, "event: shutdown\n") || strings.Contains(got, "read error") {
+        t.Errorf("rest of stream %q, want the shutdown event and a clean end", got)
+    }
+}
+
+func TestSIGHUPReloadKeepsOpenStreams(t *testing.T) {
+    dir := t.TempDir()
+    certFile, keyFile := writeTestCert(t, dir, "old")
+    certs, err := newCertStore(certFile, keyFile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, url, client := startTLSServer(t, http.HandlerFunc(streamHandler), certs)
+
+    resp, err := client.Get(url + "/stream?intervalMs=20")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if _, err := scanSSE(resp.Body, 1); err != nil {
+        t.Fatal(err)
+    }
+
+    // Renew the pair in place, as certbot would, and send SIGHUP.
+    newCert, newKey := writeTestCert(t, t.TempDir(), "new")
+    for src, dst := range map[string]string{newCert: certFile, newKey: keyFile} {
+        b, err := os.ReadFile(src)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(dst, b, 0o600); err != nil {
+            t.Fatal(err)
+        }
+    }
+    reloadCerts(certs, slog.Default())
+
+    // The stream opened before the reload keeps its connection.
+    if _, err := scanSSE(resp.Body, 3); err != nil {
+        t.Fatalf("open stream after reload: %v", err)
+    }
+    if cn := resp.TLS.PeerCertificates[0].Subject.CommonName; cn != "old" {
+        t.Errorf("open stream certificate %q, want old", cn)
+    }
+
+    // A new connection gets the new certificate.
+    pool := x509.NewCertPool()
+    pemBytes, err := os.ReadFile(newCert)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pool.AppendCertsFromPEM(pemBytes)
+    fresh := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+    t.Cleanup(fresh.CloseIdleConnections)
+    resp2, err := fresh.Get(url + "/stream?intervalMs=60000&burst=1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    resp2.Body.Close()
+    if cn := resp2.TLS.PeerCertificates[0].Subject.CommonName; cn != "new" {
+        t.Errorf("new connection got certificate %q, want new", cn)
+    }
+
+    // A broken pair keeps the current certificate.
+    if err := os.WriteFile(keyFile, []byte("junk"), 0o600); err != nil {
+        t.Fatal(err)
+    }
+    before := certs.cert.Load()
+    reloadCerts(certs, slog.Default())
+    if certs.cert.Load() != before {
+        t.Error("failed reload replaced the certificate")
+    }
+}
+
+// h2cClient speaks HTTP/2 with prior knowledge over plain TCP.
+func h2cClient(t *testing.T) *http.Client {
+    t.Helper()
+    tr := &http2.Transport{
+        AllowHTTP: true,
+        DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+            var d net.Dialer
+            return d.DialContext(ctx, network, addr)
+        },
+    }
+    t.Cleanup(tr.CloseIdleConnections)
+    return &http.Client{Transport: tr}
+}
+
+func TestH2CStreamIsIncremental(t *testing.T) {
+    t.Setenv("ENABLE_H2C", "true")
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv := withServer(l.Addr().String(), http.HandlerFunc(streamHandler))
+    go serve(srv, l, false)
+    t.Cleanup(func() { srv.Close() })
+
+    resp, err := h2cClient(t).Get("http://" + l.Addr().String() + "/stream?intervalMs=60000&burst=2")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    if resp.ProtoMajor != 2 {
+        t.Errorf("negotiated %s, want HTTP/2", resp.Proto)
+    }
+    // Nothing follows the burst for a minute, so both events arriving
+    // means each was flushed as its own DATA frame rather than buffered.
+    events, err := scanSSE(resp.Body, 2)
+    if err != nil || len(events) != 2 {
+        t.Fatalf("read %+v, %v; want two events", events, err)
+    }
+}
+
+func TestH2COffByDefault(t *testing.T) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    srv := withServer(l.Addr().String(), http.HandlerFunc(streamHandler))
+    go serve(srv, l, false)
+    t.Cleanup(func() { srv.Close() })
+
+    if resp, err := h2cClient(t).Get("http://" + l.Addr().String() + "/stream?burst=1"); err == nil {
+        resp.Body.Close()
+        t.Fatalf("prior-knowledge HTTP/2 got %s without ENABLE_H2C", resp.Proto)
+    }
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+    "errors"
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// defaultTopic is the topic served at /stream and used by /publish when no
+// topic is given.
+const defaultTopic = "default"
+
+var topicPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+func validTopic(name string) bool {
+    return topicPattern.MatchString(name)
+}
+
+// topicIntervals maps topic names to their default intervalMs, from
+// TOPIC_INTERVALS, e.g. "prices=250,orders=1000". Malformed entries are
+// ignored. Clients can still pass their own intervalMs.
+var topicIntervals = sync.OnceValue(func() map[string]int {
+    m := make(map[string]int)
+    for _, entry := range splitList(getEnv("TOPIC_INTERVALS", "")) {
+        name, ms, _ := strings.Cut(entry, "=")
+        n, err := strconv.Atoi(strings.TrimSpace(ms))
+        if name = strings.TrimSpace(name); validTopic(name) && err == nil && n >= 1 {
+            m[name] = n
+        }
+    }
+    return m
+})
+
+// topics holds every topic's broker. It is created by main.
+var topics *topicRegistry
+
+// topicRegistry maps topic names to their brokers, each with its own
+// sequence counter, history and subscribers.
+type topicRegistry struct {
+    mu         sync.Mutex
+    brokers    map[string]*Broker
+    cfg        brokerConfig
+    autoCreate bool
+    // pinned are the topics never evicted: the default topic and the
+    // preset ones.
+    pinned map[string]bool
+
+    // maxAuto caps the auto-created topics, 0 for no cap.
+    maxAuto int
+    // idleTTL is how long an auto-created topic may go unused, without
+    // subscribers, before evictIdle removes it.
+    idleTTL time.Duration
+}
+
+var (
+    errUnknownTopic  = errors.New("unknown topic")
+    errTooManyTopics = errors.New("too many topics")
+)
+
+// newTopicRegistry creates the default topic plus any names in the
+// comma-separated preset list.
+func newTopicRegistry(cfg brokerConfig, autoCreate bool, preset string) *topicRegistry {
+    t := &topicRegistry{
+        brokers:    make(map[string]*Broker),
+        cfg:        cfg,
+        autoCreate: autoCreate,
+        pinned:     map[string]bool{defaultTopic: true},
+    }
+    t.brokers[defaultTopic] = newBroker(cfg)
+    for _, name := range strings.Split(preset, ",") {
+        name = strings.TrimSpace(name)
+        if validTopic(name) && t.brokers[name] == nil {
+            t.brokers[name] = newBroker(cfg)
+            t.pinned[name] = true
+        }
+    }
+    return t
+}
+
+// topicLimitsFromEnv reads MAX_TOPICS and TOPIC_IDLE_TTL_MS, which bound
+// the topics clients can create by naming them.
+func topicLimitsFromEnv() (maxAuto int, idleTTL time.Duration, err error) {
+    if maxAuto, err = strconv.Atoi(getEnv("MAX_TOPICS", "1000")); err != nil || maxAuto < 0 {
+        return 0, 0, errors.New("invalid MAX_TOPICS: must be an integer >= 0")
+    }
+    ms, err := strconv.Atoi(getEnv("TOPIC_IDLE_TTL_MS", "600000"))
+    if err != nil || ms < 1 {
+        return 0, 0, errors.New("invalid TOPIC_IDLE_TTL_MS: must be an integer >= 1")
+    }
+    return maxAuto, time.Duration(ms) * time.Millisecond, nil
+}
+
+// get returns the broker for name, creating it when auto-creation is on
+// and the cap on auto-created topics allows.
+func (t *topicRegistry) get(name string) (*Broker, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if b, ok := t.brokers[name]; ok {
+        b.touch()
+        return b, nil
+    }
+    if !t.autoCreate {
+        return nil, errUnknownTopic
+    }
+    if t.maxAuto > 0 && len(t.brokers)-len(t.pinned) >= t.maxAuto {
+        return nil, errTooManyTopics
+    }
+    b := newBroker(t.cfg)
+    t.brokers[name] = b
+    return b, nil
+}
+
+// evictIdle removes the auto-created topics without subscribers that have
+// not been used for idleTTL, stopping their brokers, and returns how many
+// it removed.
+func (t *topicRegistry) evictIdle(now time.Time) int {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    n := 0
+    for name, b := range t.brokers {
+        if t.pinned[name] || b.Subscribers() > 0 || now.Sub(b.idleSince()) < t.idleTTL {
+            continue
+        }
+        delete(t.brokers, name)
+        b.stop()
+        n++
+    }
+    return n
+}
+
+// evictIdleEvery runs evictIdle periodically.
+func (t *topicRegistry) evictIdleEvery(d time.Duration) {
+    go func() {
+        for now := range time.Tick(d) {
+            t.evictIdle(now)
+        }
+    }()
+}
+
+// backlog sums the undelivered events and the drops of every topic.
+func (t *topicRegistry) backlog() (depth int, dropped int64) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for _, b := range t.brokers {
+        depth += b.QueueDepth()
+        dropped += b.Dropped()
+    }
+    return depth, dropped
+}
+
+// topicBroker resolves a topic name, falling back to defaultTopic. It
+// writes a 400, 404 or 503 and returns false when the topic cannot be
+// served.
+func topicBroker(w http.ResponseWriter, name string) (*Broker, bool) {
+    if name == "" {
+        name = defaultTopic
+    }
+    if !validTopic(name) {
+        http.Error(w, "invalid topic: must match "+topicPattern.String(), http.StatusBadRequest)
+        return nil, false
+    }
+    b, err := topics.get(name)
+    switch {
+    case errors.Is(err, errTooManyTopics):
+        http.Error(w, "too many topics", http.StatusServiceUnavailable)
+        return nil, false
+    case err != nil:
+        http.Error(w, "unknown topic: "+name, http.StatusNotFound)
+        return nil, false
+    }
+    return b, true
+}
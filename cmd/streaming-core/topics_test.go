@@ -0,0 +1,158 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestTopicCap(t *testing.T) {
+    reg := newTopicRegistry(brokerConfig{history: 8, buffer: 4, policy: dropNewest}, true, "a,b")
+    reg.maxAuto = 2
+    for _, name := range []string{"a", "b", defaultTopic, "x", "y", "x"} {
+        if _, err := reg.get(name); err != nil {
+            t.Fatalf("get(%q) = %v", name, err)
+        }
+    }
+    if _, err := reg.get("z"); !errors.Is(err, errTooManyTopics) {
+        t.Fatalf("get past the cap = %v, want errTooManyTopics", err)
+    }
+
+    old := topics
+    topics = reg
+    defer func() { topics = old }()
+    rec := httptest.NewRecorder()
+    if _, ok := topicBroker(rec, "z"); ok || rec.Code != http.StatusServiceUnavailable {
+        t.Fatalf("topicBroker past the cap = %v, %d; want false, 503", ok, rec.Code)
+    }
+}
+
+func TestTopicUnknownWithoutAutoCreate(t *testing.T) {
+    reg := newTopicRegistry(brokerConfig{history: 8, buffer: 4, policy: dropNewest}, false, "")
+    if _, err := reg.get("nope"); !errors.Is(err, errUnknownTopic) {
+        t.Fatalf("get = %v, want errUnknownTopic", err)
+    }
+}
+
+func TestEvictIdleTopics(t *testing.T) {
+    reg := newTopicRegistry(brokerConfig{history: 8, buffer: 4, policy: dropNewest}, true, "kept")
+    reg.idleTTL = time.Minute
+    idle, _ := reg.get("idle")
+    busy, _ := reg.get("busy")
+    sub := busy.subscribeFrom(0)
+    defer busy.Unsubscribe(sub.events)
+    reg.get("recent")
+
+    // Backdate everything but "recent".
+    past := time.Now().Add(-2 * time.Minute).UnixNano()
+    for name, b := range reg.brokers {
+        if name != "recent" {
+            b.lastUsed.Store(past)
+        }
+    }
+
+    if n := reg.evictIdle(time.Now()); n != 1 {
+        t.Fatalf("evictIdle removed %d topics, want 1", n)
+    }
+    for _, name := range []string{defaultTopic, "kept", "busy", "recent"} {
+        if reg.brokers[name] == nil {
+            t.Errorf("topic %q was evicted", name)
+        }
+    }
+    if reg.brokers["idle"] != nil {
+        t.Fatal("idle topic was kept")
+    }
+
+    // A stopped broker neither blocks publishers nor keeps subscribers.
+    idle.Publish(SSEEvent{Data: "late"})
+    if _, open := <-idle.subscribeFrom(0).events; open {
+        t.Fatal("subscribing to a stopped broker returned an open channel")
+    }
+    if b, _ := reg.get("idle"); b == idle {
+        t.Fatal("get returned the evicted broker")
+    }
+}
+
+func TestChannelsAreIsolated(t *testing.T) {
+    srv := newStreamServer(t)
+    orders, prices := uniqueTopic("orders"), uniqueTopic("prices")
+    ordersResp := openStream(t, srv, "/stream/"+orders+"?numbers=false")
+    pricesResp := openStream(t, srv, "/stream/"+prices+"?numbers=false")
+    ob, _ := topics.get(orders)
+    pb, _ := topics.get(prices)
+    waitFor(t, "a subscriber on each channel", func() bool { return ob.Subscribers() == 1 && pb.Subscribers() == 1 })
+
+    ob.Publish(SSEEvent{Event: "order", Data: "o1"})
+    ob.Publish(SSEEvent{Event: "order", Data: "o2"})
+    pb.Publish(SSEEvent{Event: "price", Data: "p1"})
+
+    got, _ := scanSSE(ordersResp.Body, 2)
+    if len(got) != 2 || got[0].Data != "o1" || got[1].Data != "o2" {
+        t.Errorf("orders got %+v", got)
+    }
+    // Had an order leaked into prices, it would come first.
+    got, _ = scanSSE(pricesResp.Body, 1)
+    if len(got) != 1 || got[0].Data != "p1" || got[0].ID != "1" {
+        t.Errorf("prices got %+v, want only p1 with its own sequence", got)
+    }
+}
+
+func TestChannelsCreatedOnDemandOverHTTP(t *testing.T) {
+    srv := newStreamServer(t)
+    a, b := uniqueTopic("channel-a"), uniqueTopic("channel-b")
+    topics.mu.Lock()
+    before := len(topics.brokers)
+    topics.mu.Unlock()
+    aResp := openStream(t, srv, "/stream/"+a+"?numbers=false")
+    bResp := openStream(t, srv, "/stream/"+b+"?numbers=false")
+    ab, _ := topics.get(a)
+    bb, _ := topics.get(b)
+    waitFor(t, "a subscriber on each channel", func() bool { return ab.Subscribers() == 1 && bb.Subscribers() == 1 })
+    topics.mu.Lock()
+    created := len(topics.brokers) - before
+    topics.mu.Unlock()
+    if created != 2 {
+        t.Errorf("opening two new channels created %d topics", created)
+    }
+
+    for i := 1; i <= 3; i++ {
+        if code := post(t, srv.URL+"/publish/"+a, fmt.Sprintf(`{"data":"a%d"}`, i)); code != http.StatusAccepted {
+            t.Fatalf("publish to %s: status %d", a, code)
+        }
+    }
+    if code := post(t, srv.URL+"/publish/"+b, `{"data":"b1"}`); code != http.StatusAccepted {
+        t.Fatalf("publish to %s: status %d", b, code)
+    }
+
+    got, _ := scanSSE(aResp.Body, 3)
+    if ids := eventIDs(got); len(got) != 3 || got[2].Data != "a3" || strings.Join(ids, ",") != "1,2,3" {
+        t.Errorf("channel-a got %+v", got)
+    }
+    // channel-b counts from 1 too, and had anything from channel-a reached
+    // it, it would come before b1.
+    got, _ = scanSSE(bResp.Body, 1)
+    if len(got) != 1 || got[0].Data != "b1" || got[0].ID != "1" {
+        t.Errorf("channel-b got %+v, want only b1 with id 1", got)
+    }
+}
+
+func TestInvalidChannelName(t *testing.T) {
+    srv := newStreamServer(t)
+    for _, name := range []string{"bad!name", "sp%20ace", strings.Repeat("a", 65)} {
+        resp, err := http.Get(srv.URL + "/stream/" + name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        resp.Body.Close()
+        if resp.StatusCode != http.StatusBadRequest {
+            t.Errorf("/stream/%s: status %d, want 400", name, resp.StatusCode)
+        }
+    }
+    if !validTopic(strings.Repeat("a", 64)) || !validTopic("a_b-C9") {
+        t.Error("valid names rejected")
+    }
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "sync"
+)
+
+// ConnectionTracker counts in-flight streams so shutdown can wait for them
+// to send their shutdown event and return. http.Server.Shutdown does not wait
+// for hijacked WebSocket connections, and would cut SSE streams at its
+// deadline, so the drain happens before it.
+type ConnectionTracker struct {
+    mu       sync.Mutex
+    draining bool
+    wg       sync.WaitGroup
+}
+
+// streamTracker tracks every streaming endpoint.
+var streamTracker = &ConnectionTracker{}
+
+// Middleware tracks each request for the lifetime of its handler. Once the
+// tracker is draining, new requests are refused with 503.
+func (t *ConnectionTracker) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        t.mu.Lock()
+        if t.draining {
+            t.mu.Unlock()
+            http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+            return
+        }
+        t.wg.Add(1)
+        t.mu.Unlock()
+        defer t.wg.Done()
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Drain stops admitting requests and waits until the tracked ones finish or
+// ctx is done.
+func (t *ConnectionTracker) Drain(ctx context.Context) error {
+    t.mu.Lock()
+    t.draining = true
+    t.mu.Unlock()
+    done := make(chan struct{})
+    go func() {
+        t.wg.Wait()
+        close(done)
+    }()
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+
+    "github.com/Amarifields/streaming-core/streamingcore"
+    "golang.org/x/net/websocket"
+)
+
+// wsSink delivers stream events as JSON text messages on a WebSocket.
+type wsSink struct {
+    conn    *websocket.Conn
+    metrics *metricsRegistry
+}
+
+func (s wsSink) Write(e SSEEvent) error {
+    b, err := json.Marshal(e)
+    if err != nil {
+        return err
+    }
+    err = streamingcore.ClassifyWriteError(websocket.Message.Send(s.conn, string(b)))
+    if err != nil {
+        s.metrics.recordWrite(0, err)
+        return err
+    }
+    s.metrics.recordWrite(len(b), nil)
+    s.metrics.eventsSent.Inc()
+    return nil
+}
+
+// Keepalive sends a ping frame; the client's pong is consumed by the read
+// loop in serveWS.
+func (s wsSink) Keepalive() error {
+    s.conn.PayloadType = websocket.PingFrame
+    defer func() { s.conn.PayloadType = websocket.TextFrame }()
+    _, err := s.conn.Write(nil)
+    err = streamingcore.ClassifyWriteError(err)
+    s.metrics.recordWrite(0, err)
+    return err
+}
+
+// checkWSOrigin accepts clients without an Origin header and browsers from
+// an origin on the CORS allowlist.
+func checkWSOrigin(config *websocket.Config, r *http.Request) error {
+    origin := r.Header.Get("Origin")
+    if _, ok := corsOrigins().allowOrigin(origin); ok || origin == "" {
+        return nil
+    }
+    return fmt.Errorf("origin %q not allowed", origin)
+}
+
+// isWebSocketUpgrade reports whether r asks to switch to WebSocket, which
+// lets /stream serve clients whose proxies strip text/event-stream.
+func isWebSocketUpgrade(r *http.Request) bool {
+    return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+        headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// headerHasToken reports whether a comma-separated header contains token,
+// ignoring case.
+func headerHasToken(h http.Header, name, token string) bool {
+    for _, v := range h.Values(name) {
+        for _, t := range strings.Split(v, ",") {
+            if strings.EqualFold(strings.TrimSpace(t), token) {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// wsHandler serves the same events as streamHandler over a WebSocket, one
+// JSON-encoded SSEEvent per text message. Browsers cannot set Last-Event-ID
+// on a WebSocket, so the lastEventId query param takes its place.
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+    lastEventID := r.URL.Query().Get("lastEventId")
+    if lastEventID == "" {
+        lastEventID = r.Header.Get("Last-Event-ID")
+    }
+    sc, ok := beginStream(w, r, "ws", lastEventID)
+    if !ok {
+        return
+    }
+    defer sc.close()
+    websocket.Server{
+        Handshake: checkWSOrigin,
+        Handler: func(conn *websocket.Conn) {
+            serveWS(conn, sc)
+        },
+    }.ServeHTTP(w, r)
+}
+
+func serveWS(conn *websocket.Conn, sc *streamConn) {
+    // The request context is not cancelled when a hijacked client goes
+    // away, so a read loop watches for the close frame instead. Reading
+    // also answers the client's pings.
+    ctx, cancel := context.WithCancel(context.WithoutCancel(sc.ctx))
+    defer cancel()
+    go func() {
+        defer cancel()
+        var msg []byte
+        for {
+            if err := websocket.Message.Receive(conn, &msg); err != nil {
+                return
+            }
+        }
+    }()
+
+    err := runStream(ctx, sc, wsSink{conn: conn, metrics: defaultMetrics}, streamFeed(ctx, sc))
+    if errors.Is(err, errShuttingDown) {
+        _ = wsSink{conn: conn, metrics: defaultMetrics}.Write(shutdownEvent())
+    }
+    if errors.Is(err, errStreamComplete) || errors.Is(err, errShuttingDown) {
+        _ = conn.Close()
+    }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "testing"
+
+    "golang.org/x/net/websocket"
+)
+
+// readWS reads n JSON events from the WebSocket stream at path on the
+// server at url.
+func readWS(t *testing.T, url, path string, n int) []SSEEvent {
+    t.Helper()
+    conn, err := websocket.Dial("ws"+strings.TrimPrefix(url, "http")+path, "", "http://localhost")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    var events []SSEEvent
+    for len(events) < n {
+        var msg string
+        if err := websocket.Message.Receive(conn, &msg); err != nil {
+            t.Fatalf("after %d messages: %v", len(events), err)
+        }
+        var e SSEEvent
+        if err := json.Unmarshal([]byte(msg), &e); err != nil {
+            t.Fatalf("message %q: %v", msg, err)
+        }
+        events = append(events, e)
+    }
+    return events
+}
+
+func TestStreamNegotiatesSSEAndWebSocket(t *testing.T) {
+    srv := newStreamServer(t)
+    const path = "/stream?intervalMs=1&limit=3&start=10&send_eof=true"
+    sse := readSSE(t, srv, path, nil, 4)
+    ws := readWS(t, srv.URL, path, 4)
+    for i := range sse {
+        if sse[i] != ws[i] {
+            t.Errorf("event %d: SSE %+v, WebSocket %+v", i, sse[i], ws[i])
+        }
+    }
+    if ws[0].ID != "10" || ws[3].Event != "eof" {
+        t.Errorf("WebSocket events %+v, want 10, 11, 12 and eof", ws)
+    }
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+    tests := []struct {
+        upgrade, connection string
+        want                bool
+    }{
+        {"websocket", "Upgrade", true},
+        {"WebSocket", "keep-alive, upgrade", true},
+        {"websocket", "", false},
+        {"h2c", "Upgrade", false},
+        {"", "", false},
+    }
+    for _, tt := range tests {
+        r, _ := http.NewRequest(http.MethodGet, "/stream", nil)
+        r.Header.Set("Upgrade", tt.upgrade)
+        r.Header.Set("Connection", tt.connection)
+        if got := isWebSocketUpgrade(r); got != tt.want {
+            t.Errorf("Upgrade %q, Connection %q: got %v, want %v", tt.upgrade, tt.connection, got, tt.want)
+        }
+    }
+}
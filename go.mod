@@ -2,4 +2,6 @@ module github.com/Amarifields/streaming-core
 
 go 1.22.0
 
+require golang.org/x/net v0.35.0
 
+require golang.org/x/text v0.22.0 // indirect
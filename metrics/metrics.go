@@ -0,0 +1,141 @@
+// Package metrics provides counters, gauges and histograms rendered in the
+// Prometheus text exposition format, without depending on the Prometheus
+// client library.
+package metrics
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "sync"
+    "sync/atomic"
+)
+
+// Metric is anything a Registry can expose.
+type Metric interface {
+    WriteText(w io.Writer)
+}
+
+// Registry is an ordered set of metrics exposed together.
+type Registry struct {
+    mu      sync.Mutex
+    metrics []Metric
+}
+
+func NewRegistry() *Registry {
+    return &Registry{}
+}
+
+// Register adds m to the registry; metrics are written in the order they
+// were registered.
+func (r *Registry) Register(m Metric) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+    c := &Counter{name: name, help: help}
+    r.Register(c)
+    return c
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+    g := &Gauge{name: name, help: help}
+    r.Register(g)
+    return g
+}
+
+// NewHistogram registers a histogram with the given ascending bucket upper
+// bounds; the +Inf bucket is implicit.
+func (r *Registry) NewHistogram(name, help string, bounds []float64) *Histogram {
+    h := &Histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds))}
+    r.Register(h)
+    return h
+}
+
+// WriteText writes every registered metric in the text exposition format.
+func (r *Registry) WriteText(w io.Writer) {
+    r.mu.Lock()
+    metrics := append([]Metric(nil), r.metrics...)
+    r.mu.Unlock()
+    for _, m := range metrics {
+        m.WriteText(w)
+    }
+}
+
+// Handler serves the registry for Prometheus to scrape.
+func (r *Registry) Handler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        r.WriteText(w)
+    })
+}
+
+// Counter is a monotonically increasing integer.
+type Counter struct {
+    name, help string
+    value      atomic.Int64
+}
+
+func (c *Counter) Inc()         { c.value.Add(1) }
+func (c *Counter) Add(n int64)  { c.value.Add(n) }
+func (c *Counter) Value() int64 { return c.value.Load() }
+
+func (c *Counter) WriteText(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value.Load())
+}
+
+// Gauge is an integer that goes up and down.
+type Gauge struct {
+    name, help string
+    value      atomic.Int64
+}
+
+func (g *Gauge) Inc()         { g.value.Add(1) }
+func (g *Gauge) Dec()         { g.value.Add(-1) }
+func (g *Gauge) Set(v int64)  { g.value.Store(v) }
+func (g *Gauge) Value() int64 { return g.value.Load() }
+
+func (g *Gauge) WriteText(w io.Writer) {
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value.Load())
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+    name, help string
+    bounds     []float64
+
+    mu     sync.Mutex
+    counts []uint64
+    sum    float64
+    count  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    for i, b := range h.bounds {
+        if v <= b {
+            h.counts[i]++
+        }
+    }
+    h.sum += v
+    h.count++
+}
+
+func (h *Histogram) WriteText(w io.Writer) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+    for i, b := range h.bounds {
+        fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(b), h.counts[i])
+    }
+    fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+    fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatFloat(h.sum), h.name, h.count)
+}
+
+func formatFloat(v float64) string {
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "regexp"
+    "strings"
+    "testing"
+)
+
+var (
+    helpLine   = regexp.MustCompile(`^# HELP [a-zA-Z_:][a-zA-Z0-9_:]* .+$`)
+    typeLine   = regexp.MustCompile(`^# TYPE [a-zA-Z_:][a-zA-Z0-9_:]* (counter|gauge|histogram)$`)
+    sampleLine = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*(\{[a-zA-Z_][a-zA-Z0-9_]*="[^"]*"\})? ([-+0-9.eE]+|\+Inf)$`)
+)
+
+func TestHandlerServesTextFormat(t *testing.T) {
+    reg := NewRegistry()
+    c := reg.NewCounter("test_events_total", "Events.")
+    g := reg.NewGauge("test_open", "Open things.")
+    h := reg.NewHistogram("test_seconds", "Durations.", []float64{0.5, 1})
+    c.Add(5)
+    g.Inc()
+    g.Inc()
+    g.Dec()
+    h.Observe(0.25)
+    h.Observe(0.75)
+    h.Observe(3)
+
+    rr := httptest.NewRecorder()
+    reg.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+    if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+        t.Errorf("Content-Type %q", ct)
+    }
+    body := rr.Body.String()
+    for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+        if !helpLine.MatchString(line) && !typeLine.MatchString(line) && !sampleLine.MatchString(line) {
+            t.Errorf("malformed line %q", line)
+        }
+    }
+    for _, want := range []string{
+        "test_events_total 5\n",
+        "test_open 1\n",
+        `test_seconds_bucket{le="0.5"} 1` + "\n",
+        `test_seconds_bucket{le="1"} 2` + "\n",
+        `test_seconds_bucket{le="+Inf"} 3` + "\n",
+        "test_seconds_sum 4\n",
+        "test_seconds_count 3\n",
+    } {
+        if !strings.Contains(body, want) {
+            t.Errorf("missing %q in\n%s", want, body)
+        }
+    }
+}
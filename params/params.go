@@ -0,0 +1,67 @@
+// Package params parses the query parameters shared by the streaming
+// endpoints. Absent params take a default; malformed or out-of-range ones are
+// an error naming the param, suitable for a 400 response.
+package params
+
+import (
+    "fmt"
+    "math"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// Int reads the integer query param name, returning def when it is absent.
+// A value that is not an integer or is below min is an error.
+func Int(r *http.Request, name string, def, min int) (int, error) {
+    q := r.URL.Query().Get(name)
+    if q == "" {
+        return def, nil
+    }
+    v, err := strconv.Atoi(q)
+    if err != nil || v < min {
+        return 0, fmt.Errorf("invalid %s: %q is not an integer >= %d", name, q, min)
+    }
+    return v, nil
+}
+
+// ParseInterval reads intervalMs, the delay between events, which must be
+// positive. defaultMs applies when it is absent.
+func ParseInterval(r *http.Request, defaultMs int) (time.Duration, error) {
+    ms, err := Int(r, "intervalMs", defaultMs, 1)
+    return time.Duration(ms) * time.Millisecond, err
+}
+
+// ParseStart reads start, the first number to emit, or -1 when it is absent.
+func ParseStart(r *http.Request) (int, error) {
+    return Int(r, "start", -1, 0)
+}
+
+// ParseLimit reads limit, the number of events to send, or 0 (unlimited)
+// when it is absent.
+func ParseLimit(r *http.Request) (int, error) {
+    return Int(r, "limit", 0, 0)
+}
+
+// ParseRate reads eventsPerSecond, the throughput to pace events at, which
+// must be a positive number. It returns 0 when the param is absent.
+func ParseRate(r *http.Request) (float64, error) {
+    q := r.URL.Query().Get("eventsPerSecond")
+    if q == "" {
+        return 0, nil
+    }
+    v, err := strconv.ParseFloat(q, 64)
+    if err != nil || !(v > 0) || math.IsInf(v, 1) {
+        return 0, fmt.Errorf("invalid eventsPerSecond: %q is not a number > 0", q)
+    }
+    return v, nil
+}
+
+// RateInterval returns the interval between events that yields rate events
+// per second, with rate capped at maxRate when maxRate is positive.
+func RateInterval(rate, maxRate float64) time.Duration {
+    if maxRate > 0 && rate > maxRate {
+        rate = maxRate
+    }
+    return max(time.Duration(float64(time.Second)/rate), 1)
+}
@@ -0,0 +1,126 @@
+package params
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func get(query string) *http.Request {
+    return httptest.NewRequest(http.MethodGet, "/stream?"+query, nil)
+}
+
+func TestParseInterval(t *testing.T) {
+    tests := []struct {
+        query   string
+        want    time.Duration
+        wantErr bool
+    }{
+        {"", 1000 * time.Millisecond, false},
+        {"intervalMs=", 1000 * time.Millisecond, false},
+        {"intervalMs=-5", 0, true},
+        {"intervalMs=abc", 0, true},
+        {"intervalMs=1.5", 0, true},
+        {"intervalMs=0", 0, true},
+        {"intervalMs=250", 250 * time.Millisecond, false},
+    }
+    for _, tt := range tests {
+        got, err := ParseInterval(get(tt.query), 1000)
+        if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+            t.Errorf("ParseInterval(%q) = %v, %v; want %v, error %v", tt.query, got, err, tt.want, tt.wantErr)
+        }
+    }
+}
+
+func TestParseStart(t *testing.T) {
+    tests := []struct {
+        query   string
+        want    int
+        wantErr bool
+    }{
+        {"", -1, false},
+        {"start=", -1, false},
+        {"start=-1", 0, true},
+        {"start=x", 0, true},
+        {"start=0", 0, false},
+        {"start=42", 42, false},
+    }
+    for _, tt := range tests {
+        got, err := ParseStart(get(tt.query))
+        if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+            t.Errorf("ParseStart(%q) = %v, %v; want %v, error %v", tt.query, got, err, tt.want, tt.wantErr)
+        }
+    }
+}
+
+func TestParseLimit(t *testing.T) {
+    tests := []struct {
+        query   string
+        want    int
+        wantErr bool
+    }{
+        {"", 0, false},
+        {"limit=", 0, false},
+        {"limit=-3", 0, true},
+        {"limit=ten", 0, true},
+        {"limit=0", 0, false},
+        {"limit=10", 10, false},
+    }
+    for _, tt := range tests {
+        got, err := ParseLimit(get(tt.query))
+        if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+            t.Errorf("ParseLimit(%q) = %v, %v; want %v, error %v", tt.query, got, err, tt.want, tt.wantErr)
+        }
+    }
+}
+
+func TestIntErrorNamesParam(t *testing.T) {
+    _, err := Int(get("step=-2"), "step", 1, 1)
+    if err == nil || err.Error() != `invalid step: "-2" is not an integer >= 1` {
+        t.Errorf("Int error = %v", err)
+    }
+}
+
+func TestParseRate(t *testing.T) {
+    tests := []struct {
+        query   string
+        want    float64
+        wantErr bool
+    }{
+        {"", 0, false},
+        {"eventsPerSecond=10", 10, false},
+        {"eventsPerSecond=0.5", 0.5, false},
+        {"eventsPerSecond=0", 0, true},
+        {"eventsPerSecond=-1", 0, true},
+        {"eventsPerSecond=NaN", 0, true},
+        {"eventsPerSecond=Inf", 0, true},
+        {"eventsPerSecond=fast", 0, true},
+    }
+    for _, tt := range tests {
+        got, err := ParseRate(get(tt.query))
+        if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+            t.Errorf("ParseRate(%q) = %v, %v; want %v, error %v", tt.query, got, err, tt.want, tt.wantErr)
+        }
+    }
+}
+
+func TestRateInterval(t *testing.T) {
+    tests := []struct {
+        rate, maxRate float64
+        want          time.Duration
+    }{
+        {10, 1000, 100 * time.Millisecond},
+        {0.5, 1000, 2 * time.Second},
+        {1000, 1000, time.Millisecond},
+        {5000, 1000, time.Millisecond},
+        {5000, 0, 200 * time.Microsecond},
+        // Never a zero interval, which time.NewTicker rejects.
+        {1e12, 0, time.Nanosecond},
+    }
+    for _, tt := range tests {
+        if got := RateInterval(tt.rate, tt.maxRate); got != tt.want {
+            t.Errorf("RateInterval(%v, %v) = %v, want %v", tt.rate, tt.maxRate, got, tt.want)
+        }
+    }
+}
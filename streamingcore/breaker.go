@@ -0,0 +1,143 @@
+package streamingcore
+
+import (
+    "context"
+    "errors"
+    "sync"
+    "time"
+)
+
+// ErrCircuitOpen is returned by CircuitBreaker.Call without calling the
+// upstream while the breaker is open.
+var ErrCircuitOpen = errors.New("streamingcore: circuit open")
+
+// State is the state of a CircuitBreaker.
+type State int
+
+const (
+    // Closed lets every call through, counting consecutive failures.
+    Closed State = iota
+    // Open fails every call with ErrCircuitOpen until RecoveryTimeout has
+    // passed since it opened.
+    Open
+    // HalfOpen lets a single trial call through: success closes the
+    // breaker, failure opens it again.
+    HalfOpen
+)
+
+func (s State) String() string {
+    switch s {
+    case Closed:
+        return "closed"
+    case Open:
+        return "open"
+    case HalfOpen:
+        return "half-open"
+    default:
+        return "unknown"
+    }
+}
+
+// CircuitBreaker stops calling a failing upstream, such as a database or
+// message queue feeding a stream, so callers fail fast instead of all
+// stalling on it, and probes it again after a while. It is safe for
+// concurrent use.
+type CircuitBreaker struct {
+    // FailureThreshold is how many consecutive failures open the breaker.
+    FailureThreshold int
+    // RecoveryTimeout is how long the breaker stays open before letting a
+    // trial call through.
+    RecoveryTimeout time.Duration
+
+    mu       sync.Mutex
+    state    State
+    failures int
+    openedAt time.Time
+    // probing is set while the half-open trial call runs.
+    probing bool
+}
+
+// NewCircuitBreaker returns a closed breaker that opens after
+// failureThreshold consecutive failures and tries again after
+// recoveryTimeout.
+func NewCircuitBreaker(failureThreshold int, recoveryTimeout time.Duration) *CircuitBreaker {
+    return &CircuitBreaker{FailureThreshold: failureThreshold, RecoveryTimeout: recoveryTimeout}
+}
+
+// State returns the breaker's current state. An open breaker whose
+// recovery timeout has passed reports HalfOpen.
+func (b *CircuitBreaker) State() State {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.advance()
+    return b.state
+}
+
+// Call calls fn unless the breaker is open, or half-open with its trial call
+// still running, in which case it returns ErrCircuitOpen at once. fn's error
+// is returned as is and counts as a failure, except when it is ctx's own
+// error: a caller giving up says nothing about the upstream.
+func (b *CircuitBreaker) Call(ctx context.Context, fn func() error) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    trial, ok := b.acquire()
+    if !ok {
+        return ErrCircuitOpen
+    }
+
+    err := fn()
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if trial {
+        b.probing = false
+    }
+    switch {
+    case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+        // Neither success nor failure; a trial call is simply retried.
+    case trial && err == nil:
+        b.state, b.failures = Closed, 0
+    case trial:
+        b.trip()
+    case b.state != Closed:
+        // The breaker opened while the call ran; only the trial call
+        // decides what happens next.
+    case err == nil:
+        b.failures = 0
+    default:
+        b.failures++
+        if b.failures >= b.FailureThreshold {
+            b.trip()
+        }
+    }
+    return err
+}
+
+// acquire decides whether a call may go ahead and whether it is the
+// half-open trial call, taking the trial slot if so.
+func (b *CircuitBreaker) acquire() (trial, ok bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.advance()
+    switch {
+    case b.state == Open, b.state == HalfOpen && b.probing:
+        return false, false
+    case b.state == HalfOpen:
+        b.probing = true
+        return true, true
+    }
+    return false, true
+}
+
+func (b *CircuitBreaker) trip() {
+    b.state, b.failures, b.openedAt = Open, 0, time.Now()
+}
+
+// advance moves an open breaker to half-open once its recovery timeout has
+// passed.
+func (b *CircuitBreaker) advance() {
+    if b.state == Open && time.Since(b.openedAt) >= b.RecoveryTimeout {
+        b.state = HalfOpen
+    }
+}
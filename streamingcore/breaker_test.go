@@ -0,0 +1,128 @@
+package streamingcore
+
+import (
+    "context"
+    "errors"
+    "testing"
+    "time"
+)
+
+var errUpstream = errors.New("upstream down")
+
+func fail() error    { return errUpstream }
+func succeed() error { return nil }
+
+func TestCircuitBreakerStateMachine(t *testing.T) {
+    ctx := context.Background()
+    b := NewCircuitBreaker(2, 20*time.Millisecond)
+
+    if err := b.Call(ctx, fail); !errors.Is(err, errUpstream) {
+        t.Fatalf("first failure: err = %v", err)
+    }
+    if b.State() != Closed {
+        t.Fatalf("after 1 failure: %v, want closed", b.State())
+    }
+    _ = b.Call(ctx, fail)
+    if b.State() != Open {
+        t.Fatalf("after 2 failures: %v, want open", b.State())
+    }
+    called := false
+    if err := b.Call(ctx, func() error { called = true; return nil }); !errors.Is(err, ErrCircuitOpen) || called {
+        t.Fatalf("open breaker: err = %v, called = %v; want ErrCircuitOpen without calling", err, called)
+    }
+
+    time.Sleep(25 * time.Millisecond)
+    if b.State() != HalfOpen {
+        t.Fatalf("after recovery timeout: %v, want half-open", b.State())
+    }
+    _ = b.Call(ctx, fail)
+    if b.State() != Open {
+        t.Fatalf("failed trial: %v, want open", b.State())
+    }
+
+    time.Sleep(25 * time.Millisecond)
+    if err := b.Call(ctx, succeed); err != nil {
+        t.Fatal(err)
+    }
+    if b.State() != Closed {
+        t.Fatalf("successful trial: %v, want closed", b.State())
+    }
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+    ctx := context.Background()
+    b := NewCircuitBreaker(2, time.Minute)
+    _ = b.Call(ctx, fail)
+    _ = b.Call(ctx, succeed)
+    _ = b.Call(ctx, fail)
+    if b.State() != Closed {
+        t.Fatalf("failures not consecutive: %v, want closed", b.State())
+    }
+}
+
+func TestCircuitBreakerSingleTrial(t *testing.T) {
+    ctx := context.Background()
+    b := NewCircuitBreaker(1, 10*time.Millisecond)
+    _ = b.Call(ctx, fail)
+    time.Sleep(15 * time.Millisecond)
+
+    release := make(chan struct{})
+    done := make(chan error)
+    go func() { done <- b.Call(ctx, func() error { <-release; return nil }) }()
+    time.Sleep(5 * time.Millisecond)
+    if err := b.Call(ctx, succeed); !errors.Is(err, ErrCircuitOpen) {
+        t.Fatalf("second call during trial: err = %v, want ErrCircuitOpen", err)
+    }
+    close(release)
+    if err := <-done; err != nil {
+        t.Fatal(err)
+    }
+    if b.State() != Closed {
+        t.Fatalf("after trial: %v, want closed", b.State())
+    }
+}
+
+// A call that started while closed and ends while half-open must not be
+// taken for the trial call.
+func TestCircuitBreakerLateCallIsNotTrial(t *testing.T) {
+    ctx := context.Background()
+    b := NewCircuitBreaker(1, 10*time.Millisecond)
+
+    release := make(chan struct{})
+    done := make(chan error)
+    go func() { done <- b.Call(ctx, func() error { <-release; return nil }) }()
+    time.Sleep(5 * time.Millisecond)
+    _ = b.Call(ctx, fail) // opens the breaker
+    time.Sleep(15 * time.Millisecond)
+
+    trialRelease := make(chan struct{})
+    trialDone := make(chan error)
+    go func() { trialDone <- b.Call(ctx, func() error { <-trialRelease; return errUpstream }) }()
+    time.Sleep(5 * time.Millisecond)
+
+    close(release)
+    <-done
+    if b.State() != HalfOpen {
+        t.Fatalf("late call changed the state to %v, want half-open", b.State())
+    }
+    if err := b.Call(ctx, succeed); !errors.Is(err, ErrCircuitOpen) {
+        t.Fatalf("late call freed the trial slot: err = %v", err)
+    }
+    close(trialRelease)
+    <-trialDone
+    if b.State() != Open {
+        t.Fatalf("failed trial: %v, want open", b.State())
+    }
+}
+
+func TestCircuitBreakerIgnoresCallerCancellation(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    b := NewCircuitBreaker(1, time.Minute)
+    _ = b.Call(ctx, func() error { cancel(); return ctx.Err() })
+    if b.State() != Closed {
+        t.Fatalf("cancellation counted as failure: %v", b.State())
+    }
+    if err := b.Call(ctx, succeed); !errors.Is(err, context.Canceled) {
+        t.Fatalf("cancelled ctx: err = %v", err)
+    }
+}
@@ -0,0 +1,70 @@
+package streamingcore
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "syscall"
+)
+
+// Writer errors wrap one of these, alongside the underlying error, so
+// callers can tell why a write failed with errors.Is.
+var (
+    // ErrClientGone means the client disconnected: there is no one left to
+    // write to, which is routine for long-lived streams.
+    ErrClientGone = errors.New("streamingcore: client gone")
+    // ErrWriteTimeout means the client did not take the event within the
+    // Writer's WriteTimeout, typically because it stopped reading.
+    ErrWriteTimeout = errors.New("streamingcore: write timeout")
+    // ErrBufferFull means the connection could not buffer the event.
+    ErrBufferFull = errors.New("streamingcore: write buffer full")
+)
+
+// clientGoneMessages are the texts of disconnect errors that have no
+// exported value to match, such as those of the HTTP/2 server.
+var clientGoneMessages = []string{
+    "broken pipe",
+    "connection reset by peer",
+    "use of closed network connection",
+    "client disconnected",
+    "stream closed",
+}
+
+// ClassifyWriteError wraps err, from writing or flushing a response, with
+// the sentinel matching its cause. Errors of unknown cause, and nil, are
+// returned unchanged.
+func ClassifyWriteError(err error) error {
+    var sentinel error
+    switch {
+    case err == nil:
+        return nil
+    case errors.Is(err, ErrClientGone), errors.Is(err, ErrWriteTimeout), errors.Is(err, ErrBufferFull):
+        return err
+    case errors.Is(err, os.ErrDeadlineExceeded):
+        sentinel = ErrWriteTimeout
+    case errors.Is(err, bufio.ErrBufferFull), errors.Is(err, syscall.ENOBUFS), errors.Is(err, syscall.EAGAIN):
+        sentinel = ErrBufferFull
+    case errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNRESET), errors.Is(err, net.ErrClosed):
+        sentinel = ErrClientGone
+    default:
+        var opErr *net.OpError
+        if errors.As(err, &opErr) && opErr.Timeout() {
+            sentinel = ErrWriteTimeout
+            break
+        }
+        msg := err.Error()
+        for _, m := range clientGoneMessages {
+            if strings.Contains(msg, m) {
+                sentinel = ErrClientGone
+                break
+            }
+        }
+        if sentinel == nil {
+            return err
+        }
+    }
+    return fmt.Errorf("%w: %w", sentinel, err)
+}
@@ -0,0 +1,51 @@
+package streamingcore
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "syscall"
+    "testing"
+)
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestClassifyWriteError(t *testing.T) {
+    other := errors.New("something else")
+    tests := []struct {
+        name string
+        err  error
+        want error
+    }{
+        {"deadline", fmt.Errorf("write: %w", os.ErrDeadlineExceeded), ErrWriteTimeout},
+        {"net timeout", &net.OpError{Op: "write", Err: timeoutErr{}}, ErrWriteTimeout},
+        {"epipe", &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, ErrClientGone},
+        {"reset", syscall.ECONNRESET, ErrClientGone},
+        {"closed", net.ErrClosed, ErrClientGone},
+        {"http2", errors.New("http2: stream closed"), ErrClientGone},
+        {"bufio", bufio.ErrBufferFull, ErrBufferFull},
+        {"enobufs", syscall.ENOBUFS, ErrBufferFull},
+    }
+    for _, tt := range tests {
+        got := ClassifyWriteError(tt.err)
+        if !errors.Is(got, tt.want) || !errors.Is(got, tt.err) {
+            t.Errorf("%s: ClassifyWriteError(%v) = %v, want it to wrap %v and the cause", tt.name, tt.err, got, tt.want)
+        }
+    }
+    if ClassifyWriteError(nil) != nil {
+        t.Error("ClassifyWriteError(nil) != nil")
+    }
+    if got := ClassifyWriteError(other); got != other {
+        t.Errorf("unknown error = %v, want it unchanged", got)
+    }
+    once := ClassifyWriteError(syscall.EPIPE)
+    if got := ClassifyWriteError(once); got != once {
+        t.Errorf("classifying twice = %v, want %v", got, once)
+    }
+}
@@ -0,0 +1,55 @@
+// Package streamingcore holds the Server-Sent Events machinery of the
+// streaming server for reuse in other services: Event, the Writer that
+// frames and flushes events over an http.ResponseWriter, the classification
+// of its write errors and a CircuitBreaker for upstream calls. Query param
+// helpers live in the sibling params package.
+package streamingcore
+
+import (
+    "fmt"
+    "io"
+    "strings"
+)
+
+// lineBreaks normalizes CRLF and lone CR to LF; either would otherwise end a
+// data field early on the client.
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// Event is a single Server-Sent Events message. Empty fields are omitted
+// from the wire; a zero Retry sends no retry field. Name is sent as the
+// event field, which EventSource clients listen for with addEventListener.
+type Event struct {
+    ID    string `json:"id,omitempty"`
+    Name  string `json:"event,omitempty"`
+    Data  string `json:"data"`
+    Retry int    `json:"retry,omitempty"`
+}
+
+// String returns e as it appears on the wire: its fields in spec order (id,
+// event, data, retry) and a terminating blank line. Data containing line
+// breaks becomes one data field per line, which clients join back up.
+func (e Event) String() string {
+    var b strings.Builder
+    if e.ID != "" {
+        fmt.Fprintf(&b, "id: %s\n", e.ID)
+    }
+    if e.Name != "" {
+        fmt.Fprintf(&b, "event: %s\n", e.Name)
+    }
+    if e.Data != "" {
+        for _, line := range strings.Split(lineBreaks.Replace(e.Data), "\n") {
+            fmt.Fprintf(&b, "data: %s\n", line)
+        }
+    }
+    if e.Retry > 0 {
+        fmt.Fprintf(&b, "retry: %d\n", e.Retry)
+    }
+    b.WriteString("\n")
+    return b.String()
+}
+
+// WriteTo writes e's wire form to w.
+func (e Event) WriteTo(w io.Writer) (int64, error) {
+    n, err := io.WriteString(w, e.String())
+    return int64(n), err
+}
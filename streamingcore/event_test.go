@@ -0,0 +1,35 @@
+package streamingcore
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestEventString(t *testing.T) {
+    tests := []struct {
+        name string
+        e    Event
+        want string
+    }{
+        {"empty", Event{}, "\n"},
+        {"data only", Event{Data: "42"}, "data: 42\n\n"},
+        {"all fields", Event{ID: "7", Name: "tick", Data: "42", Retry: 1500}, "id: 7\nevent: tick\ndata: 42\nretry: 1500\n\n"},
+        {"retry only", Event{Retry: 1000}, "retry: 1000\n\n"},
+        {"multiline", Event{Data: "a\nb\r\nc\rd"}, "data: a\ndata: b\ndata: c\ndata: d\n\n"},
+        {"trailing newline", Event{Data: "a\n"}, "data: a\ndata: \n\n"},
+    }
+    for _, tt := range tests {
+        if got := tt.e.String(); got != tt.want {
+            t.Errorf("%s: String() = %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestEventWriteTo(t *testing.T) {
+    var b strings.Builder
+    e := Event{ID: "1", Data: "x"}
+    n, err := e.WriteTo(&b)
+    if err != nil || b.String() != e.String() || n != int64(len(e.String())) {
+        t.Fatalf("WriteTo = %d, %v, wrote %q", n, err, b.String())
+    }
+}
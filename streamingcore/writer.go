@@ -0,0 +1,207 @@
+package streamingcore
+
+import (
+    "compress/gzip"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strings"
+    "time"
+)
+
+// ErrFlushUnsupported is returned by NewWriter when nothing under the
+// response writer can flush, so events would sit in a buffer instead of
+// reaching the client.
+var ErrFlushUnsupported = errors.New("streamingcore: response writer cannot flush")
+
+// ErrEventTooLarge is returned, before anything is written, for an event
+// whose data or a comment whose text exceeds the Writer's MaxEventBytes.
+var ErrEventTooLarge = errors.New("streamingcore: event too large")
+
+// Writer writes events to an SSE response, flushing each one so it reaches
+// the client immediately. It is not safe for concurrent use.
+type Writer struct {
+    // WriteTimeout bounds each write and flush, so a client that stops
+    // reading fails the stream with os.ErrDeadlineExceeded instead of
+    // blocking it forever; 0 disables it.
+    WriteTimeout time.Duration
+    // OnWrite, if set, is called after every write with the bytes written
+    // and the error, if any, e.g. to record metrics.
+    OnWrite func(n int, err error)
+    // BatchInterval, when positive, makes writes flush at most once per
+    // interval, so events written in quick succession leave in one TCP
+    // write as separate records. Events written in between are held back
+    // until a later write is due to flush or Flush is called, so the caller
+    // must call Flush at least every BatchInterval while any are pending.
+    BatchInterval time.Duration
+    // MaxEventBytes, when positive, is the largest event data or comment
+    // text Write and WriteComment accept; anything larger fails with
+    // ErrEventTooLarge.
+    MaxEventBytes int
+
+    w  http.ResponseWriter
+    rc *http.ResponseController
+    // gz compresses the stream once EnableGzip is called.
+    gz *gzip.Writer
+    // lastFlush is when output was last flushed, and pending is set while
+    // written frames wait for the next flush.
+    lastFlush time.Time
+    pending   bool
+}
+
+// NewWriter returns a Writer for w. It finds flush support through
+// middleware that wraps w, as http.ResponseController does, and fails with
+// ErrFlushUnsupported when there is none.
+func NewWriter(w http.ResponseWriter) (*Writer, error) {
+    if !CanFlush(w) {
+        return nil, ErrFlushUnsupported
+    }
+    return &Writer{w: w, rc: http.NewResponseController(w)}, nil
+}
+
+// CanFlush reports whether w, or a writer it wraps, supports flushing,
+// following Unwrap like http.ResponseController does. Middleware such as an
+// access logger may hide http.Flusher from a plain type assertion. It does
+// not flush, so headers can still be set afterwards.
+func CanFlush(w http.ResponseWriter) bool {
+    for {
+        switch t := w.(type) {
+        case http.Flusher, interface{ FlushError() error }:
+            return true
+        case interface{ Unwrap() http.ResponseWriter }:
+            w = t.Unwrap()
+        default:
+            return false
+        }
+    }
+}
+
+// Write sends e and flushes it. A failure wraps ErrClientGone,
+// ErrWriteTimeout or ErrBufferFull when its cause is known.
+func (w *Writer) Write(e Event) error {
+    if err := w.checkSize(e.Data); err != nil {
+        return err
+    }
+    return w.send(e.String())
+}
+
+// WriteRetry advertises the reconnect delay in ms.
+func (w *Writer) WriteRetry(ms int) error {
+    return w.Write(Event{Retry: ms})
+}
+
+// WriteComment sends a comment line, which clients ignore but which keeps
+// idle connections open through proxies.
+func (w *Writer) WriteComment(text string) error {
+    if err := w.checkSize(text); err != nil {
+        return err
+    }
+    return w.send(": " + text + "\n\n")
+}
+
+func (w *Writer) checkSize(s string) error {
+    if w.MaxEventBytes > 0 && len(s) > w.MaxEventBytes {
+        return fmt.Errorf("%w: %d bytes, limit %d", ErrEventTooLarge, len(s), w.MaxEventBytes)
+    }
+    return nil
+}
+
+// send writes a complete frame and flushes it, unless batching holds it
+// back.
+func (w *Writer) send(frame string) error {
+    defer w.setDeadline()()
+    var out io.Writer = w.w
+    if w.gz != nil {
+        out = w.gz
+    }
+    n, err := io.WriteString(out, frame)
+    if err == nil {
+        w.pending = true
+        if w.BatchInterval <= 0 || time.Since(w.lastFlush) >= w.BatchInterval {
+            err = w.flush()
+        }
+    }
+    err = ClassifyWriteError(err)
+    if w.OnWrite != nil {
+        w.OnWrite(n, err)
+    }
+    return err
+}
+
+// Flush sends the events a batching Writer is holding back. It does nothing
+// when none are.
+func (w *Writer) Flush() error {
+    if !w.pending {
+        return nil
+    }
+    defer w.setDeadline()()
+    err := ClassifyWriteError(w.flush())
+    if w.OnWrite != nil {
+        w.OnWrite(0, err)
+    }
+    return err
+}
+
+// setDeadline bounds the next write and flush by WriteTimeout.
+func (w *Writer) setDeadline() func() {
+    return SetWriteDeadline(w.rc, w.WriteTimeout)
+}
+
+// SetWriteDeadline bounds the next write and flush through rc by d and
+// returns a func that clears the deadline again, for responses framed
+// other than as SSE. Once it expires, writes fail with
+// os.ErrDeadlineExceeded. A d of 0 or less, or a server that cannot set
+// deadlines (e.g. an httptest recorder), leaves the write unbounded.
+func SetWriteDeadline(rc *http.ResponseController, d time.Duration) func() {
+    if d <= 0 || rc.SetWriteDeadline(time.Now().Add(d)) != nil {
+        return func() {}
+    }
+    return func() { _ = rc.SetWriteDeadline(time.Time{}) }
+}
+
+// flush pushes buffered output to the client. With gzip the compressor is
+// flushed first so the event is not held back waiting for a full block.
+func (w *Writer) flush() error {
+    if w.gz != nil {
+        if err := w.gz.Flush(); err != nil {
+            return err
+        }
+    }
+    if err := w.rc.Flush(); err != nil {
+        return err
+    }
+    w.lastFlush, w.pending = time.Now(), false
+    return nil
+}
+
+// EnableGzip compresses everything written from now on. It must be called
+// before the first write, while headers can still be set, and only for
+// clients that AcceptsGzip. Close must then be called to end the stream.
+func (w *Writer) EnableGzip() {
+    w.w.Header().Set("Content-Encoding", "gzip")
+    w.w.Header().Add("Vary", "Accept-Encoding")
+    w.gz = gzip.NewWriter(w.w)
+}
+
+// Close sends any events batching held back and ends the gzip stream, if
+// any. It does not close the connection.
+func (w *Writer) Close() error {
+    err := w.Flush()
+    if w.gz != nil {
+        err = errors.Join(err, w.gz.Close())
+    }
+    return err
+}
+
+// AcceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func AcceptsGzip(r *http.Request) bool {
+    for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+        coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+        if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+            q := strings.ReplaceAll(params, " ", "")
+            return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+        }
+    }
+    return false
+}
@@ -0,0 +1,215 @@
+package streamingcore
+
+import (
+    "compress/gzip"
+    "errors"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestWriterMaxEventBytes(t *testing.T) {
+    rec := httptest.NewRecorder()
+    w, err := NewWriter(rec)
+    if err != nil {
+        t.Fatal(err)
+    }
+    w.MaxEventBytes = 100
+    if err := w.Write(Event{Data: strings.Repeat("x", 101)}); !errors.Is(err, ErrEventTooLarge) {
+        t.Fatalf("101-byte event: err = %v, want ErrEventTooLarge", err)
+    }
+    if rec.Body.Len() != 0 {
+        t.Fatalf("rejected event wrote %q", rec.Body.String())
+    }
+    if err := w.Write(Event{Data: strings.Repeat("x", 100)}); err != nil {
+        t.Fatalf("100-byte event: %v", err)
+    }
+    if err := w.WriteComment(strings.Repeat("c", 101)); !errors.Is(err, ErrEventTooLarge) {
+        t.Fatalf("101-byte comment: err = %v, want ErrEventTooLarge", err)
+    }
+}
+
+// plainWriter hides the recorder's Flush, like a middleware that does not
+// pass it on.
+type plainWriter struct{ http.ResponseWriter }
+
+// unwrapWriter hides Flush but exposes the writer it wraps.
+type unwrapWriter struct{ http.ResponseWriter }
+
+func (u unwrapWriter) Unwrap() http.ResponseWriter { return u.ResponseWriter }
+
+func TestCanFlush(t *testing.T) {
+    rec := httptest.NewRecorder()
+    if !CanFlush(rec) {
+        t.Error("recorder: CanFlush = false")
+    }
+    if CanFlush(plainWriter{rec}) {
+        t.Error("writer without Flush: CanFlush = true")
+    }
+    if !CanFlush(unwrapWriter{unwrapWriter{rec}}) {
+        t.Error("wrapped recorder: CanFlush = false")
+    }
+    if _, err := NewWriter(plainWriter{rec}); !errors.Is(err, ErrFlushUnsupported) {
+        t.Errorf("NewWriter without Flush: err = %v, want ErrFlushUnsupported", err)
+    }
+}
+
+func TestWriterWireFormat(t *testing.T) {
+    rec := httptest.NewRecorder()
+    w, err := NewWriter(rec)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var writes, written int
+    w.OnWrite = func(n int, err error) {
+        writes++
+        written += n
+    }
+    _ = w.WriteRetry(1000)
+    _ = w.Write(Event{ID: "1", Name: "tick", Data: "a\nb"})
+    _ = w.WriteComment("ping")
+    want := "retry: 1000\n\nid: 1\nevent: tick\ndata: a\ndata: b\n\n: ping\n\n"
+    if got := rec.Body.String(); got != want {
+        t.Fatalf("body = %q, want %q", got, want)
+    }
+    if !rec.Flushed {
+        t.Error("events were not flushed")
+    }
+    if writes != 3 || written != len(want) {
+        t.Errorf("OnWrite saw %d writes of %d bytes, want 3 of %d", writes, written, len(want))
+    }
+}
+
+func TestWriterGzip(t *testing.T) {
+    rec := httptest.NewRecorder()
+    w, _ := NewWriter(rec)
+    w.EnableGzip()
+    _ = w.Write(Event{Data: "hello"})
+    if err := w.Close(); err != nil {
+        t.Fatal(err)
+    }
+    if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" {
+        t.Fatalf("headers = %v", rec.Header())
+    }
+    zr, err := gzip.NewReader(rec.Body)
+    if err != nil {
+        t.Fatal(err)
+    }
+    body, err := io.ReadAll(zr)
+    if err != nil || string(body) != "data: hello\n\n" {
+        t.Fatalf("decompressed body = %q, %v", body, err)
+    }
+}
+
+// countingFlusher counts the flushes that reach the response.
+type countingFlusher struct {
+    *httptest.ResponseRecorder
+    flushes int
+}
+
+func (c *countingFlusher) Flush() {
+    c.flushes++
+    c.ResponseRecorder.Flush()
+}
+
+func TestWriterBatchInterval(t *testing.T) {
+    cf := &countingFlusher{ResponseRecorder: httptest.NewRecorder()}
+    w, _ := NewWriter(cf)
+    w.BatchInterval = time.Hour
+    for i := 0; i < 5; i++ {
+        _ = w.Write(Event{Data: "x"})
+    }
+    // The first write flushes; the rest wait for the next flush.
+    if cf.flushes != 1 {
+        t.Fatalf("flushes after 5 writes = %d, want 1", cf.flushes)
+    }
+    _ = w.Flush()
+    _ = w.Flush()
+    if cf.flushes != 2 {
+        t.Fatalf("flushes after Flush = %d, want 2", cf.flushes)
+    }
+    if got := strings.Count(cf.Body.String(), "data: x\n\n"); got != 5 {
+        t.Fatalf("body has %d events, want 5", got)
+    }
+}
+
+// discardFlusher counts flushes and throws the body away, so benchmarks
+// do not measure a growing buffer.
+type discardFlusher struct {
+    header  http.Header
+    flushes int
+}
+
+func (d *discardFlusher) Header() http.Header         { return d.header }
+func (d *discardFlusher) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardFlusher) WriteHeader(int)             {}
+func (d *discardFlusher) Flush()                      { d.flushes++ }
+
+// BenchmarkWriterFlushes compares flushes, i.e. TCP writes, per event
+// without batching and with a BatchInterval, at the rate of a tight loop.
+func BenchmarkWriterFlushes(b *testing.B) {
+    for _, batch := range []time.Duration{0, time.Millisecond, 10 * time.Millisecond} {
+        b.Run("batch="+batch.String(), func(b *testing.B) {
+            d := &discardFlusher{header: http.Header{}}
+            w, _ := NewWriter(d)
+            w.BatchInterval = batch
+            e := Event{ID: "1", Name: "number", Data: "12345"}
+            b.ReportAllocs()
+            for i := 0; i < b.N; i++ {
+                if err := w.Write(e); err != nil {
+                    b.Fatal(err)
+                }
+            }
+            _ = w.Flush()
+            b.ReportMetric(float64(d.flushes)/float64(b.N), "flushes/op")
+        })
+    }
+}
+
+func TestSetWriteDeadline(t *testing.T) {
+    errc := make(chan error, 1)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        sw, _ := NewWriter(w)
+        sw.WriteTimeout = time.Nanosecond
+        errc <- sw.Write(Event{Data: "late"})
+    }))
+    defer srv.Close()
+    if resp, err := http.Get(srv.URL); err == nil {
+        resp.Body.Close()
+    }
+    if err := <-errc; !errors.Is(err, ErrWriteTimeout) {
+        t.Fatalf("write past the deadline: err = %v, want ErrWriteTimeout", err)
+    }
+
+    // Recorders cannot set deadlines; the write just goes ahead.
+    rc := http.NewResponseController(httptest.NewRecorder())
+    SetWriteDeadline(rc, time.Second)()
+}
+
+func TestAcceptsGzip(t *testing.T) {
+    tests := []struct {
+        header string
+        want   bool
+    }{
+        {"", false},
+        {"gzip", true},
+        {"deflate, gzip;q=0.5", true},
+        {"GZIP", true},
+        {"gzip;q=0", false},
+        {"gzip; q=0.000", false},
+        {"br, deflate", false},
+        {"x-gzip", false},
+    }
+    for _, tt := range tests {
+        r := httptest.NewRequest(http.MethodGet, "/", nil)
+        if tt.header != "" {
+            r.Header.Set("Accept-Encoding", tt.header)
+        }
+        if got := AcceptsGzip(r); got != tt.want {
+            t.Errorf("AcceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+        }
+    }
+}